@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StageError is an error caused by the stage at Index of a pipeline
+type StageError struct {
+	Index int
+	Stage string
+	Err   error
+}
+
+// Error return the error prefixed by the position of the stage
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage[%d].%s: %v", e.Index, e.Stage, e.Err)
+}
+
+// Unwrap return the original error
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// stageNameReference match the names of the stages mentioned in a server error message
+var stageNameReference = regexp.MustCompile(`\$[A-Za-z]+`)
+
+// AggregateAll run the pipeline on the collection and decode all the resulting documents into results, that must be a pointer to a slice
+func AggregateAll(ctx context.Context, collection *mongo.Collection, pipeline bson.A, results interface{}, opts ...*options.AggregateOptions) error {
+	cur, err := collection.Aggregate(ctx, pipeline, opts...)
+	if err != nil {
+		return wrapStageError(pipeline, err)
+	}
+
+	if err := cur.All(ctx, results); err != nil {
+		return wrapStageError(pipeline, err)
+	}
+	return nil
+}
+
+// AggregateOne run the pipeline on the collection and decode the first resulting document into result.
+// It return mongo.ErrNoDocuments if the pipeline doesn't return any document
+func AggregateOne(ctx context.Context, collection *mongo.Collection, pipeline bson.A, result interface{}, opts ...*options.AggregateOptions) error {
+	cur, err := collection.Aggregate(ctx, pipeline, opts...)
+	if err != nil {
+		return wrapStageError(pipeline, err)
+	}
+	defer cur.Close(ctx)
+
+	if !cur.Next(ctx) {
+		if err := cur.Err(); err != nil {
+			return wrapStageError(pipeline, err)
+		}
+		return mongo.ErrNoDocuments
+	}
+	return cur.Decode(result)
+}
+
+// AggregatePage run the pipeline followed by the APPagingStages on the collection and return the decoded page.
+// The content of the page can be decoded with Page.DecodeContent
+func AggregatePage(ctx context.Context, collection *mongo.Collection, pipeline bson.A, page int, size int, paging PagingOptions, opts ...*options.AggregateOptions) (*Page, error) {
+	if paging.Shape == PageShapeCustom {
+		return nil, errors.New("the custom page shape can't be decoded")
+	}
+
+	stages := APPagingStages(page, size, paging)
+	if stages == nil {
+		return nil, fmt.Errorf("invalid page %d of size %d", page, size)
+	}
+
+	var raw bson.Raw
+	if err := AggregateOne(ctx, collection, MAPipeline(pipeline, stages), &raw, opts...); err != nil {
+		return nil, err
+	}
+	return DecodePage(raw, paging.Shape)
+}
+
+// UpdateOneWithPipeline update the first document of the collection that match the filter with the update pipeline
+func UpdateOneWithPipeline(ctx context.Context, collection *mongo.Collection, filter interface{}, update *UpdatePipeline, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	pipeline, err := update.Bson()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := collection.UpdateOne(ctx, filter, pipeline, opts...)
+	if err != nil {
+		return nil, wrapStageError(pipeline, err)
+	}
+	return res, nil
+}
+
+// UpdateManyWithPipeline update all the documents of the collection that match the filter with the update pipeline
+func UpdateManyWithPipeline(ctx context.Context, collection *mongo.Collection, filter interface{}, update *UpdatePipeline, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	pipeline, err := update.Bson()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := collection.UpdateMany(ctx, filter, pipeline, opts...)
+	if err != nil {
+		return nil, wrapStageError(pipeline, err)
+	}
+	return res, nil
+}
+
+// wrapStageError return err wrapped in a StageError when it's a server error that mention a stage
+// that occurs only once in the pipeline, otherwise it return err
+func wrapStageError(pipeline bson.A, err error) error {
+	messages := serverErrorMessages(err)
+	if len(messages) == 0 {
+		return err
+	}
+
+	normalized, normErr := normalizePipeline(pipeline)
+	if normErr != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		for _, name := range stageNameReference.FindAllString(message, -1) {
+			index := -1
+			for i, s := range normalized {
+				stage, ok := s.(bson.D)
+				if !ok || len(stage) != 1 || stage[0].Key != name {
+					continue
+				}
+				if index != -1 {
+					index = -2
+					break
+				}
+				index = i
+			}
+
+			if index >= 0 {
+				return &StageError{Index: index, Stage: name, Err: err}
+			}
+		}
+	}
+
+	return err
+}
+
+// serverErrorMessages return the messages of err, if it's a error returned by the server to a command or to a write
+func serverErrorMessages(err error) []string {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return []string{cmdErr.Message}
+	}
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		messages := []string{}
+		for _, e := range writeErr.WriteErrors {
+			messages = append(messages, e.Message)
+		}
+		if writeErr.WriteConcernError != nil {
+			messages = append(messages, writeErr.WriteConcernError.Message)
+		}
+		return messages
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestWrapStageError(t *testing.T) {
+	pipeline := MAPipeline(
+		APMatch(bson.M{"a": 1}),
+		APSet(bson.M{"b": 1}),
+		APSet(bson.M{"c": 1}),
+		APGroup(bson.M{"_id": "$a"}),
+	)
+	tests := []struct {
+		name      string
+		err       error
+		wantIndex int
+		wantStage string
+	}{
+		{"command error", mongo.CommandError{Code: 15952, Message: "unknown group operator '$foo' in $group"}, 3, "$group"},
+		{"wrapped command error", fmt.Errorf("aggregate: %w", mongo.CommandError{Message: "$match: bad filter"}), 0, "$match"},
+		{"write exception", mongo.WriteException{WriteErrors: mongo.WriteErrors{
+			{Code: 40352, Message: "Invalid $group :: caused by :: FieldPath cannot be constructed with empty string"},
+		}}, 3, "$group"},
+		{"write concern error", mongo.WriteException{WriteConcernError: &mongo.WriteConcernError{Message: "$match timed out"}}, 0, "$match"},
+		{"stage repeated in the pipeline", mongo.CommandError{Message: "invalid $set"}, -1, ""},
+		{"stage not in the pipeline", mongo.CommandError{Message: "invalid $unwind"}, -1, ""},
+		{"not a server error", errors.New("$group failed"), -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapStageError(pipeline, tt.err)
+			var stageErr *StageError
+			if !errors.As(err, &stageErr) {
+				if tt.wantIndex >= 0 {
+					t.Fatalf("expected a StageError, got %v", err)
+				}
+				if err.Error() != tt.err.Error() {
+					t.Errorf("expected the original error, got %v", err)
+				}
+				return
+			}
+			if tt.wantIndex < 0 {
+				t.Fatalf("unexpected StageError %v", err)
+			}
+			if stageErr.Index != tt.wantIndex || stageErr.Stage != tt.wantStage {
+				t.Errorf("got stage[%d].%s, want stage[%d].%s", stageErr.Index, stageErr.Stage, tt.wantIndex, tt.wantStage)
+			}
+			if stageErr.Err.Error() != tt.err.Error() {
+				t.Errorf("the StageError doesn't wrap the original error")
+			}
+		})
+	}
+}
+
+func TestAggregatePageInvalidArguments(t *testing.T) {
+	tests := []struct {
+		name       string
+		page, size int
+		options    PagingOptions
+	}{
+		{"custom shape", 0, 10, PagingOptions{Shape: PageShapeCustom}},
+		{"invalid size", 0, 0, PagingOptions{}},
+		{"invalid page", -1, 10, PagingOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := AggregatePage(context.Background(), nil, MAPipeline(), tt.page, tt.size, tt.options); err == nil {
+				t.Error("expected a error")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Expr is a typed aggregation expression. It can be built only with Field, Var, Lit and the E* functions,
+// so a stage or a plain go value can't be used where a expression is expected.
+// A Expr can be used directly inside a bson document because it marshal to the same bson of its untyped counterpart
+type Expr interface {
+	// Bson return the untyped expression, as accepted and returned by the APO* functions
+	Bson() interface{}
+	expr()
+}
+
+// FieldRef is a expression that refer to the field path of the current document, like $a.b
+type FieldRef string
+
+// Field return a reference to the field path of the current document
+func Field(path string) FieldRef {
+	return FieldRef(strings.TrimPrefix(path, "$"))
+}
+
+// Path return the dotted path of the field, without the $ prefix
+func (f FieldRef) Path() string {
+	return string(f)
+}
+
+// Sub return a reference to the subfield name of the field
+func (f FieldRef) Sub(name string) FieldRef {
+	return FieldRef(string(f) + "." + name)
+}
+
+// Bson return the field path as a $ prefixed string
+func (f FieldRef) Bson() interface{} {
+	return "$" + string(f)
+}
+
+// MarshalBSONValue marshal the field path as a $ prefixed string
+func (f FieldRef) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(f.Bson())
+}
+
+func (f FieldRef) expr() {}
+
+// VarRef is a expression that refer to a variable, or to a field path of a variable, like $$this.name
+type VarRef string
+
+// Var return a reference to the variable name, without the $$ prefix
+func Var(name string) VarRef {
+	return VarRef(strings.TrimPrefix(name, "$$"))
+}
+
+// the system variables and the variables used by $map, $filter and $reduce
+var (
+	This    = Var("this")
+	Value   = Var("value")
+	Root    = Var("ROOT")
+	Current = Var("CURRENT")
+	Remove  = Var("REMOVE")
+)
+
+// Sub return a reference to the field path of the variable
+func (v VarRef) Sub(path string) VarRef {
+	return VarRef(string(v) + "." + path)
+}
+
+// Bson return the variable as a $$ prefixed string
+func (v VarRef) Bson() interface{} {
+	return "$$" + string(v)
+}
+
+// MarshalBSONValue marshal the variable as a $$ prefixed string
+func (v VarRef) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(v.Bson())
+}
+
+func (v VarRef) expr() {}
+
+// literalExpr is a expression that return a constant value
+type literalExpr struct {
+	value interface{}
+}
+
+// Lit return a expression that return the constant value. The documents, the arrays and the strings beginning with $
+// are wrapped in a $literal to not be interpreted as operators, expressions or field paths
+func Lit(value interface{}) Expr {
+	return literalExpr{value: value}
+}
+
+// Bson return the constant value, wrapped in a $literal if it could be interpreted as a expression
+func (l literalExpr) Bson() interface{} {
+	if s, ok := l.value.(string); ok {
+		if strings.HasPrefix(s, "$") {
+			return bson.M{"$literal": s}
+		}
+		return s
+	}
+	if t, _, err := bson.MarshalValue(l.value); err == nil && (t == bsontype.EmbeddedDocument || t == bsontype.Array) {
+		return bson.M{"$literal": l.value}
+	}
+	return l.value
+}
+
+// MarshalBSONValue marshal the constant value
+func (l literalExpr) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if l.value == nil {
+		return bsontype.Null, nil, nil
+	}
+	return bson.MarshalValue(l.Bson())
+}
+
+func (l literalExpr) expr() {}
+
+// operatorExpr is a expression built by a operator
+type operatorExpr struct {
+	value interface{}
+}
+
+// rawExpr return a expression from the untyped expr, that must be the result of a APO* function
+func rawExpr(expr interface{}) Expr {
+	return operatorExpr{value: expr}
+}
+
+// Bson return the untyped expression
+func (o operatorExpr) Bson() interface{} {
+	return o.value
+}
+
+// MarshalBSONValue marshal the untyped expression
+func (o operatorExpr) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(o.value)
+}
+
+func (o operatorExpr) expr() {}
+
+// Vars contains the variables defined by a ELet
+type Vars map[string]Expr
+
+// Bson return the variables as a untyped document
+func (v Vars) Bson() bson.M {
+	out := bson.M{}
+	for name, e := range v {
+		out[name] = e.Bson()
+	}
+	return out
+}
+
+// exprsToBson return the untyped expressions of the exprs
+func exprsToBson(exprs []Expr) []interface{} {
+	out := make([]interface{}, 0, len(exprs))
+	for _, e := range exprs {
+		out = append(out, e.Bson())
+	}
+	return out
+}
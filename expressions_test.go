@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTypedExpressionsRenderAsUntyped(t *testing.T) {
+	tests := []struct {
+		name    string
+		typed   Expr
+		untyped interface{}
+	}{
+		{"field", Field("a.b"), "$a.b"},
+		{"field with prefix", Field("$a").Sub("b"), "$a.b"},
+		{"variable", This.Sub("qty"), "$$this.qty"},
+		{"add", EAdd(Field("a"), Lit(1)), APOAdd("$a", 1)},
+		{"cond", ECond(EGreater(Field("n"), Lit(2)), Lit("big"), Lit("small")), APOCond(APOGreater("$n", 2), "big", "small")},
+		{"let", ELet(Vars{"x": Field("n")}, EMultiply(Var("x"), Var("x"))), APOLet(bson.M{"x": "$n"}, APOMultiply("$$x", "$$x"))},
+		{"map", EMap(Field("list"), "v", EAdd(Var("v"), Lit(1))), APOMap("$list", "v", APOAdd("$$v", 1))},
+		{"reduce", EReduce(Field("list"), Lit(0), EAdd(Value, This)), APOReduce("$list", 0, APOAdd("$$value", "$$this"))},
+		{"join", EJoin(Field("words"), Lit(",")), APOJoin("$words", ",")},
+		{"sum reducer", ESumReducer(Field("items"), This.Sub("qty")), APOSumReducer("$items", "$$this.qty")},
+		{"date trunc", EDateTrunc(Field("date"), "day", "UTC"), APODateTrunc("$date", "day", "UTC")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := testJSON(t, tt.typed), testJSON(t, tt.untyped); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+			if got, want := testJSON(t, tt.typed.Bson()), testJSON(t, tt.untyped); got != want {
+				t.Errorf("Bson() got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLit(t *testing.T) {
+	date := time.Date(2019, 11, 5, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		value    interface{}
+		wantBson string
+	}{
+		{"number", 3, `3`},
+		{"string", "abc", `"abc"`},
+		{"field path string", "$a", `{"$literal": "$a"}`},
+		{"date", date, `{"$date": "2019-11-05T00:00:00Z"}`},
+		{"null", nil, `null`},
+		{"operator document", bson.M{"$add": bson.A{1, 2}}, `{"$literal": {"$add": [1, 2]}}`},
+		{"ordered document", bson.D{{Key: "a", Value: "$b"}}, `{"$literal": {"a": "$b"}}`},
+		{"array of field paths", bson.A{"$a"}, `{"$literal": ["$a"]}`},
+		{"slice", []int{1, 2}, `{"$literal": [1, 2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, Lit(tt.value), tt.wantBson)
+
+			got, err := EvalExpression(Lit(tt.value), bson.M{"a": 1, "b": 2}, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if g, w := testJSON(t, got), testJSON(t, tt.value); g != w {
+				t.Errorf("evaluated to %s, want the value itself %s", g, w)
+			}
+		})
+	}
+}
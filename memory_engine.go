@@ -0,0 +1,876 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryEngine is a in-memory evaluator of the aggregation pipelines built with mu.
+// It allow to test the pipelines in ordinary go tests without a running mongod
+type MemoryEngine struct {
+	collections map[string][]bson.D
+}
+
+// NewMemoryEngine return a MemoryEngine without collections
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{
+		collections: map[string][]bson.D{},
+	}
+}
+
+// AddCollection add the collection name, used by the $lookup stages, containing the docs.
+// The docs could be a []bson.M, a []bson.D or a slice of any other type marshallable to a bson document
+func (e *MemoryEngine) AddCollection(name string, docs interface{}) error {
+	normalized, err := normalizeDocuments(docs)
+	if err != nil {
+		return err
+	}
+
+	e.collections[name] = normalized
+	return nil
+}
+
+// Aggregate return the documents produced by the pipeline when it's executed over the docs.
+// The docs could be a []bson.M, a []bson.D or a slice of any other type marshallable to a bson document
+func (e *MemoryEngine) Aggregate(pipeline bson.A, docs interface{}) ([]bson.D, error) {
+	normalized, err := normalizeDocuments(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	stages, err := normalizePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.runPipeline(stages, normalized, nil)
+}
+
+// AggregateCollection return the documents produced by the pipeline when it's executed over the collection name
+func (e *MemoryEngine) AggregateCollection(name string, pipeline bson.A) ([]bson.D, error) {
+	docs, ok := e.collections[name]
+	if !ok {
+		return nil, fmt.Errorf("collection %s doesn't exist", name)
+	}
+
+	stages, err := normalizePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.runPipeline(stages, docs, nil)
+}
+
+// runPipeline return the docs transformed by the stages. The vars are visible to every expression
+func (e *MemoryEngine) runPipeline(stages bson.A, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	for i, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("stage[%d]: a pipeline stage specification object must contain exactly one field", i)
+		}
+
+		out, err := e.runStage(stage[0].Key, stage[0].Value, docs, vars)
+		if err != nil {
+			return nil, &StageError{Index: i, Stage: stage[0].Key, Err: err}
+		}
+		docs = out
+	}
+
+	return docs, nil
+}
+
+// runStage return the docs transformed by the stage name with the argument arg
+func (e *MemoryEngine) runStage(name string, arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	switch name {
+	case "$match":
+		return stageMatch(arg, docs, vars)
+	case "$sort":
+		return stageSort(arg, docs)
+	case "$skip", "$limit":
+		n, ok := toInt64(arg)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("the argument must be a non-negative integer")
+		}
+		if name == "$limit" && n == 0 {
+			return nil, fmt.Errorf("the limit must be positive")
+		}
+		if n > int64(len(docs)) {
+			n = int64(len(docs))
+		}
+		if name == "$skip" {
+			return docs[n:], nil
+		}
+		return docs[:n], nil
+	case "$project":
+		return stageProject(arg, docs, vars)
+	case "$set", "$addFields":
+		return stageAddFields(arg, docs, vars)
+	case "$unset":
+		return stageUnset(arg, docs)
+	case "$unwind":
+		return stageUnwind(arg, docs)
+	case "$group":
+		return stageGroup(arg, docs, vars)
+	case "$bucket":
+		return stageBucket(arg, docs, vars)
+	case "$bucketAuto":
+		return stageBucketAuto(arg, docs, vars)
+	case "$setWindowFields":
+		return stageSetWindowFields(arg, docs, vars)
+	case "$densify":
+		return stageDensify(arg, docs)
+	case "$fill":
+		return stageFill(arg, docs, vars)
+	case "$facet":
+		return e.stageFacet(arg, docs, vars)
+	case "$count":
+		field, ok := arg.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, fmt.Errorf("the count field must be a non-empty string without $ and dots")
+		}
+		if len(docs) == 0 {
+			return []bson.D{}, nil
+		}
+		return []bson.D{{{Key: field, Value: numberFromInt64(int64(len(docs)))}}}, nil
+	case "$replaceWith":
+		return stageReplaceRoot(arg, docs, vars)
+	case "$replaceRoot":
+		spec, err := namedArgs(name, arg, []string{"newRoot"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return stageReplaceRoot(docGet(spec, "newRoot"), docs, vars)
+	case "$lookup":
+		return e.stageLookup(arg, docs, vars)
+	}
+
+	return nil, fmt.Errorf("unrecognized pipeline stage name")
+}
+
+// stageMatch return the docs that satisfy the filter
+func stageMatch(filter interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	scope := newExprScope(nil, vars)
+	out := []bson.D{}
+	for _, doc := range docs {
+		ok, err := matchDocument(doc, filter, scope)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, doc)
+		}
+	}
+
+	return out, nil
+}
+
+// sortKey return the value of the path used to sort the doc. Arrays are sorted by their minimum or maximum element
+func sortKey(doc bson.D, path string, direction int) interface{} {
+	v := getFieldPath(doc, path)
+	if isMissing(v) {
+		return nil
+	}
+	arr, ok := v.(bson.A)
+	if !ok {
+		return v
+	}
+	if len(arr) == 0 {
+		return missing
+	}
+
+	best := arr[0]
+	for _, item := range arr[1:] {
+		if c := compareValues(item, best); (direction > 0 && c < 0) || (direction < 0 && c > 0) {
+			best = item
+		}
+	}
+	return best
+}
+
+// stageSort return the docs sorted by the spec
+func stageSort(arg interface{}, docs []bson.D) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) == 0 {
+		return nil, fmt.Errorf("the $sort key specification must be a non-empty object")
+	}
+
+	directions := make([]int, len(spec))
+	for i, e := range spec {
+		n, ok := toInt64(e.Value)
+		if !ok || (n != 1 && n != -1) {
+			return nil, fmt.Errorf("$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+		directions[i] = int(n)
+	}
+
+	out := make([]bson.D, len(docs))
+	copy(out, docs)
+	sort.SliceStable(out, func(i, j int) bool {
+		for k, e := range spec {
+			c := compareValues(sortKey(out[i], e.Key, directions[k]), sortKey(out[j], e.Key, directions[k]))
+			if c != 0 {
+				return c*directions[k] < 0
+			}
+		}
+		return false
+	})
+
+	return out, nil
+}
+
+// isInclusionFlag return true and the value of the flag if v is a boolean or numeric projection flag
+func isInclusionFlag(v interface{}) (bool, bool) {
+	switch val := v.(type) {
+	case bool:
+		return val, true
+	case int32, int64, float64:
+		f, _ := toFloat(val)
+		return f != 0, true
+	}
+	return false, false
+}
+
+// stageProject return the docs projected by the spec
+func stageProject(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) == 0 {
+		return nil, fmt.Errorf("$project specification must be a non-empty object")
+	}
+
+	flat := flattenProjection(spec, "")
+	exclusion := false
+	inclusion := false
+	for _, e := range flat {
+		flag, isFlag := isInclusionFlag(e.Value)
+		switch {
+		case isFlag && !flag && e.Key != "_id":
+			exclusion = true
+		case !isFlag || flag:
+			inclusion = true
+		}
+	}
+	if exclusion && inclusion {
+		return nil, fmt.Errorf("cannot do exclusion and inclusion in the same projection")
+	}
+
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		projected, err := projectDocument(doc, flat, exclusion, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, projected)
+	}
+
+	return out, nil
+}
+
+// flattenProjection return the projection spec with the nested documents converted to dotted paths
+func flattenProjection(spec bson.D, prefix string) bson.D {
+	out := bson.D{}
+	for _, e := range spec {
+		if sub, ok := e.Value.(bson.D); ok && len(sub) > 0 && !isOperatorDocument(sub) {
+			out = append(out, flattenProjection(sub, prefix+e.Key+".")...)
+		} else {
+			out = append(out, bson.E{Key: prefix + e.Key, Value: e.Value})
+		}
+	}
+	return out
+}
+
+// projectDocument return the doc projected by the flattened spec
+func projectDocument(doc bson.D, flat bson.D, exclusion bool, scope *exprScope) (bson.D, error) {
+	if exclusion {
+		out := doc
+		for _, e := range flat {
+			if flag, _ := isInclusionFlag(e.Value); !flag {
+				out = unsetFieldPath(out, e.Key)
+			}
+		}
+		return out, nil
+	}
+
+	out := bson.D{}
+	idFlag, idIsFlag := isInclusionFlag(docGet(flat, "_id"))
+	if isMissing(docGet(flat, "_id")) || (idIsFlag && idFlag) {
+		if id := docGet(doc, "_id"); !isMissing(id) {
+			out = append(out, bson.E{Key: "_id", Value: id})
+		}
+	}
+
+	included := []string{}
+	for _, e := range flat {
+		if flag, isFlag := isInclusionFlag(e.Value); isFlag && flag && e.Key != "_id" {
+			included = append(included, e.Key)
+		}
+	}
+	out = append(out, includePaths(doc, included, "")...)
+
+	for _, e := range flat {
+		if _, isFlag := isInclusionFlag(e.Value); isFlag {
+			continue
+		}
+		v, err := evalExpression(e.Value, scope)
+		if err != nil {
+			return nil, err
+		}
+		out = setFieldPath(out, e.Key, v)
+	}
+
+	return out, nil
+}
+
+// includePaths return the fields of doc that are included by the paths, keeping the original order
+func includePaths(doc bson.D, paths []string, prefix string) bson.D {
+	out := bson.D{}
+	for _, e := range doc {
+		full := prefix + e.Key
+		for _, p := range paths {
+			if p == full {
+				out = append(out, e)
+				break
+			}
+			if strings.HasPrefix(p, full+".") {
+				switch val := e.Value.(type) {
+				case bson.D:
+					out = append(out, bson.E{Key: e.Key, Value: includePaths(val, paths, full+".")})
+				case bson.A:
+					arr := bson.A{}
+					for _, item := range val {
+						if sub, ok := item.(bson.D); ok {
+							arr = append(arr, includePaths(sub, paths, full+"."))
+						}
+					}
+					out = append(out, bson.E{Key: e.Key, Value: arr})
+				}
+				break
+			}
+		}
+	}
+	return out
+}
+
+// stageAddFields return the docs with the fields in the spec added
+func stageAddFields(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the specification must be an object")
+	}
+
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		added, err := addFields(doc, doc, spec, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, added)
+	}
+
+	return out, nil
+}
+
+// addFields return the target with the fields in the spec evaluated in the scope added.
+// The nested documents in the spec are merged with the existing embedded documents
+func addFields(target bson.D, doc bson.D, spec bson.D, scope *exprScope) (bson.D, error) {
+	for _, e := range spec {
+		if sub, ok := e.Value.(bson.D); ok && len(sub) > 0 && !isOperatorDocument(sub) && !strings.Contains(e.Key, ".") {
+			existing, _ := docGet(target, e.Key).(bson.D)
+			if existing == nil {
+				existing = bson.D{}
+			}
+			merged, err := addFields(existing, doc, sub, scope)
+			if err != nil {
+				return nil, err
+			}
+			target = docSet(target, e.Key, merged)
+			continue
+		}
+
+		v, err := evalExpression(e.Value, scope)
+		if err != nil {
+			return nil, err
+		}
+		target = setFieldPath(target, e.Key, v)
+	}
+
+	return target, nil
+}
+
+// stageUnset return the docs without the fields in the arg
+func stageUnset(arg interface{}, docs []bson.D) ([]bson.D, error) {
+	fields, ok := arg.(bson.A)
+	if !ok {
+		fields = bson.A{arg}
+	}
+
+	paths := make([]string, 0, len(fields))
+	for _, f := range fields {
+		p, ok := f.(string)
+		if !ok || p == "" {
+			return nil, fmt.Errorf("$unset specification must be a string or an array of strings")
+		}
+		paths = append(paths, p)
+	}
+
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		for _, p := range paths {
+			doc = unsetFieldPath(doc, p)
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+// stageUnwind return the docs with the array at path unwinded
+func stageUnwind(arg interface{}, docs []bson.D) ([]bson.D, error) {
+	path, indexField, preserve := "", "", false
+	switch spec := arg.(type) {
+	case string:
+		path = spec
+	case bson.D:
+		p, ok := docGet(spec, "path").(string)
+		if !ok {
+			return nil, fmt.Errorf("no path specified to $unwind stage")
+		}
+		path = p
+		if idx, ok := docGet(spec, "includeArrayIndex").(string); ok {
+			indexField = idx
+		}
+		preserve = isTruthy(docGet(spec, "preserveNullAndEmptyArrays"))
+	default:
+		return nil, fmt.Errorf("expected either a string or an object as specification for $unwind stage")
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path option to $unwind stage should be prefixed with a '$'")
+	}
+	path = path[1:]
+
+	out := []bson.D{}
+	for _, doc := range docs {
+		v := getFieldPath(doc, path)
+		arr, isArray := v.(bson.A)
+		switch {
+		case isArray && len(arr) > 0:
+			for i, item := range arr {
+				unwinded := setFieldPath(doc, path, item)
+				if indexField != "" {
+					unwinded = setFieldPath(unwinded, indexField, int64(i))
+				}
+				out = append(out, unwinded)
+			}
+		case isArray || isNullish(v):
+			if preserve {
+				if indexField != "" {
+					doc = setFieldPath(doc, indexField, nil)
+				}
+				out = append(out, doc)
+			}
+		default:
+			if indexField != "" {
+				doc = setFieldPath(doc, indexField, nil)
+			}
+			out = append(out, doc)
+		}
+	}
+
+	return out, nil
+}
+
+// memoryGroup is a group of documents with the same _id
+type memoryGroup struct {
+	id     interface{}
+	values map[string][]interface{}
+}
+
+// stageGroup return a document for each distinct _id with the accumulated fields
+func stageGroup(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("a group's fields must be specified in an object")
+	}
+	idExpr := docGet(spec, "_id")
+	if isMissing(idExpr) {
+		return nil, fmt.Errorf("a group specification must include an _id")
+	}
+
+	accumulators, err := groupAccumulators(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		id, err := evalExpression(idExpr, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		if isMissing(id) {
+			id = nil
+		}
+		ids[i] = id
+	}
+
+	return groupDocuments(docs, ids, accumulators, vars)
+}
+
+// groupAccumulators return the fields of the spec, except the _id, checking that they are accumulators
+func groupAccumulators(spec bson.D) (bson.D, error) {
+	accumulators := bson.D{}
+	for _, e := range spec {
+		if e.Key == "_id" {
+			continue
+		}
+		acc, ok := e.Value.(bson.D)
+		if !ok || len(acc) != 1 || !strings.HasPrefix(acc[0].Key, "$") {
+			return nil, fmt.Errorf("the field '%s' must be an accumulator object", e.Key)
+		}
+		accumulators = append(accumulators, e)
+	}
+
+	return accumulators, nil
+}
+
+// groupDocuments return a document for each distinct id, in order of appearance, with the accumulated fields.
+// ids contains the id of each document of docs
+func groupDocuments(docs []bson.D, ids []interface{}, accumulators bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	groups := []*memoryGroup{}
+	for i, doc := range docs {
+		scope := newExprScope(doc, vars)
+		id := ids[i]
+
+		var group *memoryGroup
+		for _, g := range groups {
+			if valuesEqual(g.id, id) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &memoryGroup{id: id, values: map[string][]interface{}{}}
+			groups = append(groups, group)
+		}
+
+		for _, e := range accumulators {
+			acc := e.Value.(bson.D)[0]
+			var v interface{} = int32(1)
+			if acc.Key != "$count" {
+				var err error
+				if v, err = evalExpression(acc.Value, scope); err != nil {
+					return nil, err
+				}
+			}
+			group.values[e.Key] = append(group.values[e.Key], v)
+		}
+	}
+
+	out := make([]bson.D, 0, len(groups))
+	for _, g := range groups {
+		doc := bson.D{{Key: "_id", Value: g.id}}
+		for _, e := range accumulators {
+			name := e.Value.(bson.D)[0].Key
+			if name == "$count" {
+				name = "$sum"
+			}
+			v, err := accumulate(name, g.values[e.Key])
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: e.Key, Value: v})
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+// bucketOutput return the accumulators of the output of $bucket and $bucketAuto, that by default count the documents
+func bucketOutput(spec bson.D) (bson.D, error) {
+	output := docGet(spec, "output")
+	if isMissing(output) {
+		return bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}, nil
+	}
+	fields, ok := output.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the 'output' field must be an object")
+	}
+	return groupAccumulators(fields)
+}
+
+// stageBucket return a document for each bucket of the boundaries that contains at least a document, plus the default bucket
+func stageBucket(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the argument to $bucket must be an object")
+	}
+	boundaries, ok := docGet(spec, "boundaries").(bson.A)
+	if !ok || len(boundaries) < 2 {
+		return nil, fmt.Errorf("the 'boundaries' field must be an array of at least 2 values")
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if compareValues(boundaries[i-1], boundaries[i]) >= 0 {
+			return nil, fmt.Errorf("the 'boundaries' field must be an array of values sorted in ascending order")
+		}
+	}
+	groupBy := docGet(spec, "groupBy")
+	defaultID := docGet(spec, "default")
+	accumulators, err := bucketOutput(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		v, err := evalExpression(groupBy, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		if isMissing(v) {
+			v = nil
+		}
+
+		ids[i] = missing
+		if typeOrder(v) == typeOrder(boundaries[0]) {
+			for j := 0; j+1 < len(boundaries); j++ {
+				if compareValues(boundaries[j], v) <= 0 && compareValues(v, boundaries[j+1]) < 0 {
+					ids[i] = boundaries[j]
+					break
+				}
+			}
+		}
+		if isMissing(ids[i]) {
+			if isMissing(defaultID) {
+				return nil, fmt.Errorf("$bucket could not find a matching branch for an input, and no default was specified")
+			}
+			ids[i] = defaultID
+		}
+	}
+
+	out, err := groupDocuments(docs, ids, accumulators, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// The buckets are sorted by boundary and the default bucket is the last one
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := docGet(out[i], "_id"), docGet(out[j], "_id")
+		if !isMissing(defaultID) && (valuesEqual(a, defaultID) || valuesEqual(b, defaultID)) {
+			return !valuesEqual(a, defaultID)
+		}
+		return compareValues(a, b) < 0
+	})
+	return out, nil
+}
+
+// stageBucketAuto return the documents distributed evenly into the requested number of buckets
+func stageBucketAuto(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the argument to $bucketAuto must be an object")
+	}
+	buckets, ok := toInt64(docGet(spec, "buckets"))
+	if !ok || buckets <= 0 {
+		return nil, fmt.Errorf("the 'buckets' field must be a positive integer")
+	}
+	if !isMissing(docGet(spec, "granularity")) {
+		return nil, fmt.Errorf("the 'granularity' field is not supported")
+	}
+	groupBy := docGet(spec, "groupBy")
+	accumulators, err := bucketOutput(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(docs))
+	order := make([]int, len(docs))
+	for i, doc := range docs {
+		v, err := evalExpression(groupBy, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		if isMissing(v) {
+			v = nil
+		}
+		values[i] = v
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareValues(values[order[i]], values[order[j]]) < 0
+	})
+
+	// Every bucket is filled with its share of documents, extended to contain all the documents with the same value
+	sorted := make([]bson.D, len(docs))
+	ids := make([]interface{}, len(docs))
+	bounds := bson.A{}
+	for i, start := 0, 0; start < len(order); i++ {
+		end := (i + 1) * len(order) / int(buckets)
+		if end <= start {
+			end = start + 1
+		}
+		if end > len(order) {
+			end = len(order)
+		}
+		for end < len(order) && compareValues(values[order[end]], values[order[end-1]]) == 0 {
+			end++
+		}
+		bounds = append(bounds, values[order[start]])
+		for k := start; k < end; k++ {
+			sorted[k] = docs[order[k]]
+			ids[k] = int32(len(bounds) - 1)
+		}
+		start = end
+	}
+	if len(order) > 0 {
+		bounds = append(bounds, values[order[len(order)-1]])
+	}
+
+	out, err := groupDocuments(sorted, ids, accumulators, vars)
+	if err != nil {
+		return nil, err
+	}
+	for i, doc := range out {
+		doc[0].Value = bson.D{{Key: "min", Value: bounds[i]}, {Key: "max", Value: bounds[i+1]}}
+	}
+	return out, nil
+}
+
+// stageFacet return a single document containing the result of every sub-pipeline
+func (e *MemoryEngine) stageFacet(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) == 0 {
+		return nil, fmt.Errorf("the $facet specification must be a non-empty object")
+	}
+
+	out := bson.D{}
+	for _, f := range spec {
+		pipeline, ok := f.Value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("%s: a facet must be an array of stages", f.Key)
+		}
+		res, err := e.runPipeline(pipeline, docs, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Key, err)
+		}
+		arr := make(bson.A, 0, len(res))
+		for _, r := range res {
+			arr = append(arr, r)
+		}
+		out = append(out, bson.E{Key: f.Key, Value: arr})
+	}
+
+	return []bson.D{out}, nil
+}
+
+// stageReplaceRoot return the docs replaced by the newRoot expression
+func stageReplaceRoot(newRoot interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		v, err := evalExpression(newRoot, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		root, ok := v.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("'newRoot' expression must evaluate to an object, but resulting value was of type %s", typeName(v))
+		}
+		out = append(out, root)
+	}
+
+	return out, nil
+}
+
+// stageLookup return the docs with the matching documents of the foreign collection added
+func (e *MemoryEngine) stageLookup(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, err := namedArgs("$lookup", arg, []string{"from", "as"}, []string{"localField", "foreignField", "let", "pipeline"})
+	if err != nil {
+		return nil, err
+	}
+	from, _ := docGet(spec, "from").(string)
+	as, _ := docGet(spec, "as").(string)
+	foreign, ok := e.collections[from]
+	if !ok {
+		return nil, fmt.Errorf("collection %s doesn't exist in the memory engine", from)
+	}
+	localField, _ := docGet(spec, "localField").(string)
+	foreignField, _ := docGet(spec, "foreignField").(string)
+	if (localField == "") != (foreignField == "") {
+		return nil, fmt.Errorf("localField and foreignField must be specified together")
+	}
+	pipeline, hasPipeline := docGet(spec, "pipeline").(bson.A)
+	if localField == "" && !hasPipeline {
+		return nil, fmt.Errorf("either localField and foreignField or pipeline must be specified")
+	}
+	let, _ := docGet(spec, "let").(bson.D)
+
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		matching := foreign
+		if localField != "" {
+			matching = lookupEquality(doc, localField, foreign, foreignField)
+		}
+
+		if hasPipeline {
+			scope := newExprScope(doc, vars)
+			subVars := map[string]interface{}{}
+			for k, v := range vars {
+				subVars[k] = v
+			}
+			for _, l := range let {
+				v, err := evalExpression(l.Value, scope)
+				if err != nil {
+					return nil, err
+				}
+				subVars[l.Key] = v
+			}
+			if matching, err = e.runPipeline(pipeline, matching, subVars); err != nil {
+				return nil, err
+			}
+		}
+
+		arr := make(bson.A, 0, len(matching))
+		for _, m := range matching {
+			arr = append(arr, m)
+		}
+		out = append(out, setFieldPath(doc, as, arr))
+	}
+
+	return out, nil
+}
+
+// lookupEquality return the foreign docs whose foreignField is equal to the localField of doc
+func lookupEquality(doc bson.D, localField string, foreign []bson.D, foreignField string) []bson.D {
+	locals := expandArrays(getQueryPathValues(doc, localField))
+	out := []bson.D{}
+	for _, f := range foreign {
+		for _, l := range locals {
+			if isMissing(l) {
+				l = nil
+			}
+			ok, _ := matchOperator(f, foreignField, "$eq", l, "", nil)
+			if ok {
+				out = append(out, f)
+				break
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,362 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultDateFormat is the format used by $dateToString when no format is given
+const defaultDateFormat = "%Y-%m-%dT%H:%M:%S.%LZ"
+
+// weekdays contains the days accepted by the startOfWeek argument of $dateTrunc
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+// timeUnitDurations contains the duration of the time units with a fixed length
+var timeUnitDurations = map[string]time.Duration{
+	"week":        7 * 24 * time.Hour,
+	"day":         24 * time.Hour,
+	"hour":        time.Hour,
+	"minute":      time.Minute,
+	"second":      time.Second,
+	"millisecond": time.Millisecond,
+}
+
+// evalDateArgs evaluate the named arguments of the date operator name and return the date in the timezone,
+// or a nil time if the date is null
+func evalDateArgs(name string, args interface{}, required []string, optional []string, scope *exprScope) (map[string]interface{}, *time.Time, error) {
+	doc, err := namedArgs(name, args, required, optional)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]interface{}{}
+	for _, e := range doc {
+		if values[e.Key], err = evalExpression(e.Value, scope); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if isNullish(values["date"]) {
+		return values, nil, nil
+	}
+	date, ok := values["date"].(primitive.DateTime)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s requires 'date' to be a date, but got %s", name, typeName(values["date"]))
+	}
+
+	loc := time.UTC
+	if tz, ok := values["timezone"].(string); ok {
+		if loc, err = parseTimezone(tz); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	t := date.Time().In(loc)
+	return values, &t, nil
+}
+
+// evalDateToString evaluate the $dateToString operator
+func evalDateToString(args interface{}, scope *exprScope) (interface{}, error) {
+	values, t, err := evalDateArgs("$dateToString", args, []string{"date"}, []string{"format", "timezone", "onNull"}, scope)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		if onNull, ok := values["onNull"]; ok && !isMissing(onNull) {
+			return onNull, nil
+		}
+		return nil, nil
+	}
+
+	format := defaultDateFormat
+	if f, ok := values["format"]; ok && !isNullish(f) {
+		if format, ok = f.(string); !ok {
+			return nil, fmt.Errorf("$dateToString requires 'format' to be a string, but got %s", typeName(f))
+		}
+	}
+
+	return formatDateString(*t, format)
+}
+
+// formatDateString return the time t formatted with the mongodb format
+func formatDateString(t time.Time, format string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+		if i+1 >= len(format) {
+			return "", fmt.Errorf("unmatched '%%' at end of format string")
+		}
+		i++
+
+		isoYear, isoWeek := t.ISOWeek()
+		_, offset := t.Zone()
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&sb, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&sb, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&sb, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&sb, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&sb, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&sb, "%02d", t.Second())
+		case 'L':
+			fmt.Fprintf(&sb, "%03d", t.Nanosecond()/int(time.Millisecond))
+		case 'j':
+			fmt.Fprintf(&sb, "%03d", t.YearDay())
+		case 'w':
+			fmt.Fprintf(&sb, "%d", int(t.Weekday())+1)
+		case 'u':
+			fmt.Fprintf(&sb, "%d", (int(t.Weekday())+6)%7+1)
+		case 'U':
+			fmt.Fprintf(&sb, "%02d", (t.YearDay()+6-int(t.Weekday()))/7)
+		case 'G':
+			fmt.Fprintf(&sb, "%04d", isoYear)
+		case 'V':
+			fmt.Fprintf(&sb, "%02d", isoWeek)
+		case 'z':
+			sign := '+'
+			if offset < 0 {
+				sign, offset = '-', -offset
+			}
+			fmt.Fprintf(&sb, "%c%02d%02d", sign, offset/3600, offset%3600/60)
+		case 'Z':
+			fmt.Fprintf(&sb, "%+d", offset/60)
+		case '%':
+			sb.WriteByte('%')
+		default:
+			return "", fmt.Errorf("invalid format character '%%%c' in format string", format[i])
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// evalDateTrunc evaluate the $dateTrunc operator
+func evalDateTrunc(args interface{}, scope *exprScope) (interface{}, error) {
+	values, t, err := evalDateArgs("$dateTrunc", args, []string{"date", "unit"}, []string{"binSize", "timezone", "startOfWeek"}, scope)
+	if err != nil || t == nil {
+		return nil, err
+	}
+
+	unit, ok := values["unit"].(string)
+	if !ok {
+		return nil, fmt.Errorf("$dateTrunc requires 'unit' to be a string, but got %s", typeName(values["unit"]))
+	}
+	binSize := int64(1)
+	if v, ok := values["binSize"]; ok && !isMissing(v) {
+		if binSize, ok = toInt64(v); !ok || binSize <= 0 {
+			return nil, fmt.Errorf("$dateTrunc requires 'binSize' to be a positive integer")
+		}
+	}
+	startOfWeek := time.Sunday
+	if v, ok := values["startOfWeek"]; ok && !isMissing(v) {
+		name, _ := v.(string)
+		if startOfWeek, ok = weekdays[strings.ToLower(name)]; !ok {
+			return nil, fmt.Errorf("$dateTrunc parameter 'startOfWeek' must be a valid day of the week")
+		}
+	}
+
+	truncated, err := truncateDate(*t, unit, binSize, startOfWeek)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.NewDateTimeFromTime(truncated), nil
+}
+
+// truncateDate return the start of the bin of binSize units that contains t, counting the bins
+// from 2000-01-01 in the location of t like mongodb
+func truncateDate(t time.Time, unit string, binSize int64, startOfWeek time.Weekday) (time.Time, error) {
+	loc := t.Location()
+	ref := time.Date(2000, 1, 1, 0, 0, 0, 0, loc)
+	months := int64(t.Year()-2000)*12 + int64(t.Month()) - 1
+	days := (time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() - time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Unix()) / 86400
+
+	switch unit {
+	case "year":
+		return time.Date(2000+int(floorMultiple(int64(t.Year()-2000), binSize)), 1, 1, 0, 0, 0, 0, loc), nil
+	case "quarter":
+		return ref.AddDate(0, int(floorMultiple(months, 3*binSize)), 0), nil
+	case "month":
+		return ref.AddDate(0, int(floorMultiple(months, binSize)), 0), nil
+	case "week":
+		shift := (int64(startOfWeek) - int64(ref.Weekday()) + 7) % 7
+		return ref.AddDate(0, 0, int(shift+floorMultiple(days-shift, 7*binSize))), nil
+	case "day":
+		return ref.AddDate(0, 0, int(floorMultiple(days, binSize))), nil
+	}
+
+	d, ok := timeUnitDurations[unit]
+	if !ok {
+		return time.Time{}, fmt.Errorf("$dateTrunc parameter 'unit' value cannot be recognized as a time unit: %s", unit)
+	}
+	bin := d * time.Duration(binSize)
+	return ref.Add(time.Duration(floorMultiple(int64(t.Sub(ref)), int64(bin)))), nil
+}
+
+// addDateUnits return the time n units after t
+func addDateUnits(t time.Time, unit string, n int64) (time.Time, error) {
+	switch unit {
+	case "year":
+		return t.AddDate(int(n), 0, 0), nil
+	case "quarter":
+		return t.AddDate(0, 3*int(n), 0), nil
+	case "month":
+		return t.AddDate(0, int(n), 0), nil
+	}
+
+	d, ok := timeUnitDurations[unit]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown time unit value: %s", unit)
+	}
+	return t.Add(time.Duration(n) * d), nil
+}
+
+// floorMultiple return the greatest multiple of b that is less than or equal to a
+func floorMultiple(a int64, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q * b
+}
+
+// evalDateFromParts evaluate the $dateFromParts operator with the calendar parts or the ISO week date parts,
+// the values out of range are carried
+func evalDateFromParts(args interface{}, scope *exprScope) (interface{}, error) {
+	calendarParts := []string{"year", "month", "day", "hour", "minute", "second", "millisecond"}
+	isoParts := []string{"isoWeekYear", "isoWeek", "isoDayOfWeek", "hour", "minute", "second", "millisecond"}
+	doc, err := namedArgs("$dateFromParts", args, nil, append(append(calendarParts, isoParts[:3]...), "timezone"))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := calendarParts
+	if iso := !isMissing(docGet(doc, "isoWeekYear")); iso {
+		for _, name := range calendarParts[:3] {
+			if !isMissing(docGet(doc, name)) {
+				return nil, fmt.Errorf("$dateFromParts does not allow mixing natural dates with ISO dates")
+			}
+		}
+		parts = isoParts
+	} else if isMissing(docGet(doc, "year")) {
+		return nil, fmt.Errorf("$dateFromParts requires either 'year' or 'isoWeekYear' to be present")
+	} else {
+		for _, name := range isoParts[1:3] {
+			if !isMissing(docGet(doc, name)) {
+				return nil, fmt.Errorf("$dateFromParts does not allow mixing natural dates with ISO dates")
+			}
+		}
+	}
+
+	values := []int{0, 1, 1, 0, 0, 0, 0}
+	for i, name := range parts {
+		expr := docGet(doc, name)
+		if isMissing(expr) {
+			continue
+		}
+		v, err := evalExpression(expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(v) {
+			return nil, nil
+		}
+		n, ok := toInt64(v)
+		if !ok {
+			return nil, fmt.Errorf("'%s' must evaluate to an integer, found %s", name, typeName(v))
+		}
+		values[i] = int(n)
+	}
+
+	loc := time.UTC
+	if expr := docGet(doc, "timezone"); !isMissing(expr) {
+		v, err := evalExpression(expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		tz, _ := v.(string)
+		if loc, err = parseTimezone(tz); err != nil {
+			return nil, err
+		}
+	}
+
+	nsec := values[6] * int(time.Millisecond)
+	if parts[0] == "isoWeekYear" {
+		// the first ISO week is the one that contains the 4th of January
+		jan4 := time.Date(values[0], 1, 4, 0, 0, 0, 0, loc)
+		day := 4 - (int(jan4.Weekday())+6)%7 + (values[1]-1)*7 + values[2] - 1
+		return primitive.NewDateTimeFromTime(time.Date(values[0], 1, day, values[3], values[4], values[5], nsec, loc)), nil
+	}
+	t := time.Date(values[0], time.Month(values[1]), values[2], values[3], values[4], values[5], nsec, loc)
+	return primitive.NewDateTimeFromTime(t), nil
+}
+
+// evalDateToParts evaluate the $dateToParts operator, that return the calendar parts of the date
+// or the ISO week date parts if iso8601 is true
+func evalDateToParts(args interface{}, scope *exprScope) (interface{}, error) {
+	values, t, err := evalDateArgs("$dateToParts", args, []string{"date"}, []string{"timezone", "iso8601"}, scope)
+	if err != nil || t == nil {
+		return nil, err
+	}
+
+	iso := false
+	if v, ok := values["iso8601"]; ok && !isNullish(v) {
+		if iso, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("iso8601 must evaluate to a bool, found %s", typeName(v))
+		}
+	}
+
+	parts := bson.D{
+		{Key: "year", Value: int32(t.Year())},
+		{Key: "month", Value: int32(t.Month())},
+		{Key: "day", Value: int32(t.Day())},
+	}
+	if iso {
+		isoYear, isoWeek := t.ISOWeek()
+		parts = bson.D{
+			{Key: "isoWeekYear", Value: int32(isoYear)},
+			{Key: "isoWeek", Value: int32(isoWeek)},
+			{Key: "isoDayOfWeek", Value: int32((int(t.Weekday())+6)%7 + 1)},
+		}
+	}
+	return append(parts,
+		bson.E{Key: "hour", Value: int32(t.Hour())},
+		bson.E{Key: "minute", Value: int32(t.Minute())},
+		bson.E{Key: "second", Value: int32(t.Second())},
+		bson.E{Key: "millisecond", Value: int32(t.Nanosecond() / int(time.Millisecond))},
+	), nil
+}
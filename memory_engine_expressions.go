@@ -0,0 +1,816 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// exprScope contains the variables visible to a expression
+type exprScope struct {
+	vars map[string]interface{}
+}
+
+// newExprScope return a scope with the doc as $$ROOT and $$CURRENT plus the vars
+func newExprScope(doc interface{}, vars map[string]interface{}) *exprScope {
+	s := &exprScope{vars: map[string]interface{}{}}
+	for k, v := range vars {
+		s.vars[k] = v
+	}
+	s.vars["ROOT"] = doc
+	s.vars["CURRENT"] = doc
+	return s
+}
+
+// withCurrent return a copy of the scope with the doc as $$ROOT and $$CURRENT
+func (s *exprScope) withCurrent(doc interface{}) *exprScope {
+	return newExprScope(doc, s.vars)
+}
+
+// withVar return a copy of the scope with the variable name set to value
+func (s *exprScope) withVar(name string, value interface{}) *exprScope {
+	out := &exprScope{vars: make(map[string]interface{}, len(s.vars)+1)}
+	for k, v := range s.vars {
+		out.vars[k] = v
+	}
+	out.vars[name] = value
+	return out
+}
+
+// lookupVar return the value of the variable reference ref, that could contains a path like this.name
+func (s *exprScope) lookupVar(ref string) (interface{}, error) {
+	name, path := ref, ""
+	if i := strings.IndexByte(ref, '.'); i >= 0 {
+		name, path = ref[:i], ref[i+1:]
+	}
+
+	var value interface{}
+	switch name {
+	case "REMOVE":
+		value = missing
+	case "NOW":
+		value = primitive.NewDateTimeFromTime(time.Now())
+	default:
+		v, ok := s.vars[name]
+		if !ok {
+			return nil, fmt.Errorf("use of undefined variable: %s", name)
+		}
+		value = v
+	}
+
+	return getFieldPath(value, path), nil
+}
+
+// exprOperator evaluate the args of a expression operator
+type exprOperator func(args interface{}, scope *exprScope) (interface{}, error)
+
+// expressionOperators contains the supported expression operators
+var expressionOperators map[string]exprOperator
+
+func init() {
+	expressionOperators = map[string]exprOperator{
+		"$literal": func(args interface{}, scope *exprScope) (interface{}, error) {
+			return args, nil
+		},
+		"$add":            evalAdd,
+		"$subtract":       evalSubtract,
+		"$multiply":       evalMultiply,
+		"$divide":         evalDivide,
+		"$floor":          numericFunction("$floor", math.Floor),
+		"$ceil":           numericFunction("$ceil", math.Ceil),
+		"$sum":            expressionAccumulator("$sum"),
+		"$avg":            expressionAccumulator("$avg"),
+		"$min":            expressionAccumulator("$min"),
+		"$max":            expressionAccumulator("$max"),
+		"$eq":             comparisonOperator("$eq", func(c int) bool { return c == 0 }),
+		"$ne":             comparisonOperator("$ne", func(c int) bool { return c != 0 }),
+		"$gt":             comparisonOperator("$gt", func(c int) bool { return c > 0 }),
+		"$gte":            comparisonOperator("$gte", func(c int) bool { return c >= 0 }),
+		"$lt":             comparisonOperator("$lt", func(c int) bool { return c < 0 }),
+		"$lte":            comparisonOperator("$lte", func(c int) bool { return c <= 0 }),
+		"$cmp":            evalCmp,
+		"$and":            evalAnd,
+		"$or":             evalOr,
+		"$not":            evalNot,
+		"$cond":           evalCond,
+		"$ifNull":         evalIfNull,
+		"$type":           evalType,
+		"$size":           evalSize,
+		"$arrayElemAt":    evalArrayElemAt,
+		"$reduce":         evalReduce,
+		"$regexMatch":     evalRegexMatch,
+		"$mod":            evalMod,
+		"$abs":            evalAbs,
+		"$in":             evalIn,
+		"$isArray":        evalIsArray,
+		"$switch":         evalSwitch,
+		"$let":            evalLet,
+		"$map":            evalMap,
+		"$filter":         evalFilter,
+		"$setUnion":       evalSetUnion,
+		"$concatArrays":   evalConcatArrays,
+		"$first":          arrayEdgeOperator("$first"),
+		"$last":           arrayEdgeOperator("$last"),
+		"$range":          evalRange,
+		"$slice":          evalSlice,
+		"$mergeObjects":   evalMergeObjects,
+		"$objectToArray":  evalObjectToArray,
+		"$arrayToObject":  evalArrayToObject,
+		"$concat":         evalConcat,
+		"$split":          evalSplit,
+		"$indexOfCP":      evalIndexOfCP,
+		"$trim":           trimOperator("$trim"),
+		"$ltrim":          trimOperator("$ltrim"),
+		"$rtrim":          trimOperator("$rtrim"),
+		"$strLenCP":       evalStrLenCP,
+		"$substrCP":       evalSubstrCP,
+		"$toLower":        caseOperator("$toLower", strings.ToLower),
+		"$toUpper":        caseOperator("$toUpper", strings.ToUpper),
+		"$regexFind":      regexFindOperator("$regexFind"),
+		"$regexFindAll":   regexFindOperator("$regexFindAll"),
+		"$convert":        evalConvert,
+		"$toDouble":       conversionOperator("$toDouble", "double"),
+		"$toInt":          conversionOperator("$toInt", "int"),
+		"$toLong":         conversionOperator("$toLong", "long"),
+		"$toDecimal":      conversionOperator("$toDecimal", "decimal"),
+		"$toString":       conversionOperator("$toString", "string"),
+		"$toBool":         conversionOperator("$toBool", "bool"),
+		"$toDate":         conversionOperator("$toDate", "date"),
+		"$toObjectId":     conversionOperator("$toObjectId", "objectId"),
+		"$dateFromString": evalDateFromString,
+		"$dateToString":   evalDateToString,
+		"$dateTrunc":      evalDateTrunc,
+		"$dateFromParts":  evalDateFromParts,
+		"$dateToParts":    evalDateToParts,
+	}
+}
+
+// evalExpression return the value of the expr evaluated in the scope
+func evalExpression(expr interface{}, scope *exprScope) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$$") {
+			return scope.lookupVar(e[2:])
+		} else if strings.HasPrefix(e, "$") {
+			return scope.lookupVar("CURRENT." + e[1:])
+		}
+		return e, nil
+	case bson.A:
+		out := make(bson.A, 0, len(e))
+		for _, item := range e {
+			v, err := evalExpression(item, scope)
+			if err != nil {
+				return nil, err
+			}
+			if isMissing(v) {
+				v = nil
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case bson.D:
+		if len(e) > 0 && strings.HasPrefix(e[0].Key, "$") {
+			if len(e) != 1 {
+				return nil, fmt.Errorf("an expression specification must contain exactly one field, the name of the expression. Found %d fields", len(e))
+			}
+			op, ok := expressionOperators[e[0].Key]
+			if !ok {
+				return nil, fmt.Errorf("unrecognized expression operator: %s", e[0].Key)
+			}
+			return op(e[0].Value, scope)
+		}
+
+		out := make(bson.D, 0, len(e))
+		for _, item := range e {
+			v, err := evalExpression(item.Value, scope)
+			if err != nil {
+				return nil, err
+			}
+			if !isMissing(v) {
+				out = append(out, bson.E{Key: item.Key, Value: v})
+			}
+		}
+		return out, nil
+	default:
+		return expr, nil
+	}
+}
+
+// evalArgs return the evaluated args, that could be a array of expressions or a single expression
+func evalArgs(args interface{}, scope *exprScope) ([]interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+
+	out := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		v, err := evalExpression(item, scope)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+
+	return out, nil
+}
+
+// evalFixedArgs return the evaluated args checking that they are exactly n
+func evalFixedArgs(name string, args interface{}, n int, scope *exprScope) ([]interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+	if len(list) != n {
+		return nil, fmt.Errorf("expression %s takes exactly %d arguments. %d were passed in", name, n, len(list))
+	}
+
+	return evalArgs(list, scope)
+}
+
+// namedArgs return the args of a operator that takes a document of named arguments, checking the required and allowed ones
+func namedArgs(name string, args interface{}, required []string, optional []string) (bson.D, error) {
+	doc, ok := args.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s expects an object as its argument", name)
+	}
+
+	for _, e := range doc {
+		if !containsString(required, e.Key) && !containsString(optional, e.Key) {
+			return nil, fmt.Errorf("%s found an unknown argument: %s", name, e.Key)
+		}
+	}
+	for _, r := range required {
+		if isMissing(docGet(doc, r)) {
+			return nil, fmt.Errorf("missing '%s' parameter to %s", r, name)
+		}
+	}
+
+	return doc, nil
+}
+
+// containsString return true if list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// addNumbers return a+b keeping the integer types when possible
+func addNumbers(a interface{}, b interface{}) interface{} {
+	if isIntegral(a) && isIntegral(b) {
+		ia, _ := toInt64(a)
+		ib, _ := toInt64(b)
+		sum := ia + ib
+		if (sum > ia) == (ib > 0) {
+			if _, ok := a.(int64); ok {
+				return sum
+			}
+			if _, ok := b.(int64); ok {
+				return sum
+			}
+			return numberFromInt64(sum)
+		}
+	}
+	fa, _ := toFloat(a)
+	fb, _ := toFloat(b)
+	return fa + fb
+}
+
+// multiplyNumbers return a*b keeping the integer types when possible
+func multiplyNumbers(a interface{}, b interface{}) interface{} {
+	if isIntegral(a) && isIntegral(b) {
+		ia, _ := toInt64(a)
+		ib, _ := toInt64(b)
+		prod := ia * ib
+		if ia == 0 || (prod/ia == ib && !(ia == -1 && ib == math.MinInt64)) {
+			if _, ok := a.(int64); ok {
+				return prod
+			}
+			if _, ok := b.(int64); ok {
+				return prod
+			}
+			return numberFromInt64(prod)
+		}
+	}
+	fa, _ := toFloat(a)
+	fb, _ := toFloat(b)
+	return fa * fb
+}
+
+// negateNumber return -n
+func negateNumber(n interface{}) interface{} {
+	switch v := n.(type) {
+	case int32:
+		return multiplyNumbers(v, int32(-1))
+	case int64:
+		return multiplyNumbers(v, int64(-1))
+	}
+	f, _ := toFloat(n)
+	return -f
+}
+
+// evalAdd evaluate the $add operator
+func evalAdd(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalArgs(args, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var sum interface{} = int32(0)
+	var date *primitive.DateTime
+	for _, v := range values {
+		switch val := v.(type) {
+		case primitive.DateTime:
+			if date != nil {
+				return nil, fmt.Errorf("only one date allowed in an $add expression")
+			}
+			date = &val
+		default:
+			if isNullish(v) {
+				return nil, nil
+			}
+			if !isNumber(v) {
+				return nil, fmt.Errorf("$add only supports numeric or date types, not %s", typeName(v))
+			}
+			sum = addNumbers(sum, v)
+		}
+	}
+
+	if date != nil {
+		f, _ := toFloat(sum)
+		return primitive.DateTime(int64(*date) + int64(math.Round(f))), nil
+	}
+	return sum, nil
+}
+
+// evalSubtract evaluate the $subtract operator
+func evalSubtract(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$subtract", args, 2, scope)
+	if err != nil {
+		return nil, err
+	}
+	a, b := values[0], values[1]
+	if isNullish(a) || isNullish(b) {
+		return nil, nil
+	}
+
+	da, aIsDate := a.(primitive.DateTime)
+	db, bIsDate := b.(primitive.DateTime)
+	switch {
+	case aIsDate && bIsDate:
+		return int64(da) - int64(db), nil
+	case aIsDate && isNumber(b):
+		f, _ := toFloat(b)
+		return primitive.DateTime(int64(da) - int64(math.Round(f))), nil
+	case isNumber(a) && isNumber(b):
+		return addNumbers(a, negateNumber(b)), nil
+	}
+
+	return nil, fmt.Errorf("can't $subtract %s from %s", typeName(b), typeName(a))
+}
+
+// evalMultiply evaluate the $multiply operator
+func evalMultiply(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalArgs(args, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var prod interface{} = int32(1)
+	for _, v := range values {
+		if isNullish(v) {
+			return nil, nil
+		}
+		if !isNumber(v) {
+			return nil, fmt.Errorf("$multiply only supports numeric types, not %s", typeName(v))
+		}
+		prod = multiplyNumbers(prod, v)
+	}
+
+	return prod, nil
+}
+
+// evalDivide evaluate the $divide operator
+func evalDivide(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$divide", args, 2, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	a, okA := toFloat(values[0])
+	b, okB := toFloat(values[1])
+	if !okA || !okB {
+		return nil, fmt.Errorf("$divide only supports numeric types, not %s and %s", typeName(values[0]), typeName(values[1]))
+	}
+	if b == 0 {
+		return nil, fmt.Errorf("can't $divide by zero")
+	}
+
+	return a / b, nil
+}
+
+// numericFunction return a operator that apply fn to its single numeric argument, leaving the integers unchanged
+func numericFunction(name string, fn func(float64) float64) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		values, err := evalFixedArgs(name, args, 1, scope)
+		if err != nil {
+			return nil, err
+		}
+
+		v := values[0]
+		switch {
+		case isNullish(v):
+			return nil, nil
+		case isIntegral(v):
+			return v, nil
+		case isNumber(v):
+			f, _ := toFloat(v)
+			return fn(f), nil
+		}
+
+		return nil, fmt.Errorf("%s only supports numeric types, not %s", name, typeName(v))
+	}
+}
+
+// expressionAccumulator return a operator that apply the accumulator to its arguments,
+// or to the elements of its single array argument
+func expressionAccumulator(name string) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		values, err := evalArgs(args, scope)
+		if err != nil {
+			return nil, err
+		}
+		if _, isList := args.(bson.A); !isList || len(values) == 1 {
+			if arr, ok := values[0].(bson.A); ok {
+				values = arr
+			}
+		}
+
+		return accumulate(name, values)
+	}
+}
+
+// accumulate return the result of the accumulator name applied to values
+func accumulate(name string, values []interface{}) (interface{}, error) {
+	switch name {
+	case "$sum", "$avg":
+		var sum interface{} = int32(0)
+		count := 0
+		for _, v := range values {
+			if isNumber(v) {
+				sum = addNumbers(sum, v)
+				count++
+			}
+		}
+		if name == "$sum" {
+			return sum, nil
+		}
+		if count == 0 {
+			return nil, nil
+		}
+		f, _ := toFloat(sum)
+		return f / float64(count), nil
+	case "$min", "$max":
+		var best interface{}
+		for _, v := range values {
+			if isNullish(v) {
+				continue
+			}
+			if best == nil || (name == "$min" && compareValues(v, best) < 0) || (name == "$max" && compareValues(v, best) > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		v := values[0]
+		if name == "$last" {
+			v = values[len(values)-1]
+		}
+		if isMissing(v) {
+			return nil, nil
+		}
+		return v, nil
+	case "$push", "$addToSet":
+		out := bson.A{}
+		for _, v := range values {
+			if isMissing(v) {
+				continue
+			}
+			if name == "$addToSet" && containsValue(out, v) {
+				continue
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case "$mergeObjects":
+		out := bson.D{}
+		for _, v := range values {
+			if isNullish(v) {
+				continue
+			}
+			doc, ok := v.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$mergeObjects requires object inputs, but input is of type %s", typeName(v))
+			}
+			for _, e := range doc {
+				out = docSet(out, e.Key, e.Value)
+			}
+		}
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("unknown accumulator: %s", name)
+}
+
+// containsValue return true if list contains a value equal to v
+func containsValue(list bson.A, v interface{}) bool {
+	for _, item := range list {
+		if valuesEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// comparisonOperator return a operator that compare its two arguments
+func comparisonOperator(name string, test func(int) bool) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		values, err := evalFixedArgs(name, args, 2, scope)
+		if err != nil {
+			return nil, err
+		}
+		return test(compareValues(values[0], values[1])), nil
+	}
+}
+
+// evalCmp evaluate the $cmp operator
+func evalCmp(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$cmp", args, 2, scope)
+	if err != nil {
+		return nil, err
+	}
+	return int32(compareValues(values[0], values[1])), nil
+}
+
+// evalAnd evaluate the $and operator, stopping at the first false argument
+func evalAnd(args interface{}, scope *exprScope) (interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+	for _, item := range list {
+		v, err := evalExpression(item, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !isTruthy(v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// evalOr evaluate the $or operator, stopping at the first true argument
+func evalOr(args interface{}, scope *exprScope) (interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+	for _, item := range list {
+		v, err := evalExpression(item, scope)
+		if err != nil {
+			return nil, err
+		}
+		if isTruthy(v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// evalNot evaluate the $not operator
+func evalNot(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$not", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	return !isTruthy(values[0]), nil
+}
+
+// evalCond evaluate the $cond operator, in the array or in the document form
+func evalCond(args interface{}, scope *exprScope) (interface{}, error) {
+	var cond, ifTrue, ifFalse interface{}
+	if list, ok := args.(bson.A); ok {
+		if len(list) != 3 {
+			return nil, fmt.Errorf("expression $cond takes exactly 3 arguments. %d were passed in", len(list))
+		}
+		cond, ifTrue, ifFalse = list[0], list[1], list[2]
+	} else {
+		doc, err := namedArgs("$cond", args, []string{"if", "then", "else"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		cond, ifTrue, ifFalse = docGet(doc, "if"), docGet(doc, "then"), docGet(doc, "else")
+	}
+
+	c, err := evalExpression(cond, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isTruthy(c) {
+		return evalExpression(ifTrue, scope)
+	}
+	return evalExpression(ifFalse, scope)
+}
+
+// evalIfNull evaluate the $ifNull operator
+func evalIfNull(args interface{}, scope *exprScope) (interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok || len(list) < 2 {
+		return nil, fmt.Errorf("$ifNull needs at least two arguments")
+	}
+	for i, item := range list {
+		v, err := evalExpression(item, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !isNullish(v) || i == len(list)-1 {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// evalType evaluate the $type operator
+func evalType(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$type", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	return typeName(values[0]), nil
+}
+
+// evalSize evaluate the $size operator
+func evalSize(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$size", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("the argument to $size must be an array. Type of argument is %s", typeName(values[0]))
+	}
+	return int32(len(arr)), nil
+}
+
+// evalArrayElemAt evaluate the $arrayElemAt operator
+func evalArrayElemAt(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$arrayElemAt", args, 2, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	arr, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("$arrayElemAt's first argument must be an array, but is %s", typeName(values[0]))
+	}
+	idx, ok := toInt64(values[1])
+	if !ok {
+		return nil, fmt.Errorf("$arrayElemAt's second argument must be a integer, but is %s", typeName(values[1]))
+	}
+	if idx < 0 {
+		idx += int64(len(arr))
+	}
+	if idx < 0 || idx >= int64(len(arr)) {
+		return missing, nil
+	}
+
+	return arr[idx], nil
+}
+
+// evalReduce evaluate the $reduce operator
+func evalReduce(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$reduce", args, []string{"input", "initialValue", "in"}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := evalExpression(docGet(doc, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(input) {
+		return nil, nil
+	}
+	arr, ok := input.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("$reduce requires that 'input' be an array, found: %s", typeName(input))
+	}
+
+	value, err := evalExpression(docGet(doc, "initialValue"), scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range arr {
+		value, err = evalExpression(docGet(doc, "in"), scope.withVar("this", item).withVar("value", value))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return value, nil
+}
+
+// regexArgs evaluate the input, regex and options arguments of the $regexMatch, $regexFind and $regexFindAll operators
+func regexArgs(name string, args interface{}, scope *exprScope) (input interface{}, pattern string, options string, err error) {
+	doc, err := namedArgs(name, args, []string{"input", "regex"}, []string{"options"})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if input, err = evalExpression(docGet(doc, "input"), scope); err != nil {
+		return nil, "", "", err
+	}
+	regex, err := evalExpression(docGet(doc, "regex"), scope)
+	if err != nil {
+		return nil, "", "", err
+	}
+	opts, err := evalExpression(docGet(doc, "options"), scope)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	switch r := regex.(type) {
+	case string:
+		pattern = r
+	case primitive.Regex:
+		pattern, options = r.Pattern, r.Options
+	default:
+		if !isNullish(regex) {
+			return nil, "", "", fmt.Errorf("%s needs 'regex' to be of type string or regex", name)
+		}
+	}
+	if o, ok := opts.(string); ok {
+		if options != "" && o != "" {
+			return nil, "", "", fmt.Errorf("%s: options set in both 'regex' and 'options'", name)
+		}
+		options += o
+	}
+
+	if !isNullish(input) {
+		if _, ok := input.(string); !ok {
+			return nil, "", "", fmt.Errorf("%s needs 'input' to be of type string", name)
+		}
+	}
+
+	return input, pattern, options, nil
+}
+
+// evalRegexMatch evaluate the $regexMatch operator
+func evalRegexMatch(args interface{}, scope *exprScope) (interface{}, error) {
+	input, pattern, options, err := regexArgs("$regexMatch", args, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(input) {
+		return false, nil
+	}
+
+	re, err := compileRegex(pattern, options)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(input.(string)), nil
+}
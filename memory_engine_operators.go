@@ -0,0 +1,1144 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EvalExpression return the value of the aggregation expression expr, built for example with the APO* functions,
+// evaluated against the doc as $$ROOT and $$CURRENT and with the user variables vars (without the $$ prefix).
+// A missing result, like a reference to a non-existent field, is returned as nil
+func EvalExpression(expr interface{}, doc interface{}, vars map[string]interface{}) (interface{}, error) {
+	normalizedExpr, err := normalizeValue(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var root interface{} = bson.D{}
+	if doc != nil {
+		if root, err = normalizeValue(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	normalizedVars := map[string]interface{}{}
+	for k, v := range vars {
+		if normalizedVars[k], err = normalizeValue(v); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := evalExpression(normalizedExpr, newExprScope(root, normalizedVars))
+	if err != nil {
+		return nil, err
+	}
+	if isMissing(res) {
+		return nil, nil
+	}
+
+	return res, nil
+}
+
+// evalMod evaluate the $mod operator
+func evalMod(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$mod", args, 2, scope)
+	if err != nil {
+		return nil, err
+	}
+	a, b := values[0], values[1]
+	if isNullish(a) || isNullish(b) {
+		return nil, nil
+	}
+	if !isNumber(a) || !isNumber(b) {
+		return nil, fmt.Errorf("$mod only supports numeric types, not %s and %s", typeName(a), typeName(b))
+	}
+
+	if isIntegral(a) && isIntegral(b) {
+		ia, _ := toInt64(a)
+		ib, _ := toInt64(b)
+		if ib == 0 {
+			return nil, fmt.Errorf("can't $mod by zero")
+		}
+		if _, ok := a.(int32); ok {
+			if _, ok := b.(int32); ok {
+				return int32(ia % ib), nil
+			}
+		}
+		return ia % ib, nil
+	}
+
+	fa, _ := toFloat(a)
+	fb, _ := toFloat(b)
+	if fb == 0 {
+		return nil, fmt.Errorf("can't $mod by zero")
+	}
+	return math.Mod(fa, fb), nil
+}
+
+// evalAbs evaluate the $abs operator
+func evalAbs(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$abs", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	v := values[0]
+	switch {
+	case isNullish(v):
+		return nil, nil
+	case !isNumber(v):
+		return nil, fmt.Errorf("$abs only supports numeric types, not %s", typeName(v))
+	}
+	if c := compareValues(v, int32(0)); c < 0 {
+		return negateNumber(v), nil
+	}
+	return v, nil
+}
+
+// evalIn evaluate the $in operator
+func evalIn(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$in", args, 2, scope)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := values[1].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("$in requires an array as a second argument, found: %s", typeName(values[1]))
+	}
+	return containsValue(arr, values[0]), nil
+}
+
+// evalIsArray evaluate the $isArray operator
+func evalIsArray(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$isArray", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := values[0].(bson.A)
+	return ok, nil
+}
+
+// evalSwitch evaluate the $switch operator
+func evalSwitch(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$switch", args, []string{"branches"}, []string{"default"})
+	if err != nil {
+		return nil, err
+	}
+	branches, ok := docGet(doc, "branches").(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("$switch expected an array for 'branches'")
+	}
+
+	for _, b := range branches {
+		branch, err := namedArgs("$switch branch", b, []string{"case", "then"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		c, err := evalExpression(docGet(branch, "case"), scope)
+		if err != nil {
+			return nil, err
+		}
+		if isTruthy(c) {
+			return evalExpression(docGet(branch, "then"), scope)
+		}
+	}
+
+	if def := docGet(doc, "default"); !isMissing(def) {
+		return evalExpression(def, scope)
+	}
+	return nil, fmt.Errorf("$switch could not find a matching branch for an input, and no default was specified")
+}
+
+// evalLet evaluate the $let operator
+func evalLet(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$let", args, []string{"vars", "in"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	vars, ok := docGet(doc, "vars").(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("invalid parameter: expected an object (vars)")
+	}
+
+	inner := scope
+	for _, v := range vars {
+		value, err := evalExpression(v.Value, scope)
+		if err != nil {
+			return nil, err
+		}
+		inner = inner.withVar(v.Key, value)
+	}
+
+	return evalExpression(docGet(doc, "in"), inner)
+}
+
+// arrayIteratorArgs evaluate the input of the $map and $filter operators returning the input array and the variable name
+func arrayIteratorArgs(name string, doc bson.D, scope *exprScope) (bson.A, string, error) {
+	as := "this"
+	if v, ok := docGet(doc, "as").(string); ok {
+		as = v
+	}
+
+	input, err := evalExpression(docGet(doc, "input"), scope)
+	if err != nil {
+		return nil, "", err
+	}
+	if isNullish(input) {
+		return nil, as, nil
+	}
+	arr, ok := input.(bson.A)
+	if !ok {
+		return nil, "", fmt.Errorf("input to %s must be an array not %s", name, typeName(input))
+	}
+
+	return arr, as, nil
+}
+
+// evalMap evaluate the $map operator
+func evalMap(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$map", args, []string{"input", "in"}, []string{"as"})
+	if err != nil {
+		return nil, err
+	}
+	arr, as, err := arrayIteratorArgs("$map", doc, scope)
+	if err != nil || arr == nil {
+		return nil, err
+	}
+
+	out := make(bson.A, 0, len(arr))
+	for _, item := range arr {
+		v, err := evalExpression(docGet(doc, "in"), scope.withVar(as, item))
+		if err != nil {
+			return nil, err
+		}
+		if isMissing(v) {
+			v = nil
+		}
+		out = append(out, v)
+	}
+
+	return out, nil
+}
+
+// evalFilter evaluate the $filter operator
+func evalFilter(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$filter", args, []string{"input", "cond"}, []string{"as", "limit"})
+	if err != nil {
+		return nil, err
+	}
+	arr, as, err := arrayIteratorArgs("$filter", doc, scope)
+	if err != nil || arr == nil {
+		return nil, err
+	}
+
+	limit := int64(len(arr))
+	if l := docGet(doc, "limit"); !isMissing(l) {
+		lv, err := evalExpression(l, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !isNullish(lv) {
+			if limit, _ = toInt64(lv); limit <= 0 {
+				return nil, fmt.Errorf("$filter: limit must be greater than 0")
+			}
+		}
+	}
+
+	out := bson.A{}
+	for _, item := range arr {
+		if int64(len(out)) >= limit {
+			break
+		}
+		c, err := evalExpression(docGet(doc, "cond"), scope.withVar(as, item))
+		if err != nil {
+			return nil, err
+		}
+		if isTruthy(c) {
+			out = append(out, item)
+		}
+	}
+
+	return out, nil
+}
+
+// arrayArgs evaluate the args of a operator that works on arrays, returning ok false if any of them is null
+func arrayArgs(name string, args interface{}, scope *exprScope) ([]bson.A, bool, error) {
+	values, err := evalArgs(args, scope)
+	if err != nil {
+		return nil, false, err
+	}
+
+	out := make([]bson.A, 0, len(values))
+	for _, v := range values {
+		if isNullish(v) {
+			return nil, false, nil
+		}
+		arr, ok := v.(bson.A)
+		if !ok {
+			return nil, false, fmt.Errorf("all operands of %s must be arrays. One argument is of type: %s", name, typeName(v))
+		}
+		out = append(out, arr)
+	}
+
+	return out, true, nil
+}
+
+// evalSetUnion evaluate the $setUnion operator
+func evalSetUnion(args interface{}, scope *exprScope) (interface{}, error) {
+	arrays, ok, err := arrayArgs("$setUnion", args, scope)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	out := bson.A{}
+	for _, arr := range arrays {
+		for _, item := range arr {
+			if !containsValue(out, item) {
+				out = append(out, item)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// evalConcatArrays evaluate the $concatArrays operator
+func evalConcatArrays(args interface{}, scope *exprScope) (interface{}, error) {
+	arrays, ok, err := arrayArgs("$concatArrays", args, scope)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	out := bson.A{}
+	for _, arr := range arrays {
+		out = append(out, arr...)
+	}
+
+	return out, nil
+}
+
+// arrayEdgeOperator return the $first or $last array operator
+func arrayEdgeOperator(name string) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		values, err := evalFixedArgs(name, args, 1, scope)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(values[0]) {
+			return nil, nil
+		}
+		arr, ok := values[0].(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("%s's argument must be an array, but is %s", name, typeName(values[0]))
+		}
+		if len(arr) == 0 {
+			return missing, nil
+		}
+		if name == "$first" {
+			return arr[0], nil
+		}
+		return arr[len(arr)-1], nil
+	}
+}
+
+// evalRange evaluate the $range operator
+func evalRange(args interface{}, scope *exprScope) (interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok || len(list) < 2 || len(list) > 3 {
+		return nil, fmt.Errorf("expression $range takes at least 2 arguments, and at most 3")
+	}
+	values, err := evalArgs(list, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := []int64{0, 0, 1}
+	for i, v := range values {
+		n, ok := toInt64(v)
+		if !ok {
+			return nil, fmt.Errorf("$range requires integral arguments, found %s", typeName(v))
+		}
+		bounds[i] = n
+	}
+	if bounds[2] == 0 {
+		return nil, fmt.Errorf("$range requires a non-zero step value")
+	}
+
+	out := bson.A{}
+	for i := bounds[0]; (bounds[2] > 0 && i < bounds[1]) || (bounds[2] < 0 && i > bounds[1]); i += bounds[2] {
+		out = append(out, numberFromInt64(i))
+	}
+
+	return out, nil
+}
+
+// evalSlice evaluate the $slice operator
+func evalSlice(args interface{}, scope *exprScope) (interface{}, error) {
+	list, ok := args.(bson.A)
+	if !ok || len(list) < 2 || len(list) > 3 {
+		return nil, fmt.Errorf("expression $slice takes at least 2 arguments, and at most 3")
+	}
+	values, err := evalArgs(list, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+	arr, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("first argument to $slice must be an array, but is of type: %s", typeName(values[0]))
+	}
+
+	bounds := []int64{}
+	for _, v := range values[1:] {
+		n, ok := toInt64(v)
+		if !ok {
+			return nil, fmt.Errorf("$slice requires integral arguments, found %s", typeName(v))
+		}
+		bounds = append(bounds, n)
+	}
+
+	size := int64(len(arr))
+	start, n := int64(0), bounds[0]
+	if len(bounds) == 2 {
+		start, n = bounds[0], bounds[1]
+		if n <= 0 {
+			return nil, fmt.Errorf("third argument to $slice must be positive: %d", n)
+		}
+		if start < 0 {
+			start += size
+		}
+	} else if n < 0 {
+		start, n = size+n, -n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > size {
+		start = size
+	}
+	end := start + n
+	if end > size {
+		end = size
+	}
+
+	return append(bson.A{}, arr[start:end]...), nil
+}
+
+// evalMergeObjects evaluate the $mergeObjects operator
+func evalMergeObjects(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalArgs(args, scope)
+	if err != nil {
+		return nil, err
+	}
+	return accumulate("$mergeObjects", values)
+}
+
+// evalObjectToArray evaluate the $objectToArray operator
+func evalObjectToArray(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$objectToArray", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+	doc, ok := values[0].(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("$objectToArray requires a document input, found: %s", typeName(values[0]))
+	}
+
+	out := make(bson.A, 0, len(doc))
+	for _, e := range doc {
+		out = append(out, bson.D{{Key: "k", Value: e.Key}, {Key: "v", Value: e.Value}})
+	}
+
+	return out, nil
+}
+
+// evalArrayToObject evaluate the $arrayToObject operator
+func evalArrayToObject(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$arrayToObject", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+	arr, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("$arrayToObject requires an array input, found: %s", typeName(values[0]))
+	}
+
+	out := bson.D{}
+	for _, item := range arr {
+		var key, value interface{}
+		switch pair := item.(type) {
+		case bson.A:
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("$arrayToObject requires an array of size 2 arrays, found array of size: %d", len(pair))
+			}
+			key, value = pair[0], pair[1]
+		case bson.D:
+			if len(pair) != 2 || isMissing(docGet(pair, "k")) || isMissing(docGet(pair, "v")) {
+				return nil, fmt.Errorf("$arrayToObject requires an object keys of 'k' and 'v'")
+			}
+			key, value = docGet(pair, "k"), docGet(pair, "v")
+		default:
+			return nil, fmt.Errorf("unrecognised input type format for $arrayToObject: %s", typeName(item))
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("$arrayToObject requires keys of type string, found: %s", typeName(key))
+		}
+		out = docSet(out, k, value)
+	}
+
+	return out, nil
+}
+
+// stringArgs evaluate the args of a string operator that takes exactly n string arguments.
+// The ok is false if any argument is null
+func stringArgs(name string, args interface{}, n int, scope *exprScope) ([]string, bool, error) {
+	values, err := evalFixedArgs(name, args, n, scope)
+	if err != nil {
+		return nil, false, err
+	}
+
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if isNullish(v) {
+			return nil, false, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, false, fmt.Errorf("%s requires string arguments, found: %s", name, typeName(v))
+		}
+		out = append(out, s)
+	}
+
+	return out, true, nil
+}
+
+// evalConcat evaluate the $concat operator
+func evalConcat(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalArgs(args, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	for _, v := range values {
+		if isNullish(v) {
+			return nil, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("$concat only supports strings, not %s", typeName(v))
+		}
+		sb.WriteString(s)
+	}
+
+	return sb.String(), nil
+}
+
+// evalSplit evaluate the $split operator
+func evalSplit(args interface{}, scope *exprScope) (interface{}, error) {
+	values, ok, err := stringArgs("$split", args, 2, scope)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if values[1] == "" {
+		return nil, fmt.Errorf("$split requires a non-empty separator")
+	}
+
+	out := bson.A{}
+	for _, s := range strings.Split(values[0], values[1]) {
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// evalIndexOfCP evaluate the $indexOfCP operator
+func evalIndexOfCP(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalArgs(args, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 2 || len(values) > 4 {
+		return nil, fmt.Errorf("expression $indexOfCP takes at least 2 arguments, and at most 4")
+	}
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+	s, ok := values[0].(string)
+	sub, okSub := values[1].(string)
+	if !ok || !okSub {
+		return nil, fmt.Errorf("$indexOfCP requires string arguments")
+	}
+
+	runes := []rune(s)
+	start, end := int64(0), int64(len(runes))
+	if len(values) > 2 {
+		if start, ok = toInt64(values[2]); !ok || start < 0 {
+			return nil, fmt.Errorf("$indexOfCP requires a non-negative integral starting index")
+		}
+	}
+	if len(values) > 3 {
+		if end, ok = toInt64(values[3]); !ok || end < 0 {
+			return nil, fmt.Errorf("$indexOfCP requires a non-negative integral ending index")
+		}
+		if end > int64(len(runes)) {
+			end = int64(len(runes))
+		}
+	}
+	if start > end {
+		return int32(-1), nil
+	}
+
+	idx := strings.Index(string(runes[start:end]), sub)
+	if idx < 0 {
+		return int32(-1), nil
+	}
+	return int32(start) + int32(utf8.RuneCountInString(string(runes[start:end])[:idx])), nil
+}
+
+// trimOperator return the $trim, $ltrim or $rtrim operator
+func trimOperator(name string) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		doc, err := namedArgs(name, args, []string{"input"}, []string{"chars"})
+		if err != nil {
+			return nil, err
+		}
+		input, err := evalExpression(docGet(doc, "input"), scope)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(input) {
+			return nil, nil
+		}
+		s, ok := input.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s requires its input to be a string, got %s", name, typeName(input))
+		}
+
+		isTrimmed := unicode.IsSpace
+		if c := docGet(doc, "chars"); !isMissing(c) {
+			chars, err := evalExpression(c, scope)
+			if err != nil {
+				return nil, err
+			}
+			if isNullish(chars) {
+				return nil, nil
+			}
+			set, ok := chars.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s requires 'chars' to be a string, got %s", name, typeName(chars))
+			}
+			isTrimmed = func(r rune) bool { return strings.ContainsRune(set, r) }
+		}
+
+		if name != "$rtrim" {
+			s = strings.TrimLeftFunc(s, isTrimmed)
+		}
+		if name != "$ltrim" {
+			s = strings.TrimRightFunc(s, isTrimmed)
+		}
+		return s, nil
+	}
+}
+
+// evalStrLenCP evaluate the $strLenCP operator
+func evalStrLenCP(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$strLenCP", args, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := values[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("$strLenCP requires a string argument, found: %s", typeName(values[0]))
+	}
+	return int32(utf8.RuneCountInString(s)), nil
+}
+
+// evalSubstrCP evaluate the $substrCP operator
+func evalSubstrCP(args interface{}, scope *exprScope) (interface{}, error) {
+	values, err := evalFixedArgs("$substrCP", args, 3, scope)
+	if err != nil {
+		return nil, err
+	}
+	if isNullish(values[0]) {
+		return "", nil
+	}
+	converted, err := convertValue(values[0], "string")
+	if err != nil {
+		return nil, err
+	}
+	s := converted.(string)
+	start, okStart := toInt64(values[1])
+	length, okLength := toInt64(values[2])
+	if !okStart || !okLength || start < 0 {
+		return nil, fmt.Errorf("$substrCP requires a non-negative integral starting index and a integral length")
+	}
+
+	runes := []rune(s)
+	if start > int64(len(runes)) {
+		return "", nil
+	}
+	end := start + length
+	if length < 0 || end > int64(len(runes)) {
+		end = int64(len(runes))
+	}
+	return string(runes[start:end]), nil
+}
+
+// caseOperator return the $toLower or the $toUpper operator
+func caseOperator(name string, fn func(string) string) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		values, err := evalFixedArgs(name, args, 1, scope)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(values[0]) {
+			return "", nil
+		}
+		s, err := convertValue(values[0], "string")
+		if err != nil {
+			return nil, err
+		}
+		return fn(s.(string)), nil
+	}
+}
+
+// regexFindOperator return the $regexFind or the $regexFindAll operator
+func regexFindOperator(name string) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		input, pattern, options, err := regexArgs(name, args, scope)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(input) {
+			if name == "$regexFind" {
+				return nil, nil
+			}
+			return bson.A{}, nil
+		}
+
+		re, err := compileRegex(pattern, options)
+		if err != nil {
+			return nil, err
+		}
+		s := input.(string)
+		n := 1
+		if name == "$regexFindAll" {
+			n = -1
+		}
+
+		out := bson.A{}
+		for _, loc := range re.FindAllStringSubmatchIndex(s, n) {
+			captures := bson.A{}
+			for i := 2; i < len(loc); i += 2 {
+				if loc[i] < 0 {
+					captures = append(captures, nil)
+				} else {
+					captures = append(captures, s[loc[i]:loc[i+1]])
+				}
+			}
+			out = append(out, bson.D{
+				{Key: "match", Value: s[loc[0]:loc[1]]},
+				{Key: "idx", Value: int32(utf8.RuneCountInString(s[:loc[0]]))},
+				{Key: "captures", Value: captures},
+			})
+		}
+
+		if name == "$regexFindAll" {
+			return out, nil
+		}
+		if len(out) == 0 {
+			return nil, nil
+		}
+		return out[0], nil
+	}
+}
+
+// evalConvert evaluate the $convert operator
+func evalConvert(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$convert", args, []string{"input", "to"}, []string{"onError", "onNull"})
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := evalExpression(docGet(doc, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+	to, err := evalExpression(docGet(doc, "to"), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNullish(input) {
+		if onNull := docGet(doc, "onNull"); !isMissing(onNull) {
+			return evalExpression(onNull, scope)
+		}
+		return nil, nil
+	}
+
+	res, err := convertValue(input, to)
+	if err != nil {
+		if onError := docGet(doc, "onError"); !isMissing(onError) {
+			return evalExpression(onError, scope)
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// conversionOperator return a operator like $toDouble that convert its argument to the type to
+func conversionOperator(name string, to string) exprOperator {
+	return func(args interface{}, scope *exprScope) (interface{}, error) {
+		values, err := evalFixedArgs(name, args, 1, scope)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(values[0]) {
+			return nil, nil
+		}
+		return convertValue(values[0], to)
+	}
+}
+
+// conversionTypeCodes contains the names of the bson type codes accepted by $convert
+var conversionTypeCodes = map[int64]string{
+	1: "double", 2: "string", 7: "objectId", 8: "bool", 9: "date", 16: "int", 18: "long", 19: "decimal",
+}
+
+// formatDouble return the string representation of f used by mongodb
+func formatDouble(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// formatDate return the ISO 8601 string representation of d used by mongodb
+func formatDate(d primitive.DateTime) string {
+	return time.Unix(0, int64(d)*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// convertValue return the non-null v converted to the type to, that could be a type name or a type code
+func convertValue(v interface{}, to interface{}) (interface{}, error) {
+	target, ok := to.(string)
+	if !ok {
+		code, isCode := toInt64(to)
+		if target, ok = conversionTypeCodes[code]; !isCode || !ok {
+			return nil, fmt.Errorf("unknown type to convert to: %v", to)
+		}
+	}
+
+	failure := fmt.Errorf("unsupported conversion from %s to %s in $convert with no onError value", typeName(v), target)
+	switch target {
+	case "double":
+		switch val := v.(type) {
+		case bool:
+			if val {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse number '%s' in $convert with no onError value", val)
+			}
+			return f, nil
+		case primitive.DateTime:
+			return float64(val), nil
+		}
+		if f, ok := toFloat(v); ok {
+			return f, nil
+		}
+	case "int", "long":
+		var n int64
+		switch val := v.(type) {
+		case bool:
+			if val {
+				n = 1
+			}
+		case string:
+			parsed, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse number '%s' in $convert with no onError value", val)
+			}
+			n = parsed
+		case primitive.DateTime:
+			if target == "int" {
+				return nil, failure
+			}
+			n = int64(val)
+		default:
+			f, ok := toFloat(v)
+			if !ok || math.IsNaN(f) || math.IsInf(f, 0) || f >= math.MaxInt64 || f < math.MinInt64 {
+				return nil, failure
+			}
+			n = int64(f)
+		}
+		if target == "long" {
+			return n, nil
+		}
+		if n > math.MaxInt32 || n < math.MinInt32 {
+			return nil, fmt.Errorf("conversion would overflow target type in $convert with no onError value")
+		}
+		return int32(n), nil
+	case "decimal":
+		var s string
+		switch val := v.(type) {
+		case bool:
+			s = "0"
+			if val {
+				s = "1"
+			}
+		case string:
+			s = val
+		case primitive.DateTime:
+			s = strconv.FormatInt(int64(val), 10)
+		case primitive.Decimal128:
+			return val, nil
+		case float64:
+			s = formatDouble(val)
+		default:
+			if !isNumber(v) {
+				return nil, failure
+			}
+			s = fmt.Sprint(v)
+		}
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse number '%s' in $convert with no onError value", s)
+		}
+		return d, nil
+	case "string":
+		switch val := v.(type) {
+		case string:
+			return val, nil
+		case bool:
+			return strconv.FormatBool(val), nil
+		case float64:
+			return formatDouble(val), nil
+		case int32, int64:
+			return fmt.Sprint(val), nil
+		case primitive.Decimal128:
+			return val.String(), nil
+		case primitive.ObjectID:
+			return val.Hex(), nil
+		case primitive.DateTime:
+			return formatDate(val), nil
+		}
+	case "bool":
+		switch val := v.(type) {
+		case bool:
+			return val, nil
+		case string, primitive.ObjectID, primitive.DateTime:
+			return true, nil
+		default:
+			if isNumber(val) {
+				return isTruthy(val), nil
+			}
+		}
+	case "date":
+		switch val := v.(type) {
+		case primitive.DateTime:
+			return val, nil
+		case string:
+			t, err := parseDateString(val, "", nil)
+			if err != nil {
+				return nil, err
+			}
+			return primitive.NewDateTimeFromTime(t), nil
+		case primitive.ObjectID:
+			return primitive.NewDateTimeFromTime(val.Timestamp()), nil
+		case int64, float64, primitive.Decimal128:
+			f, _ := toFloat(val)
+			return primitive.DateTime(int64(f)), nil
+		}
+	case "objectId":
+		switch val := v.(type) {
+		case primitive.ObjectID:
+			return val, nil
+		case string:
+			id, err := primitive.ObjectIDFromHex(val)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse objectId '%s' in $convert with no onError value", val)
+			}
+			return id, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type name: %s", target)
+	}
+
+	return nil, failure
+}
+
+// evalDateFromString evaluate the $dateFromString operator
+func evalDateFromString(args interface{}, scope *exprScope) (interface{}, error) {
+	doc, err := namedArgs("$dateFromString", args, []string{"dateString"}, []string{"format", "timezone", "onError", "onNull"})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	for _, name := range []string{"dateString", "format", "timezone"} {
+		if values[name], err = evalExpression(docGet(doc, name), scope); err != nil {
+			return nil, err
+		}
+	}
+
+	if isNullish(values["dateString"]) {
+		if onNull := docGet(doc, "onNull"); !isMissing(onNull) {
+			return evalExpression(onNull, scope)
+		}
+		return nil, nil
+	}
+
+	var loc *time.Location
+	if tz, ok := values["timezone"].(string); ok {
+		if loc, err = parseTimezone(tz); err != nil {
+			return nil, err
+		}
+	}
+	format, _ := values["format"].(string)
+
+	s, ok := values["dateString"].(string)
+	if !ok {
+		err = fmt.Errorf("$dateFromString requires that 'dateString' be a string, found: %s", typeName(values["dateString"]))
+	} else {
+		var t time.Time
+		if t, err = parseDateString(s, format, loc); err == nil {
+			return primitive.NewDateTimeFromTime(t), nil
+		}
+	}
+
+	if onError := docGet(doc, "onError"); !isMissing(onError) {
+		return evalExpression(onError, scope)
+	}
+	return nil, err
+}
+
+// parseTimezone return the location of the Olson timezone name or of the UTC offset like +02:00
+func parseTimezone(tz string) (*time.Location, error) {
+	if strings.HasPrefix(tz, "+") || strings.HasPrefix(tz, "-") {
+		digits := strings.Replace(tz[1:], ":", "", 1)
+		if len(digits) == 2 {
+			digits += "00"
+		}
+		if len(digits) != 4 {
+			return nil, fmt.Errorf("unrecognized time zone identifier: %s", tz)
+		}
+		hours, errH := strconv.Atoi(digits[:2])
+		minutes, errM := strconv.Atoi(digits[2:])
+		if errH != nil || errM != nil {
+			return nil, fmt.Errorf("unrecognized time zone identifier: %s", tz)
+		}
+		offset := hours*3600 + minutes*60
+		if tz[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(tz, offset), nil
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unrecognized time zone identifier: %s", tz)
+	}
+	return loc, nil
+}
+
+// dateFormatLayouts contains the go layouts of the mongodb date format specifiers
+var dateFormatLayouts = map[byte]string{
+	'Y': "2006", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05", 'L': "000",
+	'z': "-0700", 'Z': "Z07:00", 'b': "Jan", 'B': "January", 'j': "002", '%': "%",
+}
+
+// isoDateLayouts contains the layouts tried when no format is given to $dateFromString
+var isoDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	"Jan 2, 2006",
+	"January 2, 2006",
+}
+
+// parseDateString return the time parsed from s using the mongodb format, or the iso formats if the format is empty.
+// The time is interpreted in the loc if s doesn't contain a offset
+func parseDateString(s string, format string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	layouts := isoDateLayouts
+	if format != "" {
+		var sb strings.Builder
+		for i := 0; i < len(format); i++ {
+			if format[i] != '%' {
+				sb.WriteByte(format[i])
+				continue
+			}
+			if i+1 >= len(format) {
+				return time.Time{}, fmt.Errorf("unmatched '%%' at end of format string")
+			}
+			layout, ok := dateFormatLayouts[format[i+1]]
+			if !ok {
+				return time.Time{}, fmt.Errorf("invalid format character '%%%c' in format string", format[i+1])
+			}
+			if format[i+1] == 'L' && (i == 0 || (format[i-1] != '.' && format[i-1] != ',')) {
+				return time.Time{}, fmt.Errorf("the '%%L' format specifier must follow a '.' or a ','")
+			}
+			sb.WriteString(layout)
+			i++
+		}
+		layouts = []string{sb.String()}
+	}
+
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("error parsing date string '%s'", s)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEvalExpression(t *testing.T) {
+	doc := bson.M{
+		"a":     bson.M{"b": 5},
+		"n":     3,
+		"s":     " héllo world ",
+		"list":  bson.A{1, 2, 3, 4},
+		"words": bson.A{"a", "b", "c"},
+		"date":  "2019-11-05",
+		"items": bson.A{bson.M{"qty": 2}, bson.M{"qty": 5}},
+	}
+	tests := []struct {
+		name string
+		expr interface{}
+		vars map[string]interface{}
+		want string
+	}{
+		{"field path", "$a.b", nil, `5`},
+		{"missing field", "$nothing", nil, `null`},
+		{"root", "$$ROOT.n", nil, `3`},
+		{"user variable", "$$limit", map[string]interface{}{"limit": 7}, `7`},
+		{"arithmetic", APOAdd("$n", APOMultiply(2, "$a.b"), APOSubtract(10, 4), APODivide(9, 3)), nil, `22.0`},
+		{"floor and ceil", bson.A{APOFloor(2.5), APOCeil(2.5)}, nil, `[2.0, 3.0]`},
+		{"comparison", APOAnd(APOGreater("$n", 2), APONot(APOEqual("$n", 4)), APOGreaterOrEqual(3, "$n")), nil, `true`},
+		{"cond", APOCond(APOGreater("$n", 5), "big", "small"), nil, `"small"`},
+		{"if null", APOIfNull("$nothing", "default"), nil, `"default"`},
+		{"let", APOLet(bson.M{"x": "$n"}, APOMultiply("$$x", "$$x")), nil, `9`},
+		{"map", APOMap("$list", "v", APOMultiply("$$v", 10)), nil, `[10, 20, 30, 40]`},
+		{"filter", APOFilter("$list", "v", APOGreater("$$v", 2)), nil, `[3, 4]`},
+		{"reduce", APOReduce("$list", 0, APOAdd("$$value", "$$this")), nil, `10`},
+		{"slice and size", bson.A{APOSlice("$list", 1, 2), APOSize("$list"), APOArrayElemAt("$list", -1)}, nil, `[[2, 3], 4, 4]`},
+		{"concat arrays and set union", bson.A{APOConcatArrays("$words", bson.A{"d"}), APOSize(APOSetUnion("$words", bson.A{"a", "z"}))}, nil,
+			`[["a", "b", "c", "d"], 4]`},
+		{"merge objects", APOMergeObjects("$a", bson.M{"c": 1}), nil, `{"b": 5, "c": 1}`},
+		{"strings", bson.A{APOTrim("$s"), APOStrLenCP(APOTrim("$s")), APOSubstrCP(APOTrim("$s"), 1, 4), APOIndexOfCp("$s", "w")}, nil,
+			`["héllo world", 11, "éllo", 7]`},
+		{"split and concat", APOConcat(APOArrayElemAt(APOSplit("a-b", "-"), 1), "!"), nil, `"b!"`},
+		{"convert", bson.A{APOConvert("42", "int"), APOToDouble("1.5"), APOConvertToDoubleOrZero("x"), APOConvertToDoubleOrZero(nil)}, nil,
+			`[42, 1.5, 0, 0]`},
+		{"date from string", APODateFromString("$date", "%Y-%m-%d"), nil, `{"$date": "2019-11-05T00:00:00Z"}`},
+		{"min and max", bson.A{APOMin(3, 1, 2), APOMax(3, 1, 2)}, nil, `[1, 3]`},
+		{"join", APOJoin("$words", ", "), nil, `"a, b, c"`},
+		{"any", APOAny("$list", "v", APOGreater("$$v", 3)), nil, `true`},
+		{"capture from regex match", APOGetCaptureFromRegexMatch("host-42", `^host-(\d+)$`, "", 0), nil, `"42"`},
+		{"sum reducer", APOSumReducer("$items", "$$this.qty"), nil, `7`},
+		{"max with compare expression", APOMaxWithCmpExpr("$n", 5, "n", "five"), nil, `"five"`},
+		{"date to parts", bson.M{"$dateToParts": bson.M{"date": time.Date(2019, 12, 30, 8, 5, 0, 0, time.UTC), "timezone": "+01:00"}}, nil,
+			`{"year": 2019, "month": 12, "day": 30, "hour": 9, "minute": 5, "second": 0, "millisecond": 0}`},
+		{"date to ISO parts", bson.M{"$dateToParts": bson.M{"date": time.Date(2019, 12, 30, 8, 0, 0, 0, time.UTC), "iso8601": true}}, nil,
+			`{"isoWeekYear": 2020, "isoWeek": 1, "isoDayOfWeek": 1, "hour": 8, "minute": 0, "second": 0, "millisecond": 0}`},
+		{"date from ISO parts", bson.M{"$dateFromParts": bson.M{"isoWeekYear": 2021, "isoWeek": 1, "isoDayOfWeek": 7}}, nil,
+			`{"$date": "2021-01-10T00:00:00Z"}`},
+		{"date from parts carry", bson.M{"$dateFromParts": bson.M{"year": 2019, "month": 14, "day": 0}}, nil,
+			`{"$date": "2020-01-31T00:00:00Z"}`},
+		{"date trunc emulated", APODateTruncEmulated(time.Date(2019, 3, 31, 22, 30, 0, 0, time.UTC), DateUnitWeek, "Europe/Rome"), nil,
+			`{"$date": "2019-03-31T22:00:00Z"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EvalExpression(tt.expr, doc, tt.vars)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestEvalExpressionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr interface{}
+	}{
+		{"unknown operator", bson.M{"$foo": 1}},
+		{"undefined variable", "$$nothing"},
+		{"divide by zero", APODivide(1, 0)},
+		{"add strings", APOAdd("a", 1)},
+		{"failed conversion", APOConvert("x", "int")},
+		{"date from mixed parts", bson.M{"$dateFromParts": bson.M{"year": 2019, "isoWeek": 1}}},
+		{"date from parts without year", bson.M{"$dateFromParts": bson.M{"month": 1}}},
+		{"date to parts of a string", bson.M{"$dateToParts": bson.M{"date": "2019"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := EvalExpression(tt.expr, bson.M{}, nil); err == nil {
+				t.Errorf("expected a error, got %v", got)
+			}
+		})
+	}
+}
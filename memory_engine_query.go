@@ -0,0 +1,458 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// matchDocument return true if the doc satisfy the query filter
+func matchDocument(doc bson.D, filter interface{}, scope *exprScope) (bool, error) {
+	cond, ok := filter.(bson.D)
+	if !ok {
+		return false, fmt.Errorf("the query filter must be a document, got %s", typeName(filter))
+	}
+
+	for _, e := range cond {
+		ok, err := matchTopLevel(doc, e.Key, e.Value, scope)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchTopLevel return true if the doc satisfy the single top level condition key: value
+func matchTopLevel(doc bson.D, key string, value interface{}, scope *exprScope) (bool, error) {
+	switch key {
+	case "$and", "$or", "$nor":
+		conds, ok := value.(bson.A)
+		if !ok || len(conds) == 0 {
+			return false, fmt.Errorf("%s must be a nonempty array", key)
+		}
+		for _, c := range conds {
+			ok, err := matchDocument(doc, c, scope)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case key == "$and" && !ok:
+				return false, nil
+			case key == "$or" && ok:
+				return true, nil
+			case key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return key != "$or", nil
+	case "$expr":
+		res, err := evalExpression(value, scope.withCurrent(doc))
+		if err != nil {
+			return false, err
+		}
+		return isTruthy(res), nil
+	case "$comment":
+		return true, nil
+	}
+
+	if strings.HasPrefix(key, "$") {
+		return false, fmt.Errorf("unknown top level operator: %s", key)
+	}
+
+	return matchField(doc, key, value, scope)
+}
+
+// isOperatorDocument return true if v is a document whose first key is a operator
+func isOperatorDocument(v interface{}) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// matchField return true if the value at path satisfy the cond
+func matchField(doc bson.D, path string, cond interface{}, scope *exprScope) (bool, error) {
+	if !isOperatorDocument(cond) {
+		if re, ok := cond.(primitive.Regex); ok {
+			return matchOperator(doc, path, "$regex", re, re.Options, scope)
+		}
+		return matchOperator(doc, path, "$eq", cond, "", scope)
+	}
+
+	ops := cond.(bson.D)
+	options := ""
+	if o, ok := docGet(ops, "$options").(string); ok {
+		options = o
+	}
+	for _, op := range ops {
+		if op.Key == "$options" {
+			continue
+		}
+		ok, err := matchOperator(doc, path, op.Key, op.Value, options, scope)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// expandArrays return the values plus the elements of the values that are arrays
+func expandArrays(values []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+		if arr, ok := v.(bson.A); ok {
+			out = append(out, arr...)
+		}
+	}
+	return out
+}
+
+// queryEqual return true if the candidate is equal to the value with the query semantics, where null match also missing fields
+func queryEqual(candidate interface{}, value interface{}) bool {
+	if value == nil {
+		return candidate == nil || isMissing(candidate)
+	}
+	if re, ok := value.(primitive.Regex); ok {
+		if s, ok := candidate.(string); ok {
+			compiled, err := compileRegex(re.Pattern, re.Options)
+			return err == nil && compiled.MatchString(s)
+		}
+	}
+	return valuesEqual(candidate, value)
+}
+
+// queryComparable return true if the candidate can be compared to value by the $lt, $gt, ... operators
+func queryComparable(candidate interface{}, value interface{}) bool {
+	if value == nil {
+		return candidate == nil || isMissing(candidate)
+	}
+	return typeOrder(candidate) == typeOrder(value)
+}
+
+// matchOperator return true if the value at path satisfy the query operator op with the argument arg
+func matchOperator(doc bson.D, path string, op string, arg interface{}, options string, scope *exprScope) (bool, error) {
+	values := getQueryPathValues(doc, path)
+	candidates := expandArrays(values)
+
+	switch op {
+	case "$eq":
+		for _, c := range candidates {
+			if queryEqual(c, arg) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$ne":
+		ok, err := matchOperator(doc, path, "$eq", arg, options, scope)
+		return !ok, err
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, c := range candidates {
+			if !queryComparable(c, arg) {
+				continue
+			}
+			cmp := compareValues(c, arg)
+			if arg == nil {
+				cmp = 0
+			}
+			if (op == "$gt" && cmp > 0) || (op == "$gte" && cmp >= 0) || (op == "$lt" && cmp < 0) || (op == "$lte" && cmp <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		list, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		found := false
+		for _, c := range candidates {
+			for _, v := range list {
+				if queryEqual(c, v) {
+					found = true
+				}
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		exists := false
+		for _, v := range values {
+			if !isMissing(v) {
+				exists = true
+			}
+		}
+		return exists == isTruthy(arg), nil
+	case "$size":
+		n, ok := toInt64(arg)
+		if !ok {
+			return false, fmt.Errorf("$size needs a integer")
+		}
+		for _, v := range values {
+			if arr, ok := v.(bson.A); ok && int64(len(arr)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$regex":
+		pattern := ""
+		switch r := arg.(type) {
+		case string:
+			pattern = r
+		case primitive.Regex:
+			pattern = r.Pattern
+			if options == "" {
+				options = r.Options
+			}
+		default:
+			return false, fmt.Errorf("$regex has to be a string")
+		}
+		re, err := compileRegex(pattern, options)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range candidates {
+			if s, ok := c.(string); ok && re.MatchString(s) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$not":
+		if re, ok := arg.(primitive.Regex); ok {
+			arg = bson.D{{Key: "$regex", Value: re}}
+		}
+		if !isOperatorDocument(arg) {
+			return false, fmt.Errorf("$not needs a regex or a document")
+		}
+		ok, err := matchField(doc, path, arg, scope)
+		return !ok, err
+	case "$all":
+		list, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("$all needs an array")
+		}
+		if len(list) == 0 {
+			return false, nil
+		}
+		for _, v := range list {
+			cond := v
+			if !isOperatorDocument(v) {
+				cond = bson.D{{Key: "$eq", Value: v}}
+			}
+			ok, err := matchField(doc, path, cond, scope)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case "$elemMatch":
+		cond, ok := arg.(bson.D)
+		if !ok {
+			return false, fmt.Errorf("$elemMatch needs an object")
+		}
+		for _, v := range values {
+			arr, ok := v.(bson.A)
+			if !ok {
+				continue
+			}
+			for _, elem := range arr {
+				ok, err := matchElement(elem, cond, scope)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$mod":
+		list, ok := arg.(bson.A)
+		if !ok || len(list) != 2 {
+			return false, fmt.Errorf("malformed mod, needs to be an array of two numbers")
+		}
+		divisor, ok1 := toFloat(list[0])
+		remainder, ok2 := toFloat(list[1])
+		if !ok1 || !ok2 || !isNumber(list[0]) || !isNumber(list[1]) {
+			return false, fmt.Errorf("malformed mod, divisor and remainder must be numbers")
+		}
+		if int64(divisor) == 0 {
+			return false, fmt.Errorf("divisor cannot be 0")
+		}
+		for _, c := range candidates {
+			if f, ok := toFloat(c); ok && isNumber(c) && int64(f)%int64(divisor) == int64(remainder) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$type":
+		types, ok := arg.(bson.A)
+		if !ok {
+			types = bson.A{arg}
+		}
+		for _, t := range types {
+			name, err := queryTypeName(t)
+			if err != nil {
+				return false, err
+			}
+			for _, c := range candidates {
+				if name == typeName(c) || (name == "number" && isNumber(c)) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$bitsAllSet", "$bitsAnySet", "$bitsAllClear", "$bitsAnyClear":
+		mask, err := queryBitmask(op, arg)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range candidates {
+			f, ok := toFloat(c)
+			if !ok || !isNumber(c) || f != float64(int64(f)) {
+				continue
+			}
+			set := uint64(int64(f)) & mask
+			if (op == "$bitsAllSet" && set == mask) || (op == "$bitsAnySet" && set != 0) ||
+				(op == "$bitsAllClear" && set == 0) || (op == "$bitsAnyClear" && set != mask) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unknown operator: %s", op)
+}
+
+// matchElement return true if the array element satisfy the condition of $elemMatch, that is a query filter for
+// the documents or a document of operators applied to the element itself
+func matchElement(elem interface{}, cond bson.D, scope *exprScope) (bool, error) {
+	if isOperatorDocument(cond) && cond[0].Key != "$and" && cond[0].Key != "$or" && cond[0].Key != "$nor" && cond[0].Key != "$expr" {
+		return matchField(bson.D{{Key: "elem", Value: elem}}, "elem", cond, scope)
+	}
+
+	doc, ok := elem.(bson.D)
+	if !ok {
+		return false, nil
+	}
+	return matchDocument(doc, cond, scope)
+}
+
+// queryTypeNames contains the names of the bson types by number, as accepted by $type
+var queryTypeNames = map[int64]string{
+	-1: "minKey", 1: "double", 2: "string", 3: "object", 4: "array", 5: "binData", 6: "undefined", 7: "objectId",
+	8: "bool", 9: "date", 10: "null", 11: "regex", 12: "dbPointer", 13: "javascript", 14: "symbol",
+	15: "javascriptWithScope", 16: "int", 17: "timestamp", 18: "long", 19: "decimal", 127: "maxKey",
+}
+
+// queryTypeName return the name of the bson type t, that could be a alias like "string" or a number like 2
+func queryTypeName(t interface{}) (string, error) {
+	if name, ok := t.(string); ok {
+		if name == "number" {
+			return name, nil
+		}
+		for _, n := range queryTypeNames {
+			if n == name {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("unknown type name alias: %s", name)
+	}
+
+	n, ok := toInt64(t)
+	if name, known := queryTypeNames[n]; ok && known {
+		return name, nil
+	}
+	return "", fmt.Errorf("invalid numerical type code: %v", t)
+}
+
+// queryBitmask return the bitmask of the bitwise operator op, that could be a number or an array of bit positions
+func queryBitmask(op string, arg interface{}) (uint64, error) {
+	if positions, ok := arg.(bson.A); ok {
+		mask := uint64(0)
+		for _, p := range positions {
+			n, ok := toInt64(p)
+			if !ok || n < 0 || n > 63 {
+				return 0, fmt.Errorf("%s bit positions must be integers between 0 and 63", op)
+			}
+			mask |= 1 << uint(n)
+		}
+		return mask, nil
+	}
+
+	f, ok := toFloat(arg)
+	if !ok || !isNumber(arg) || f < 0 || f != float64(int64(f)) {
+		return 0, fmt.Errorf("%s takes an Array, a number, or a BinData but received: %v", op, arg)
+	}
+	return uint64(int64(f)), nil
+}
+
+// compileRegex return the compiled regex with the mongodb options i, m, s and x
+func compileRegex(pattern string, options string) (*regexp.Regexp, error) {
+	flags := ""
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+			pattern = stripExtendedRegex(pattern)
+		case 'u':
+		default:
+			return nil, fmt.Errorf("invalid flag in regex options: %c", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	return re, nil
+}
+
+// stripExtendedRegex return the pattern without the whitespaces and the comments allowed by the x option
+func stripExtendedRegex(pattern string) string {
+	var sb strings.Builder
+	escaped, inClass, inComment := false, false, false
+	for _, r := range pattern {
+		switch {
+		case inComment:
+			inComment = r != '\n'
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '[':
+			inClass = true
+		case r == ']':
+			inClass = false
+		case !inClass && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			continue
+		case !inClass && r == '#':
+			inComment = true
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// densifyStep return the function that return the value step after v, for numbers or, if unit is not empty, for dates
+func densifyStep(step interface{}, unit string) (func(v interface{}) (interface{}, bool), error) {
+	if !isNumber(step) {
+		return nil, fmt.Errorf("the step parameter in a range statement must be a numeric value")
+	}
+
+	if unit == "" {
+		return func(v interface{}) (interface{}, bool) {
+			if !isNumber(v) {
+				return nil, false
+			}
+			return addNumbers(v, step), true
+		}, nil
+	}
+
+	n, ok := toInt64(step)
+	if !ok {
+		return nil, fmt.Errorf("the step parameter must be an integer when a unit is specified")
+	}
+	if _, err := addDateUnits(time.Time{}, unit, 0); err != nil {
+		return nil, err
+	}
+
+	return func(v interface{}) (interface{}, bool) {
+		date, ok := v.(primitive.DateTime)
+		if !ok {
+			return nil, false
+		}
+		t, _ := addDateUnits(date.Time().UTC(), unit, n)
+		return primitive.NewDateTimeFromTime(t), true
+	}, nil
+}
+
+// stageDensify return the docs sorted by the field plus a document for every missing value of the range of the field.
+// The partitions are not supported
+func stageDensify(arg interface{}, docs []bson.D) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the $densify specification must be an object")
+	}
+	field, ok := docGet(spec, "field").(string)
+	if !ok {
+		return nil, fmt.Errorf("the 'field' parameter must be a string")
+	}
+	if !isMissing(docGet(spec, "partitionByFields")) {
+		return nil, fmt.Errorf("the 'partitionByFields' parameter is not supported")
+	}
+	rangeSpec, ok := docGet(spec, "range").(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the 'range' parameter must be an object")
+	}
+	unit, _ := docGet(rangeSpec, "unit").(string)
+	next, err := densifyStep(docGet(rangeSpec, "step"), unit)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted, err := stageSort(bson.D{{Key: field, Value: int32(1)}}, docs)
+	if err != nil {
+		return nil, err
+	}
+	values := bson.A{}
+	for _, doc := range sorted {
+		if v := getFieldPath(doc, field); !isNullish(v) {
+			values = append(values, v)
+		}
+	}
+
+	var lower, upper interface{}
+	switch bounds := docGet(rangeSpec, "bounds").(type) {
+	case bson.A:
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("the bounds of a range must be an array of two values")
+		}
+		lower, upper = bounds[0], bounds[1]
+	case string:
+		if bounds != "full" && bounds != "partition" {
+			return nil, fmt.Errorf("the bounds must be 'full', 'partition' or an array")
+		}
+		if len(values) == 0 {
+			return sorted, nil
+		}
+		lower = values[0]
+		if upper, _ = next(values[len(values)-1]); upper == nil {
+			return nil, fmt.Errorf("the values of the field %s don't match the step of the range", field)
+		}
+	default:
+		return nil, fmt.Errorf("the 'bounds' parameter is required")
+	}
+
+	out := append([]bson.D{}, sorted...)
+	for v := lower; compareValues(v, upper) < 0; {
+		if !containsValue(values, v) {
+			out = append(out, setFieldPath(bson.D{}, field, v))
+		}
+		var ok bool
+		if v, ok = next(v); !ok {
+			return nil, fmt.Errorf("the bounds of the range don't match the type of the step")
+		}
+	}
+
+	return stageSort(bson.D{{Key: field, Value: int32(1)}}, out)
+}
+
+// stageFill return the docs sorted by sortBy with the null or missing output fields set to a value or to the last observed value.
+// The partitions and the linear method are not supported
+func stageFill(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the $fill specification must be an object")
+	}
+	if !isMissing(docGet(spec, "partitionBy")) || !isMissing(docGet(spec, "partitionByFields")) {
+		return nil, fmt.Errorf("the partitions are not supported")
+	}
+	output, ok := docGet(spec, "output").(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the 'output' parameter must be an object")
+	}
+
+	if sortBy := docGet(spec, "sortBy"); !isMissing(sortBy) {
+		sorted, err := stageSort(sortBy, docs)
+		if err != nil {
+			return nil, err
+		}
+		docs = sorted
+	}
+
+	last := map[string]interface{}{}
+	out := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		for _, o := range output {
+			method, _ := o.Value.(bson.D)
+			current := getFieldPath(doc, o.Key)
+			if !isNullish(current) {
+				last[o.Key] = current
+				continue
+			}
+
+			if value := docGet(method, "value"); !isMissing(value) {
+				v, err := evalExpression(value, newExprScope(doc, vars))
+				if err != nil {
+					return nil, err
+				}
+				doc = setFieldPath(doc, o.Key, v)
+			} else if docGet(method, "method") == "locf" {
+				if v, ok := last[o.Key]; ok {
+					doc = setFieldPath(doc, o.Key, v)
+				}
+			} else {
+				return nil, fmt.Errorf("%s: the fill method must be a value or locf", o.Key)
+			}
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"sort"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testJSON return v as relaxed Extended JSON with the keys of the documents sorted,
+// to compare the values regardless of the order of the keys and of the types of the numbers
+func testJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	normalized, err := normalizeValue(v)
+	if err != nil {
+		t.Fatalf("can't normalize %v: %v", v, err)
+	}
+	out, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: testSortKeys(normalized)}}, false, false)
+	if err != nil {
+		t.Fatalf("can't marshal %v: %v", v, err)
+	}
+	return string(out)
+}
+
+// testSortKeys return v with the keys of the documents sorted
+func testSortKeys(v interface{}) interface{} {
+	switch x := v.(type) {
+	case bson.D:
+		out := make(bson.D, 0, len(x))
+		for _, e := range x {
+			out = append(out, bson.E{Key: e.Key, Value: testSortKeys(e.Value)})
+		}
+		sort.SliceStable(out, func(i, j int) bool {
+			return out[i].Key < out[j].Key
+		})
+		return out
+	case bson.A:
+		out := make(bson.A, 0, len(x))
+		for _, e := range x {
+			out = append(out, testSortKeys(e))
+		}
+		return out
+	}
+	return v
+}
+
+// assertJSON fail the test if got isn't equal to want, that is written in relaxed Extended JSON
+func assertJSON(t *testing.T, got interface{}, want string) {
+	t.Helper()
+	var expected bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"v": `+want+`}`), false, &expected); err != nil {
+		t.Fatalf("invalid expected value %s: %v", want, err)
+	}
+	if g, w := testJSON(t, got), testJSON(t, expected[0].Value); g != w {
+		t.Errorf("got %s, want %s", g, w)
+	}
+}
+
+// testNumbers return the documents {n: 0} ... {n: count-1}
+func testNumbers(count int) []bson.M {
+	out := []bson.M{}
+	for i := 0; i < count; i++ {
+		out = append(out, bson.M{"n": i})
+	}
+	return out
+}
+
+func TestMemoryEngineStages(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "name": "web1", "os": "linux", "tags": bson.A{"web", "prod"}, "cpu": 4},
+		{"_id": 2, "name": "db1", "os": "linux", "tags": bson.A{"db"}, "cpu": 16},
+		{"_id": 3, "name": "win1", "os": "windows", "tags": bson.A{}, "cpu": 8},
+	}
+	tests := []struct {
+		name     string
+		pipeline bson.A
+		want     string
+	}{
+		{"nil pipeline", nil, `[{"_id": 1, "name": "web1", "os": "linux", "tags": ["web", "prod"], "cpu": 4},
+			{"_id": 2, "name": "db1", "os": "linux", "tags": ["db"], "cpu": 16},
+			{"_id": 3, "name": "win1", "os": "windows", "tags": [], "cpu": 8}]`},
+		{"match", MAPipeline(APMatch(bson.M{"os": "linux"}), APProject(bson.M{"name": 1})),
+			`[{"_id": 1, "name": "web1"}, {"_id": 2, "name": "db1"}]`},
+		{"sort skip limit", MAPipeline(APSort(bson.M{"cpu": -1}), APSkip(1), APLimit(1), APProject(bson.M{"_id": 0, "cpu": 1})),
+			`[{"cpu": 8}]`},
+		{"set and unset", MAPipeline(APSet(bson.M{"double": APOMultiply("$cpu", 2)}), APUnset("tags", "os", "name"), APLimit(1)),
+			`[{"_id": 1, "cpu": 4, "double": 8}]`},
+		{"unwind", MAPipeline(APUnwind("$tags"), APProject(bson.M{"tags": 1})),
+			`[{"_id": 1, "tags": "web"}, {"_id": 1, "tags": "prod"}, {"_id": 2, "tags": "db"}]`},
+		{"group", MAPipeline(APGroup(bson.M{"_id": "$os", "cpu": APOSum("$cpu")}), APSort(bson.M{"_id": 1})),
+			`[{"_id": "linux", "cpu": 20}, {"_id": "windows", "cpu": 8}]`},
+		{"count", MAPipeline(APMatch(bson.M{"cpu": bson.M{"$gt": 4}}), APCount("total")),
+			`[{"total": 2}]`},
+		{"count of nothing", MAPipeline(APMatch(bson.M{"os": "mac"}), APCount("total")),
+			`[]`},
+		{"facet", MAPipeline(APFacet(bson.M{
+			"names": MAPipeline(APProject(bson.M{"_id": 0, "name": 1}), APLimit(1)),
+			"count": MAPipeline(APCount("n")),
+		})), `[{"names": [{"name": "web1"}], "count": [{"n": 3}]}]`},
+		{"replace with", MAPipeline(APLimit(1), APReplaceWith(bson.M{"host": "$name"})),
+			`[{"host": "web1"}]`},
+		{"lookup", MAPipeline(APMatch(bson.M{"_id": 2}), APLookupSimple("alerts", "name", "host", "alerts"),
+			APProject(bson.M{"alerts.msg": 1})),
+			`[{"_id": 2, "alerts": [{"msg": "disk full"}, {"msg": "slow queries"}]}]`},
+	}
+
+	e := NewMemoryEngine()
+	if err := e.AddCollection("alerts", []bson.M{
+		{"host": "db1", "msg": "disk full"},
+		{"host": "web1", "msg": "down"},
+		{"host": "db1", "msg": "slow queries"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := e.Aggregate(tt.pipeline, docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestMemoryEngineAggregateCollection(t *testing.T) {
+	e := NewMemoryEngine()
+	if err := e.AddCollection("hosts", testNumbers(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := e.AggregateCollection("hosts", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSON(t, out, `[{"n": 0}, {"n": 1}, {"n": 2}]`)
+
+	if _, err := e.AggregateCollection("missing", MAPipeline()); err == nil {
+		t.Error("expected a error for a missing collection")
+	}
+}
+
+func TestMemoryEngineErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline bson.A
+	}{
+		{"unknown stage", bson.A{bson.M{"$foo": 1}}},
+		{"stage with two keys", bson.A{bson.D{{Key: "$match", Value: bson.M{}}, {Key: "$limit", Value: 1}}}},
+		{"zero limit", MAPipeline(APLimit(0))},
+		{"unknown operator", MAPipeline(APSet(bson.M{"a": bson.M{"$foo": 1}}))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMemoryEngine().Aggregate(tt.pipeline, testNumbers(1)); err == nil {
+				t.Error("expected a error")
+			}
+		})
+	}
+}
+
+func TestMemoryEngineOptionalPagingStage(t *testing.T) {
+	tests := []struct {
+		name       string
+		page, size int
+		count      int
+		want       string
+	}{
+		{"first page", 0, 3, 10, `[{"content": [{"n": 0}, {"n": 1}, {"n": 2}], "metadata": {"totalElements": 10, "totalPages": 4,
+			"size": 3, "pageSize": 3, "number": 0, "numberOfElements": 3, "empty": false, "first": true, "last": false,
+			"hasNext": true, "hasPrevious": false, "sort": null}}]`},
+		{"last partial page", 3, 3, 10, `[{"content": [{"n": 9}], "metadata": {"totalElements": 10, "totalPages": 4,
+			"size": 1, "pageSize": 3, "number": 3, "numberOfElements": 1, "empty": false, "first": false, "last": true,
+			"hasNext": false, "hasPrevious": true, "sort": null}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(APOptionalPagingStage(tt.page, tt.size)), testNumbers(tt.count))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestMemoryEngineSearchFilterStage(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "hostname": "web-prod-1", "os": "Linux"},
+		{"_id": 2, "hostname": "db-prod-1", "os": "Linux"},
+		{"_id": 3, "hostname": "web-test-1", "os": "Windows"},
+	}
+	tests := []struct {
+		name     string
+		keywords []string
+		want     string
+	}{
+		{"no keywords", []string{}, `[{"_id": 1}, {"_id": 2}, {"_id": 3}]`},
+		{"one keyword", []string{"web"}, `[{"_id": 1}, {"_id": 3}]`},
+		{"case insensitive", []string{"WINDOWS"}, `[{"_id": 3}]`},
+		{"all keywords", []string{"prod", "linux", "db"}, `[{"_id": 2}]`},
+		{"regex metacharacters", []string{"web.prod"}, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(
+				APSearchFilterStage([]interface{}{"$hostname", "$os"}, tt.keywords),
+				APProject(bson.M{"_id": 1}),
+			), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestMemoryEngineGroupAndCountStages(t *testing.T) {
+	docs := []bson.M{{"os": "linux"}, {"os": "windows"}, {"os": "linux"}, {}}
+	out, err := NewMemoryEngine().Aggregate(MAPipeline(
+		APGroupAndCountStages("os", "count", "$os"),
+		APSort(bson.D{{Key: "count", Value: -1}, {Key: "os", Value: 1}}),
+	), docs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSON(t, out, `[{"os": "linux", "count": 2}, {"os": null, "count": 1}, {"os": "windows", "count": 1}]`)
+}
@@ -0,0 +1,579 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// missingValue is the value of a field that doesn't exist
+type missingValue struct{}
+
+// missing is the singleton used to represent a missing field
+var missing = missingValue{}
+
+// isMissing return true if v is the missing value
+func isMissing(v interface{}) bool {
+	_, ok := v.(missingValue)
+	return ok
+}
+
+// isNullish return true if v is null, undefined or missing
+func isNullish(v interface{}) bool {
+	switch v.(type) {
+	case nil, missingValue, primitive.Undefined, primitive.Null:
+		return true
+	}
+	return false
+}
+
+// normalizeValue return v converted to the types produced by the bson decoder (bson.D, bson.A, int32, int64, float64, ...)
+func normalizeValue(v interface{}) (interface{}, error) {
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+
+	var out bson.D
+	if err := bson.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+
+	return out[0].Value, nil
+}
+
+// normalizePipeline return the pipeline with the stages converted to the types produced by the bson decoder
+func normalizePipeline(pipeline bson.A) (bson.A, error) {
+	if pipeline == nil {
+		return bson.A{}, nil
+	}
+
+	normalized, err := normalizeValue(sortMapKeys(pipeline))
+	if err != nil {
+		return nil, err
+	}
+	return normalized.(bson.A), nil
+}
+
+// sortMapKeys return v with the maps, like the bson.M produced by the builders, converted to documents sorted by key,
+// so that the order of the keys doesn't change from run to run
+func sortMapKeys(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case Expr:
+		return sortMapKeys(x.Bson())
+	case bson.D:
+		out := make(bson.D, 0, len(x))
+		for _, e := range x {
+			out = append(out, bson.E{Key: e.Key, Value: sortMapKeys(e.Value)})
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, 0, len(x))
+		for _, item := range x {
+			out = append(out, sortMapKeys(item))
+		}
+		return out
+	}
+
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String:
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		out := make(bson.D, 0, len(keys))
+		for _, k := range keys {
+			value := rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()))
+			out = append(out, bson.E{Key: k, Value: sortMapKeys(value.Interface())})
+		}
+		return out
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 && !rv.IsNil():
+		out := make(bson.A, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			out = append(out, sortMapKeys(rv.Index(i).Interface()))
+		}
+		return out
+	}
+	return v
+}
+
+// normalizeDocuments return the docs, that could be a slice of bson.M, bson.D or structs, as a slice of bson.D
+func normalizeDocuments(docs interface{}) ([]bson.D, error) {
+	if docs == nil {
+		return []bson.D{}, nil
+	}
+
+	items, err := normalizeValue(docs)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := items.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("documents must be a slice, got %T", docs)
+	}
+
+	out := make([]bson.D, 0, len(arr))
+	for i, item := range arr {
+		doc, ok := item.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("document %d is not a document", i)
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+// docGet return the value of the key in doc or missing
+func docGet(doc bson.D, key string) interface{} {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return missing
+}
+
+// docSet return doc with the key set to value, preserving the position of the key if already present
+func docSet(doc bson.D, key string, value interface{}) bson.D {
+	for i, e := range doc {
+		if e.Key == key {
+			out := make(bson.D, len(doc))
+			copy(out, doc)
+			out[i].Value = value
+			return out
+		}
+	}
+
+	out := make(bson.D, len(doc), len(doc)+1)
+	copy(out, doc)
+	return append(out, bson.E{Key: key, Value: value})
+}
+
+// docRemove return doc without the key
+func docRemove(doc bson.D, key string) bson.D {
+	out := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		if e.Key != key {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// getFieldPath return the value of the dotted path in v with the aggregation semantics,
+// traversing arrays of documents and returning missing when the path doesn't exist
+func getFieldPath(v interface{}, path string) interface{} {
+	if path == "" {
+		return v
+	}
+	head, tail := path, ""
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		head, tail = path[:i], path[i+1:]
+	}
+
+	switch val := v.(type) {
+	case bson.D:
+		child := docGet(val, head)
+		if isMissing(child) || tail == "" {
+			return child
+		}
+		return getFieldPath(child, tail)
+	case bson.A:
+		out := bson.A{}
+		for _, item := range val {
+			switch item.(type) {
+			case bson.D, bson.A:
+				res := getFieldPath(item, path)
+				if !isMissing(res) {
+					out = append(out, res)
+				}
+			}
+		}
+		return out
+	default:
+		return missing
+	}
+}
+
+// getQueryPathValues return the candidate values of the dotted path in v with the query semantics,
+// where every element of a traversed array is a candidate too
+func getQueryPathValues(v interface{}, path string) []interface{} {
+	head, tail := path, ""
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		head, tail = path[:i], path[i+1:]
+	}
+
+	switch val := v.(type) {
+	case bson.D:
+		child := docGet(val, head)
+		if tail == "" {
+			return []interface{}{child}
+		}
+		return getQueryPathValues(child, tail)
+	case bson.A:
+		if idx, err := strconv.Atoi(head); err == nil {
+			if idx >= 0 && idx < len(val) {
+				if tail == "" {
+					return []interface{}{val[idx]}
+				}
+				return getQueryPathValues(val[idx], tail)
+			}
+		}
+		out := []interface{}{}
+		for _, item := range val {
+			if _, ok := item.(bson.D); ok {
+				out = append(out, getQueryPathValues(item, path)...)
+			}
+		}
+		if len(out) == 0 {
+			out = append(out, missing)
+		}
+		return out
+	default:
+		return []interface{}{missing}
+	}
+}
+
+// setFieldPath return doc with the value set at the dotted path, creating the intermediate documents.
+// When a intermediate value is an array of documents the value is set in every element
+func setFieldPath(doc bson.D, path string, value interface{}) bson.D {
+	head, tail := path, ""
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		head, tail = path[:i], path[i+1:]
+	}
+	if tail == "" {
+		if isMissing(value) {
+			return docRemove(doc, head)
+		}
+		return docSet(doc, head, value)
+	}
+
+	switch child := docGet(doc, head).(type) {
+	case bson.D:
+		return docSet(doc, head, setFieldPath(child, tail, value))
+	case bson.A:
+		out := make(bson.A, len(child))
+		for i, item := range child {
+			if sub, ok := item.(bson.D); ok {
+				out[i] = setFieldPath(sub, tail, value)
+			} else {
+				out[i] = item
+			}
+		}
+		return docSet(doc, head, out)
+	default:
+		if isMissing(value) {
+			return doc
+		}
+		return docSet(doc, head, setFieldPath(bson.D{}, tail, value))
+	}
+}
+
+// unsetFieldPath return doc without the value at the dotted path
+func unsetFieldPath(doc bson.D, path string) bson.D {
+	return setFieldPath(doc, path, missing)
+}
+
+// isNumber return true if v is a numeric value
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int32, int64, float64, primitive.Decimal128:
+		return true
+	}
+	return false
+}
+
+// isIntegral return true if v is a int32 or a int64
+func isIntegral(v interface{}) bool {
+	switch v.(type) {
+	case int32, int64:
+		return true
+	}
+	return false
+}
+
+// toFloat return the numeric v as a float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return math.NaN(), true
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+// toInt64 return the numeric v as a int64 if it has no fractional part
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	f, ok := toFloat(v)
+	if !ok || f != math.Trunc(f) || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// numberFromInt64 return n as int32 if it fits, otherwise as int64
+func numberFromInt64(n int64) interface{} {
+	if n >= math.MinInt32 && n <= math.MaxInt32 {
+		return int32(n)
+	}
+	return n
+}
+
+// isTruthy return the boolean value of v with the aggregation semantics
+func isTruthy(v interface{}) bool {
+	if isNullish(v) {
+		return false
+	}
+	switch val := v.(type) {
+	case bool:
+		return val
+	case int32, int64, float64, primitive.Decimal128:
+		f, _ := toFloat(val)
+		return f != 0
+	}
+	return true
+}
+
+// typeName return the name of the bson type of v, as returned by $type
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case missingValue:
+		return "missing"
+	case nil, primitive.Null:
+		return "null"
+	case primitive.Undefined:
+		return "undefined"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case bson.D, bson.M:
+		return "object"
+	case bson.A:
+		return "array"
+	case primitive.Binary:
+		return "binData"
+	case primitive.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case primitive.DateTime:
+		return "date"
+	case primitive.Regex:
+		return "regex"
+	case primitive.DBPointer:
+		return "dbPointer"
+	case primitive.JavaScript:
+		return "javascript"
+	case primitive.Symbol:
+		return "symbol"
+	case primitive.CodeWithScope:
+		return "javascriptWithScope"
+	case int32:
+		return "int"
+	case primitive.Timestamp:
+		return "timestamp"
+	case int64:
+		return "long"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.MinKey:
+		return "minKey"
+	case primitive.MaxKey:
+		return "maxKey"
+	}
+	return "unknown"
+}
+
+// typeOrder return the position of the type of v in the bson comparison order
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 0
+	case missingValue:
+		return 1
+	case nil, primitive.Null, primitive.Undefined:
+		return 2
+	case int32, int64, float64, primitive.Decimal128:
+		return 3
+	case string, primitive.Symbol:
+		return 4
+	case bson.D:
+		return 5
+	case bson.A:
+		return 6
+	case primitive.Binary:
+		return 7
+	case primitive.ObjectID:
+		return 8
+	case bool:
+		return 9
+	case primitive.DateTime:
+		return 10
+	case primitive.Timestamp:
+		return 11
+	case primitive.Regex:
+		return 12
+	case primitive.MaxKey:
+		return 14
+	}
+	return 13
+}
+
+// compareValues return -1, 0 or 1 if a is less, equal or greater than b using the bson comparison order
+func compareValues(a interface{}, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return compareInts(int64(ta), int64(tb))
+	}
+
+	switch va := a.(type) {
+	case int32, int64, float64, primitive.Decimal128:
+		if isIntegral(a) && isIntegral(b) {
+			ia, _ := toInt64(a)
+			ib, _ := toInt64(b)
+			return compareInts(ia, ib)
+		}
+		fa, _ := toFloat(va)
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		case math.IsNaN(fa) && !math.IsNaN(fb):
+			return -1
+		case !math.IsNaN(fa) && math.IsNaN(fb):
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(va, stringOf(b))
+	case primitive.Symbol:
+		return strings.Compare(string(va), stringOf(b))
+	case bson.D:
+		vb := b.(bson.D)
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			if c := compareInts(int64(typeOrder(va[i].Value)), int64(typeOrder(vb[i].Value))); c != 0 {
+				return c
+			}
+			if c := strings.Compare(va[i].Key, vb[i].Key); c != 0 {
+				return c
+			}
+			if c := compareValues(va[i].Value, vb[i].Value); c != 0 {
+				return c
+			}
+		}
+		return compareInts(int64(len(va)), int64(len(vb)))
+	case bson.A:
+		vb := b.(bson.A)
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			if c := compareValues(va[i], vb[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(int64(len(va)), int64(len(vb)))
+	case primitive.Binary:
+		vb := b.(primitive.Binary)
+		if len(va.Data) != len(vb.Data) {
+			return compareInts(int64(len(va.Data)), int64(len(vb.Data)))
+		}
+		if va.Subtype != vb.Subtype {
+			return compareInts(int64(va.Subtype), int64(vb.Subtype))
+		}
+		return bytes.Compare(va.Data, vb.Data)
+	case primitive.ObjectID:
+		vb := b.(primitive.ObjectID)
+		return bytes.Compare(va[:], vb[:])
+	case bool:
+		vb := b.(bool)
+		switch {
+		case va == vb:
+			return 0
+		case !va:
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		return compareInts(int64(va), int64(b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		return primitive.CompareTimestamp(va, b.(primitive.Timestamp))
+	case primitive.Regex:
+		vb := b.(primitive.Regex)
+		if c := strings.Compare(va.Pattern, vb.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(va.Options, vb.Options)
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// valuesEqual return true if a and b are equal using the bson comparison order
+func valuesEqual(a interface{}, b interface{}) bool {
+	return compareValues(a, b) == 0
+}
+
+// compareInts return -1, 0 or 1 if a is less, equal or greater than b
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// stringOf return the string value of a string or symbol
+func stringOf(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case primitive.Symbol:
+		return string(s)
+	}
+	return ""
+}
@@ -0,0 +1,577 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// windowPartition contains the sorted documents of a partition of $setWindowFields
+type windowPartition struct {
+	docs   []bson.D
+	sortBy bson.D
+	vars   map[string]interface{}
+}
+
+// stageSetWindowFields return the docs grouped by partition and sorted by sortBy with the output fields
+// computed over their windows
+func stageSetWindowFields(arg interface{}, docs []bson.D, vars map[string]interface{}) ([]bson.D, error) {
+	spec, err := namedArgs("$setWindowFields", arg, []string{"output"}, []string{"partitionBy", "sortBy"})
+	if err != nil {
+		return nil, err
+	}
+	output, ok := docGet(spec, "output").(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the 'output' parameter must be an object")
+	}
+	var sortBy bson.D
+	if v := docGet(spec, "sortBy"); !isMissing(v) {
+		if sortBy, ok = v.(bson.D); !ok {
+			return nil, fmt.Errorf("the 'sortBy' parameter must be an object")
+		}
+	}
+
+	partitions, err := windowPartitions(docGet(spec, "partitionBy"), docs, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]bson.D, 0, len(docs))
+	for _, partition := range partitions {
+		if sortBy != nil {
+			if partition, err = stageSort(sortBy, partition); err != nil {
+				return nil, err
+			}
+		}
+		w := &windowPartition{docs: partition, sortBy: sortBy, vars: vars}
+
+		results := make([]bson.D, len(partition))
+		copy(results, partition)
+		for _, e := range output {
+			fieldSpec, ok := e.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("the output field '%s' must be an object", e.Key)
+			}
+			values, err := w.evalOutput(fieldSpec)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", e.Key, err)
+			}
+			for i, v := range values {
+				results[i] = setFieldPath(results[i], e.Key, v)
+			}
+		}
+		out = append(out, results...)
+	}
+
+	return out, nil
+}
+
+// windowPartitions return the docs grouped by the value of partitionBy, sorted by that value
+func windowPartitions(partitionBy interface{}, docs []bson.D, vars map[string]interface{}) ([][]bson.D, error) {
+	if isMissing(partitionBy) {
+		return [][]bson.D{docs}, nil
+	}
+
+	keys := []interface{}{}
+	partitions := [][]bson.D{}
+	for _, doc := range docs {
+		key, err := evalExpression(partitionBy, newExprScope(doc, vars))
+		if err != nil {
+			return nil, err
+		}
+		if isMissing(key) {
+			key = nil
+		}
+
+		found := false
+		for i, k := range keys {
+			if valuesEqual(k, key) {
+				partitions[i] = append(partitions[i], doc)
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, key)
+			partitions = append(partitions, []bson.D{doc})
+		}
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareValues(keys[order[i]], keys[order[j]]) < 0
+	})
+	out := make([][]bson.D, len(order))
+	for i, k := range order {
+		out[i] = partitions[k]
+	}
+
+	return out, nil
+}
+
+// evalOutput return the value of the output field spec for every document of the partition
+func (w *windowPartition) evalOutput(spec bson.D) ([]interface{}, error) {
+	var op bson.E
+	var window interface{} = missing
+	for _, e := range spec {
+		switch {
+		case e.Key == "window":
+			window = e.Value
+		case strings.HasPrefix(e.Key, "$") && op.Key == "":
+			op = e
+		default:
+			return nil, fmt.Errorf("window function found an unknown argument: %s", e.Key)
+		}
+	}
+	if op.Key == "" {
+		return nil, fmt.Errorf("expected a window function")
+	}
+
+	switch op.Key {
+	case "$documentNumber", "$rank", "$denseRank":
+		if !isMissing(window) {
+			return nil, fmt.Errorf("%s does not accept a window", op.Key)
+		}
+		return w.ranks(op.Key)
+	case "$shift":
+		if !isMissing(window) {
+			return nil, fmt.Errorf("$shift does not accept a window")
+		}
+		return w.shift(op.Value)
+	case "$expMovingAvg":
+		if !isMissing(window) {
+			return nil, fmt.Errorf("$expMovingAvg does not accept a window")
+		}
+		return w.expMovingAvg(op.Value)
+	case "$derivative", "$integral":
+		return w.calculus(op.Key, op.Value, window)
+	}
+
+	return w.accumulate(op.Key, op.Value, window)
+}
+
+// sortField return the single field of sortBy required by the operator name
+func (w *windowPartition) sortField(name string) (string, error) {
+	if len(w.sortBy) != 1 {
+		return "", fmt.Errorf("%s must be specified with a top level sortBy expression with exactly one element", name)
+	}
+	return w.sortBy[0].Key, nil
+}
+
+// sortKeys return the values of the sort field of the documents
+func (w *windowPartition) sortKeys(name string) ([]interface{}, error) {
+	field, err := w.sortField(name)
+	if err != nil {
+		return nil, err
+	}
+	direction, _ := toInt64(w.sortBy[0].Value)
+
+	keys := make([]interface{}, len(w.docs))
+	for i, doc := range w.docs {
+		keys[i] = sortKey(doc, field, int(direction))
+	}
+	return keys, nil
+}
+
+// eachValue return the value of the expression for every document
+func (w *windowPartition) eachValue(expr interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(w.docs))
+	for i, doc := range w.docs {
+		v, err := evalExpression(expr, newExprScope(doc, w.vars))
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// ranks return the position of every document in the partition, with the ties ranked equally for $rank and $denseRank
+func (w *windowPartition) ranks(name string) ([]interface{}, error) {
+	out := make([]interface{}, len(w.docs))
+	if name == "$documentNumber" {
+		for i := range w.docs {
+			out[i] = int32(i + 1)
+		}
+		return out, nil
+	}
+
+	keys, err := w.sortKeys(name)
+	if err != nil {
+		return nil, err
+	}
+	rank, dense := 0, 0
+	for i := range w.docs {
+		if i == 0 || compareValues(keys[i], keys[i-1]) != 0 {
+			rank = i + 1
+			dense++
+		}
+		if name == "$rank" {
+			out[i] = int32(rank)
+		} else {
+			out[i] = int32(dense)
+		}
+	}
+
+	return out, nil
+}
+
+// shift return the value of the output of the document by positions after every document, or the default value
+func (w *windowPartition) shift(args interface{}) ([]interface{}, error) {
+	doc, err := namedArgs("$shift", args, []string{"output", "by"}, []string{"default"})
+	if err != nil {
+		return nil, err
+	}
+	if len(w.sortBy) == 0 {
+		return nil, fmt.Errorf("$shift requires a sortBy")
+	}
+	by, ok := toInt64(docGet(doc, "by"))
+	if !ok {
+		return nil, fmt.Errorf("'$shift:by' field must be an integer, but found %s", typeName(docGet(doc, "by")))
+	}
+	var defaultValue interface{}
+	if expr := docGet(doc, "default"); !isMissing(expr) {
+		if defaultValue, err = evalExpression(expr, newExprScope(nil, w.vars)); err != nil {
+			return nil, err
+		}
+	}
+
+	values, err := w.eachValue(docGet(doc, "output"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, len(w.docs))
+	for i := range w.docs {
+		j := i + int(by)
+		if j < 0 || j >= len(values) {
+			out[i] = defaultValue
+		} else if isMissing(values[j]) {
+			out[i] = nil
+		} else {
+			out[i] = values[j]
+		}
+	}
+
+	return out, nil
+}
+
+// expMovingAvg return the exponential moving average of the input, weighted by alpha or by 2/(N+1)
+func (w *windowPartition) expMovingAvg(args interface{}) ([]interface{}, error) {
+	doc, err := namedArgs("$expMovingAvg", args, []string{"input"}, []string{"N", "alpha"})
+	if err != nil {
+		return nil, err
+	}
+	if len(w.sortBy) == 0 {
+		return nil, fmt.Errorf("$expMovingAvg requires a sortBy")
+	}
+
+	var alpha float64
+	n, alpha1 := docGet(doc, "N"), docGet(doc, "alpha")
+	switch {
+	case !isMissing(n) && isMissing(alpha1):
+		count, ok := toInt64(n)
+		if !ok || count <= 0 {
+			return nil, fmt.Errorf("'N' field must be a positive integer")
+		}
+		alpha = 2 / float64(count+1)
+	case isMissing(n) && !isMissing(alpha1):
+		var ok bool
+		if alpha, ok = toFloat(alpha1); !ok || alpha <= 0 || alpha >= 1 {
+			return nil, fmt.Errorf("'alpha' must be a number between 0 and 1 (exclusive)")
+		}
+	default:
+		return nil, fmt.Errorf("$expMovingAvg requires exactly one of 'N' and 'alpha'")
+	}
+
+	values, err := w.eachValue(docGet(doc, "input"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, len(values))
+	var avg *float64
+	for i, v := range values {
+		f, ok := toFloat(v)
+		if !ok || !isNumber(v) {
+			out[i] = nil
+			continue
+		}
+		if avg == nil {
+			avg = &f
+		} else {
+			*avg = alpha*f + (1-alpha)**avg
+		}
+		out[i] = *avg
+	}
+
+	return out, nil
+}
+
+// calculus return the $derivative or the $integral of the input over the sort field in the window of every document.
+// The dates of the sort field are measured in unit, that is required for them
+func (w *windowPartition) calculus(name string, args interface{}, window interface{}) ([]interface{}, error) {
+	doc, err := namedArgs(name, args, []string{"input"}, []string{"unit"})
+	if err != nil {
+		return nil, err
+	}
+	if name == "$derivative" && isMissing(window) {
+		return nil, fmt.Errorf("$derivative requires explicit window bounds")
+	}
+	keys, err := w.sortKeys(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var unit time.Duration
+	if v := docGet(doc, "unit"); !isMissing(v) {
+		unitName, _ := v.(string)
+		var ok bool
+		if unit, ok = timeUnitDurations[unitName]; !ok {
+			return nil, fmt.Errorf("unknown time unit value: %s", unitName)
+		}
+	}
+	xs := make([]float64, len(keys))
+	for i, k := range keys {
+		switch x := k.(type) {
+		case primitive.DateTime:
+			if unit == 0 {
+				return nil, fmt.Errorf("%s where the sortBy is a Date requires a 'unit'", name)
+			}
+			xs[i] = float64(x) / float64(unit/time.Millisecond)
+		default:
+			var ok bool
+			if xs[i], ok = toFloat(x); !ok || !isNumber(x) {
+				return nil, fmt.Errorf("%s requires the sortBy to be a number or a date, but found %s", name, typeName(x))
+			}
+			if unit != 0 {
+				return nil, fmt.Errorf("%s with a 'unit' requires the sortBy to be a date", name)
+			}
+		}
+	}
+
+	values, err := w.eachValue(docGet(doc, "input"))
+	if err != nil {
+		return nil, err
+	}
+	ys := make([]float64, len(values))
+	for i, v := range values {
+		var ok bool
+		if ys[i], ok = toFloat(v); !ok || !isNumber(v) {
+			return nil, fmt.Errorf("%s requires the input to be a number, but found %s", name, typeName(v))
+		}
+	}
+
+	out := make([]interface{}, len(w.docs))
+	for i := range w.docs {
+		start, end, err := w.windowBounds(window, i)
+		if err != nil {
+			return nil, err
+		}
+		if name == "$derivative" {
+			if end-start < 2 {
+				out[i] = nil
+				continue
+			}
+			out[i] = (ys[end-1] - ys[start]) / (xs[end-1] - xs[start])
+			continue
+		}
+
+		sum := 0.0
+		for k := start; k+1 < end; k++ {
+			sum += (xs[k+1] - xs[k]) * (ys[k] + ys[k+1]) / 2
+		}
+		out[i] = sum
+	}
+
+	return out, nil
+}
+
+// accumulate return the accumulator name applied to the values of the expression in the window of every document
+func (w *windowPartition) accumulate(name string, expr interface{}, window interface{}) ([]interface{}, error) {
+	if name == "$count" {
+		name, expr = "$sum", int32(1)
+	}
+	if _, err := accumulate(name, nil); err != nil {
+		return nil, err
+	}
+	values, err := w.eachValue(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]interface{}, len(w.docs))
+	for i := range w.docs {
+		start, end, err := w.windowBounds(window, i)
+		if err != nil {
+			return nil, err
+		}
+		if out[i], err = accumulate(name, values[start:end]); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// windowBounds return the range of the documents of the partition that are in the window of the document i.
+// Without a window the range is the whole partition
+func (w *windowPartition) windowBounds(window interface{}, i int) (int, int, error) {
+	if isMissing(window) {
+		return 0, len(w.docs), nil
+	}
+	spec, ok := window.(bson.D)
+	if !ok {
+		return 0, 0, fmt.Errorf("'window' field must be an object")
+	}
+
+	if bounds := docGet(spec, "documents"); !isMissing(bounds) {
+		if !isMissing(docGet(spec, "range")) || !isMissing(docGet(spec, "unit")) {
+			return 0, 0, fmt.Errorf("'window' field can only specify 'documents' or 'range' with 'unit'")
+		}
+		lower, upper, err := windowBoundPair(bounds)
+		if err != nil {
+			return 0, 0, err
+		}
+		start, end := 0, len(w.docs)
+		if lower != "unbounded" {
+			n, ok := w.documentOffset(lower, i)
+			if !ok {
+				return 0, 0, fmt.Errorf("numeric document-based bounds must be an integer")
+			}
+			start = n
+		}
+		if upper != "unbounded" {
+			n, ok := w.documentOffset(upper, i)
+			if !ok {
+				return 0, 0, fmt.Errorf("numeric document-based bounds must be an integer")
+			}
+			end = n + 1
+		}
+		start, end = clampWindow(start, end, len(w.docs))
+		return start, end, nil
+	}
+
+	bounds := docGet(spec, "range")
+	if isMissing(bounds) {
+		return 0, 0, fmt.Errorf("'window' field must specify 'documents' or 'range'")
+	}
+	lower, upper, err := windowBoundPair(bounds)
+	if err != nil {
+		return 0, 0, err
+	}
+	unit, _ := docGet(spec, "unit").(string)
+	keys, err := w.sortKeys("range-based window")
+	if err != nil {
+		return 0, 0, err
+	}
+	lowerValue, err := rangeBound(keys[i], lower, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	upperValue, err := rangeBound(keys[i], upper, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start, end := -1, -1
+	for j, k := range keys {
+		if (lower == "unbounded" || compareValues(k, lowerValue) >= 0) && (upper == "unbounded" || compareValues(k, upperValue) <= 0) {
+			if start < 0 {
+				start = j
+			}
+			end = j + 1
+		}
+	}
+	if start < 0 {
+		return 0, 0, nil
+	}
+	return start, end, nil
+}
+
+// documentOffset return the position of the document-based bound relative to the document i
+func (w *windowPartition) documentOffset(bound interface{}, i int) (int, bool) {
+	if bound == "current" {
+		return i, true
+	}
+	n, ok := toInt64(bound)
+	return i + int(n), ok
+}
+
+// windowBoundPair return the lower and the upper bound of a window
+func windowBoundPair(bounds interface{}) (interface{}, interface{}, error) {
+	pair, ok := bounds.(bson.A)
+	if !ok || len(pair) != 2 {
+		return nil, nil, fmt.Errorf("window bounds must be a 2-element array")
+	}
+	for _, b := range pair {
+		if s, isString := b.(string); isString && s != "unbounded" && s != "current" {
+			return nil, nil, fmt.Errorf("window bounds must be 'unbounded', 'current' or a number, found '%s'", s)
+		}
+	}
+	return pair[0], pair[1], nil
+}
+
+// rangeBound return the value of the range-based bound relative to the sort key of the current document
+func rangeBound(key interface{}, bound interface{}, unit string) (interface{}, error) {
+	switch bound {
+	case "unbounded":
+		return nil, nil
+	case "current":
+		return key, nil
+	}
+
+	if unit == "" {
+		if !isNumber(key) {
+			return nil, fmt.Errorf("range-based window requires the sortBy to be a number, found %s", typeName(key))
+		}
+		return addNumbers(key, bound), nil
+	}
+	date, ok := key.(primitive.DateTime)
+	if !ok {
+		return nil, fmt.Errorf("range-based window with a 'unit' requires the sortBy to be a date, found %s", typeName(key))
+	}
+	n, ok := toInt64(bound)
+	if !ok {
+		return nil, fmt.Errorf("time-based bounds must be an integer")
+	}
+	t, err := addDateUnits(date.Time().UTC(), unit, n)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.NewDateTimeFromTime(t), nil
+}
+
+// clampWindow return the range start:end limited to the documents of a partition of size n
+func clampWindow(start int, end int, n int) (int, int) {
+	if start < 0 {
+		start = 0
+	}
+	if end > n {
+		end = n
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// shellInlineWidth is the maximum length of a document or array printed on a single line by FormatShell
+const shellInlineWidth = 72
+
+// shellIdentifier match the keys that can be printed without quotes
+var shellIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// FormatShell return the pipeline as text in the mongosh syntax, with ISODate, ObjectId, NumberLong and /regex/ literals,
+// that can be pasted in mongosh or Compass and parsed back with ParsePipeline. The keys of the maps, like the bson.M
+// produced by the builders, are sorted so the text doesn't change from run to run
+func FormatShell(pipeline bson.A) (string, error) {
+	normalized, err := normalizePipeline(pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	return formatShellValue(normalized, ""), nil
+}
+
+// FormatExtJSON return the pipeline as indented Extended JSON, in the canonical or in the relaxed format.
+// The relaxed format is more readable but it doesn't preserve the type of the numbers. The keys of the maps are sorted like in FormatShell
+func FormatExtJSON(pipeline bson.A, canonical bool) (string, error) {
+	normalized, err := normalizePipeline(pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	stages := []string{}
+	for _, stage := range normalized {
+		text, err := bson.MarshalExtJSON(stage, canonical, false)
+		if err != nil {
+			return "", err
+		}
+		stages = append(stages, string(text))
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte("["+strings.Join(stages, ",")+"]"), "", "  "); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// formatShellValue return the normalized value v in the mongosh syntax, indenting the nested lines with indent
+func formatShellValue(v interface{}, indent string) string {
+	switch val := v.(type) {
+	case bson.D:
+		if len(val) == 0 {
+			return "{}"
+		}
+		items := make([]string, 0, len(val))
+		for _, e := range val {
+			items = append(items, formatShellKey(e.Key)+": "+formatShellValue(e.Value, indent+"  "))
+		}
+		return formatShellContainer("{ ", " }", "{", "}", items, indent)
+	case bson.A:
+		if len(val) == 0 {
+			return "[]"
+		}
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			items = append(items, formatShellValue(item, indent+"  "))
+		}
+		return formatShellContainer("[ ", " ]", "[", "]", items, indent)
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(val)
+	case string:
+		return formatShellString(val)
+	case int32:
+		return strconv.FormatInt(int64(val), 10)
+	case int64:
+		return "NumberLong('" + strconv.FormatInt(val, 10) + "')"
+	case float64:
+		s := formatDouble(val)
+		if !strings.ContainsAny(s, ".eEIN") {
+			s += ".0"
+		}
+		return s
+	case primitive.Decimal128:
+		return "NumberDecimal('" + val.String() + "')"
+	case primitive.DateTime:
+		return "ISODate('" + formatDate(val) + "')"
+	case primitive.ObjectID:
+		return "ObjectId('" + val.Hex() + "')"
+	case primitive.Regex:
+		return formatShellRegex(val)
+	case primitive.Binary:
+		return fmt.Sprintf("BinData(%d, '%s')", val.Subtype, base64.StdEncoding.EncodeToString(val.Data))
+	case primitive.Timestamp:
+		return fmt.Sprintf("Timestamp({ t: %d, i: %d })", val.T, val.I)
+	case primitive.MinKey:
+		return "MinKey()"
+	case primitive.MaxKey:
+		return "MaxKey()"
+	case primitive.Undefined:
+		return "undefined"
+	case primitive.Symbol:
+		return formatShellString(string(val))
+	case primitive.JavaScript:
+		return "Code(" + formatShellString(string(val)) + ")"
+	}
+
+	return formatShellString(fmt.Sprint(v))
+}
+
+// formatShellRegex return the /pattern/flags literal of the regex, escaping the slashes that aren't already escaped.
+// The empty pattern is written as (?:) because // would be a comment
+func formatShellRegex(val primitive.Regex) string {
+	if val.Pattern == "" {
+		return "/(?:)/" + val.Options
+	}
+	var sb strings.Builder
+	sb.WriteByte('/')
+	for i := 0; i < len(val.Pattern); i++ {
+		switch c := val.Pattern[i]; {
+		case c == '\\' && i+1 < len(val.Pattern):
+			sb.WriteByte(c)
+			i++
+			sb.WriteByte(val.Pattern[i])
+		case c == '/':
+			sb.WriteString(`\/`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('/')
+	sb.WriteString(val.Options)
+	return sb.String()
+}
+
+// formatShellContainer return the items joined on a single line if they are short enough, otherwise on indented lines
+func formatShellContainer(inlineOpen string, inlineClose string, open string, close string, items []string, indent string) string {
+	inline := inlineOpen + strings.Join(items, ", ") + inlineClose
+	if len(indent)+len(inline) <= shellInlineWidth && !strings.Contains(inline, "\n") {
+		return inline
+	}
+
+	return open + "\n" + indent + "  " + strings.Join(items, ",\n"+indent+"  ") + "\n" + indent + close
+}
+
+// formatShellKey return the key of a document, quoted only if needed
+func formatShellKey(key string) string {
+	if shellIdentifier.MatchString(key) {
+		return key
+	}
+	return formatShellString(key)
+}
+
+// formatShellString return s as a single quoted javascript string
+func formatShellString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'':
+			sb.WriteString(`\'`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&sb, `\u%04x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
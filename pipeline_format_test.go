@@ -0,0 +1,153 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testFormatPipelines contains the pipelines used to test the format and the parse round-trips,
+// with the pipeline expected from the shell round-trip when the shell text normalizes it
+var testFormatPipelines = []struct {
+	name     string
+	pipeline bson.A
+	parsed   bson.A
+}{
+	{"empty", MAPipeline(), nil},
+	{"paging", MAPipeline(
+		APMatch(bson.M{"os": "linux", "cpu": bson.M{"$gte": int64(4)}}),
+		APOptionalSortingStage("name", true),
+		APOptionalPagingStage(2, 10),
+	), nil},
+	{"search", MAPipeline(APSearchFilterStage([]interface{}{"$hostname", "$info.os"}, []string{"web", "it's"})), nil},
+	{"typed values", bson.A{bson.M{"$match": bson.M{
+		"date":    primitive.NewDateTimeFromTime(time.Date(2019, 11, 5, 10, 0, 0, 0, time.UTC)),
+		"id":      primitive.ObjectID{0x5d, 0xc1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		"name":    primitive.Regex{Pattern: "^web/[0-9]+$", Options: "i"},
+		"int":     int32(1),
+		"long":    int64(1),
+		"double":  1.0,
+		"decimal": primitive.NewDecimal128(0, 15),
+		"binary":  primitive.Binary{Subtype: 0, Data: []byte("abc")},
+		"ts":      primitive.Timestamp{T: 1, I: 2},
+		"nan":     math.NaN(),
+		"inf":     math.Inf(-1),
+		"quoted":  "a'b\\c\nd",
+		"key-1":   nil,
+		"bool":    true,
+	}}}, nil},
+	{"empty regex", MAPipeline(APMatch(bson.M{"name": primitive.Regex{Pattern: "", Options: "i"}})), nil},
+	{"escaped slashes", MAPipeline(APMatch(bson.M{
+		"path":    primitive.Regex{Pattern: `^a\/b/c$`},
+		"class":   primitive.Regex{Pattern: `[/\]]`},
+		"escaped": primitive.Regex{Pattern: `a\\/b`},
+	})), MAPipeline(APMatch(bson.M{
+		"path":    primitive.Regex{Pattern: `^a/b/c$`},
+		"class":   primitive.Regex{Pattern: `[/\]]`},
+		"escaped": primitive.Regex{Pattern: `a\\/b`},
+	}))},
+}
+
+func TestFormatParseRoundTrip(t *testing.T) {
+	for _, tt := range testFormatPipelines {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := FormatExtJSON(tt.pipeline, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantParsed := want
+			if tt.parsed != nil {
+				wantParsed, _ = FormatExtJSON(tt.parsed, true)
+			}
+
+			shell, err := FormatShell(tt.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParsePipeline(shell)
+			if err != nil {
+				t.Fatalf("can't parse the shell text %s: %v", shell, err)
+			}
+			if got, _ := FormatExtJSON(parsed, true); got != wantParsed {
+				t.Errorf("shell round-trip: got %s, want %s", got, wantParsed)
+			}
+
+			for _, canonical := range []bool{true, false} {
+				text, err := FormatExtJSON(tt.pipeline, canonical)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := ParsePipeline(text)
+				if err != nil {
+					t.Fatalf("can't parse the Extended JSON %s: %v", text, err)
+				}
+				got, _ := FormatExtJSON(parsed, canonical)
+				if !canonical {
+					want, _ = FormatExtJSON(tt.pipeline, false)
+				}
+				if got != want {
+					t.Errorf("Extended JSON round-trip (canonical %v): got %s, want %s", canonical, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatShell(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline bson.A
+		want     string
+	}{
+		{"nil", nil, `[]`},
+		{"sorted keys", MAPipeline(APMatch(bson.M{"os": "linux", "cpu": 4, "arch": "x86"})),
+			`[ { $match: { arch: 'x86', cpu: 4, os: 'linux' } } ]`},
+		{"typed values", MAPipeline(APMatch(bson.M{
+			"n": int64(5),
+			"d": primitive.NewDateTimeFromTime(time.Date(2019, 11, 5, 0, 0, 0, 0, time.UTC)),
+			"r": primitive.Regex{Pattern: "a/b", Options: "i"},
+		})), `[
+  {
+    $match: {
+      d: ISODate('2019-11-05T00:00:00.000Z'),
+      n: NumberLong('5'),
+      r: /a\/b/i
+    }
+  }
+]`},
+		{"quoted keys and strings", MAPipeline(APSet(bson.M{"a.b": "it's"})), `[ { $set: { 'a.b': 'it\'s' } } ]`},
+		{"empty regex", MAPipeline(APMatch(bson.M{"r": primitive.Regex{Options: "i"}})), `[ { $match: { r: /(?:)/i } } ]`},
+		{"escaped slash", MAPipeline(APMatch(bson.M{"r": primitive.Regex{Pattern: `a\/b/c`}})), `[ { $match: { r: /a\/b\/c/ } } ]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				got, err := FormatShell(tt.pipeline)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Fatalf("got %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
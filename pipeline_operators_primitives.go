@@ -37,6 +37,13 @@ func APOSubtract(a interface{}, b interface{}) interface{} {
 	}
 }
 
+// APOMultiply return a expression that multiply the things
+func APOMultiply(things ...interface{}) interface{} {
+	return bson.M{
+		"$multiply": things,
+	}
+}
+
 // APODivide return a expression that divide a by b
 func APODivide(a interface{}, b interface{}) interface{} {
 	return bson.M{
@@ -81,6 +88,11 @@ func APOOr(conds ...interface{}) interface{} {
 	}
 }
 
+// APONot return a expression that return true if cond is false
+func APONot(cond interface{}) interface{} {
+	return bson.M{"$not": bson.A{cond}}
+}
+
 // APOEqual return a expression that return true if a and b are equal, otherwise false
 func APOEqual(a interface{}, b interface{}) interface{} {
 	return bson.M{"$eq": bson.A{a, b}}
@@ -138,6 +150,16 @@ func APOFilter(input interface{}, as string, cond interface{}) interface{} {
 	}}
 }
 
+// APOSlice return a expression that return n elements of the array input starting from position
+func APOSlice(input interface{}, position interface{}, n interface{}) interface{} {
+	return bson.M{"$slice": bson.A{input, position, n}}
+}
+
+// APOConcatArrays return a expression that return the concatenation of the arrays
+func APOConcatArrays(arrays ...interface{}) interface{} {
+	return bson.M{"$concatArrays": arrays}
+}
+
 // APOReduce return a expression that reduce the input array into a value
 func APOReduce(input interface{}, initialValue interface{}, in interface{}) interface{} {
 	return bson.M{"$reduce": bson.M{
@@ -258,6 +280,11 @@ func APOMaxAggr(what interface{}) interface{} {
 	return bson.M{"$max": what}
 }
 
+// APOAvg return a averaging expression of whats
+func APOAvg(what interface{}) interface{} {
+	return bson.M{"$avg": what}
+}
+
 // APOPush return a pushing expression of whats
 func APOPush(what interface{}) interface{} {
 	return bson.M{"$push": what}
@@ -299,3 +326,141 @@ func APOSubstrCP(what interface{}, start interface{}, len interface{}) interface
 		len,
 	}}
 }
+
+// APOMeta return a expression that return the metadata keyword of the document, like textScore, searchScore or searchHighlights
+func APOMeta(keyword string) interface{} {
+	return bson.M{"$meta": keyword}
+}
+
+// APODateTrunc return a expression that truncate the date to the start of the unit (like day or month) in the timezone,
+// that is UTC if empty
+func APODateTrunc(date interface{}, unit string, timezone string) interface{} {
+	trunc := bson.M{
+		"date": date,
+		"unit": unit,
+	}
+	if timezone != "" {
+		trunc["timezone"] = timezone
+	}
+	return bson.M{"$dateTrunc": trunc}
+}
+
+// APODateTruncEmulated return a expression like APODateTrunc, with the weeks starting on monday, that works also with
+// the servers older than MongoDB 5.0 because it rebuild the date from its parts with $dateToParts and $dateFromParts
+func APODateTruncEmulated(date interface{}, unit DateUnit, timezone string) interface{} {
+	toParts := bson.M{
+		"date": date,
+	}
+	fromParts := bson.M{}
+	if timezone != "" {
+		toParts["timezone"] = timezone
+		fromParts["timezone"] = timezone
+	}
+	if unit == DateUnitWeek {
+		toParts["iso8601"] = true
+	}
+	for _, part := range dateUnitParts[unit] {
+		fromParts[part] = "$$parts." + part
+	}
+
+	return APOLet(bson.M{"parts": bson.M{"$dateToParts": toParts}}, bson.M{"$dateFromParts": fromParts})
+}
+
+// APODateToString return a expression that format the date with the format in the timezone, that is UTC if empty
+func APODateToString(date interface{}, format string, timezone string) interface{} {
+	toString := bson.M{
+		"date":   date,
+		"format": format,
+	}
+	if timezone != "" {
+		toString["timezone"] = timezone
+	}
+	return bson.M{"$dateToString": toString}
+}
+
+// APORank return a window function that return the position of the document sorted by the sortBy field,
+// with the ties ranked equally leaving gaps
+func APORank() interface{} {
+	return bson.M{"$rank": bson.M{}}
+}
+
+// APODenseRank return a window function that return the position of the document sorted by the sortBy field,
+// with the ties ranked equally without gaps
+func APODenseRank() interface{} {
+	return bson.M{"$denseRank": bson.M{}}
+}
+
+// APODocumentNumber return a window function that return the position of the document in the partition
+func APODocumentNumber() interface{} {
+	return bson.M{"$documentNumber": bson.M{}}
+}
+
+// APOShift return a window function that return the output of the document by positions after the current one,
+// or the defaultValue if it doesn't exist
+func APOShift(output interface{}, by int, defaultValue interface{}) interface{} {
+	shift := bson.M{
+		"output": output,
+		"by":     by,
+	}
+	if defaultValue != nil {
+		shift["default"] = defaultValue
+	}
+	return bson.M{"$shift": shift}
+}
+
+// APODerivative return a window function that return the rate of change of input over the sortBy field in the window.
+// The unit, like hour, is required if the sortBy field is a date, otherwise it's omitted if empty
+func APODerivative(input interface{}, unit string) interface{} {
+	derivative := bson.M{
+		"input": input,
+	}
+	if unit != "" {
+		derivative["unit"] = unit
+	}
+	return bson.M{"$derivative": derivative}
+}
+
+// APOIntegral return a window function that return the area under input over the sortBy field in the window.
+// The unit, like hour, is required if the sortBy field is a date, otherwise it's omitted if empty
+func APOIntegral(input interface{}, unit string) interface{} {
+	integral := bson.M{
+		"input": input,
+	}
+	if unit != "" {
+		integral["unit"] = unit
+	}
+	return bson.M{"$integral": integral}
+}
+
+// APOExpMovingAvg return a window function that return the exponential moving average of input
+// weighted over the last n documents
+func APOExpMovingAvg(input interface{}, n int) interface{} {
+	return bson.M{"$expMovingAvg": bson.M{
+		"input": input,
+		"N":     n,
+	}}
+}
+
+// APOExpMovingAvgAlpha return a window function that return the exponential moving average of input
+// with the weight alpha of the current document
+func APOExpMovingAvgAlpha(input interface{}, alpha float64) interface{} {
+	return bson.M{"$expMovingAvg": bson.M{
+		"input": input,
+		"alpha": alpha,
+	}}
+}
+
+// APOObjectToArray return a expression that convert the document what to an array of {k, v} documents
+func APOObjectToArray(what interface{}) interface{} {
+	return bson.M{"$objectToArray": what}
+}
+
+// APOArrayToObject return a expression that convert the array of {k, v} documents or [k, v] pairs what to a document
+func APOArrayToObject(what interface{}) interface{} {
+	return bson.M{"$arrayToObject": what}
+}
+
+// APOIn return a expression that is true if the array contains the value
+func APOIn(value interface{}, array interface{}) interface{} {
+	return bson.M{"$in": bson.A{value, array}}
+}
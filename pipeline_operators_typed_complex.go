@@ -0,0 +1,48 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+// EConvertToDoubleOrZero return a expression that convert what to double if it's valid or return zero if invalid or null
+func EConvertToDoubleOrZero(what Expr) Expr {
+	return rawExpr(APOConvertToDoubleOrZero(what.Bson()))
+}
+
+// EJoin return a expression that join the list into a string
+func EJoin(list Expr, sep Expr) Expr {
+	return rawExpr(APOJoin(list.Bson(), sep.Bson()))
+}
+
+// EMaxWithCmpExpr return a expression that return the maximium between a and b using the cmpExpressions
+func EMaxWithCmpExpr(cmpExprA Expr, cmpExprB Expr, a Expr, b Expr) Expr {
+	return rawExpr(APOMaxWithCmpExpr(cmpExprA.Bson(), cmpExprB.Bson(), a.Bson(), b.Bson()))
+}
+
+// EAny return a expression that return true if any element in input satisfy the cond
+// (in the cond the variable itemName can be used to refer to the current item of the array)
+func EAny(input Expr, itemName string, cond Expr) Expr {
+	return rawExpr(APOAny(input.Bson(), itemName, cond.Bson()))
+}
+
+// EGetCaptureFromRegexMatch return a capture group from a regex match of given input and regex
+func EGetCaptureFromRegexMatch(input Expr, regex string, options string, captureIndex int) Expr {
+	return rawExpr(APOGetCaptureFromRegexMatch(input.Bson(), regex, options, captureIndex))
+}
+
+// ESumReducer return a expression that return the sum of every expr applied to each argument of input
+// This contains the current item
+func ESumReducer(input Expr, expr Expr) Expr {
+	return rawExpr(APOSumReducer(input.Bson(), expr.Bson()))
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+// The E* functions are the typed counterparts of the APO* functions and return the same bson
+
+// EAdd return a expression that sum the things
+func EAdd(things ...Expr) Expr {
+	return rawExpr(APOAdd(exprsToBson(things)...))
+}
+
+// ESubtract return a expression that subtract a-b
+func ESubtract(a Expr, b Expr) Expr {
+	return rawExpr(APOSubtract(a.Bson(), b.Bson()))
+}
+
+// EMultiply return a expression that multiply the things
+func EMultiply(things ...Expr) Expr {
+	return rawExpr(APOMultiply(exprsToBson(things)...))
+}
+
+// EDivide return a expression that divide a by b
+func EDivide(a Expr, b Expr) Expr {
+	return rawExpr(APODivide(a.Bson(), b.Bson()))
+}
+
+// EFloor return a expression that return floor(what)
+func EFloor(what Expr) Expr {
+	return rawExpr(APOFloor(what.Bson()))
+}
+
+// ECeil return a expression that return ceil(what)
+func ECeil(what Expr) Expr {
+	return rawExpr(APOCeil(what.Bson()))
+}
+
+// EMin return a expression that return the min of what
+func EMin(what ...Expr) Expr {
+	return rawExpr(APOMin(exprsToBson(what)...))
+}
+
+// EMax return a expression that return the max of what
+func EMax(what ...Expr) Expr {
+	return rawExpr(APOMax(exprsToBson(what)...))
+}
+
+// EAnd return a expression that return true if all conds are true
+func EAnd(conds ...Expr) Expr {
+	return rawExpr(APOAnd(exprsToBson(conds)...))
+}
+
+// EOr return a expression that return true if any conds are true
+func EOr(conds ...Expr) Expr {
+	return rawExpr(APOOr(exprsToBson(conds)...))
+}
+
+// ENot return a expression that return true if cond is false
+func ENot(cond Expr) Expr {
+	return rawExpr(APONot(cond.Bson()))
+}
+
+// EEqual return a expression that return true if a and b are equal, otherwise false
+func EEqual(a Expr, b Expr) Expr {
+	return rawExpr(APOEqual(a.Bson(), b.Bson()))
+}
+
+// ENotEqual return a expression that return true if a and b are inequal, otherwise false
+func ENotEqual(a Expr, b Expr) Expr {
+	return rawExpr(APONotEqual(a.Bson(), b.Bson()))
+}
+
+// EGreater return a expression that return true if a is greater than b
+func EGreater(a Expr, b Expr) Expr {
+	return rawExpr(APOGreater(a.Bson(), b.Bson()))
+}
+
+// EGreaterOrEqual return a expression that return true if a is greater or equal than b
+func EGreaterOrEqual(a Expr, b Expr) Expr {
+	return rawExpr(APOGreaterOrEqual(a.Bson(), b.Bson()))
+}
+
+// ERegexFind return a expression that return a regex match
+func ERegexFind(input Expr, regex string, options string) Expr {
+	return rawExpr(APORegexFind(input.Bson(), regex, options))
+}
+
+// EConcat return a expression that return the concatenation of what
+func EConcat(what ...Expr) Expr {
+	return rawExpr(APOConcat(exprsToBson(what)...))
+}
+
+// ESetUnion return a expression that return a set that contains every elements in what
+func ESetUnion(what ...Expr) Expr {
+	return rawExpr(APOSetUnion(exprsToBson(what)...))
+}
+
+// EMap return a expression that return a array of mapped value from input to in
+func EMap(input Expr, as string, in Expr) Expr {
+	return rawExpr(APOMap(input.Bson(), as, in.Bson()))
+}
+
+// EFilter return a expression that return a filtered array of values by cond from input
+func EFilter(input Expr, as string, cond Expr) Expr {
+	return rawExpr(APOFilter(input.Bson(), as, cond.Bson()))
+}
+
+// ESlice return a expression that return n elements of the array input starting from position
+func ESlice(input Expr, position Expr, n Expr) Expr {
+	return rawExpr(APOSlice(input.Bson(), position.Bson(), n.Bson()))
+}
+
+// EConcatArrays return a expression that return the concatenation of the arrays
+func EConcatArrays(arrays ...Expr) Expr {
+	return rawExpr(APOConcatArrays(exprsToBson(arrays)...))
+}
+
+// EReduce return a expression that reduce the input array into a value
+func EReduce(input Expr, initialValue Expr, in Expr) Expr {
+	return rawExpr(APOReduce(input.Bson(), initialValue.Bson(), in.Bson()))
+}
+
+// ESize return a expression that return the size of input
+func ESize(input Expr) Expr {
+	return rawExpr(APOSize(input.Bson()))
+}
+
+// EArrayElemAt return a expression that return the element from the array input with the index index
+func EArrayElemAt(input Expr, index Expr) Expr {
+	return rawExpr(APOArrayElemAt(input.Bson(), index.Bson()))
+}
+
+// EMergeObjects return a expression that return a merge of what
+func EMergeObjects(what ...Expr) Expr {
+	return rawExpr(APOMergeObjects(exprsToBson(what)...))
+}
+
+// EIfNull return a expression that return what if not null, otherwise altValue
+func EIfNull(what Expr, altValue Expr) Expr {
+	return rawExpr(APOIfNull(what.Bson(), altValue.Bson()))
+}
+
+// ECond return a expression that return ifTrue if cond is true, otherwise ifFalse
+func ECond(cond Expr, ifTrue Expr, ifFalse Expr) Expr {
+	return rawExpr(APOCond(cond.Bson(), ifTrue.Bson(), ifFalse.Bson()))
+}
+
+// ELet return a expression that calculate the vars and use it in the in expression
+func ELet(vars Vars, in Expr) Expr {
+	return rawExpr(APOLet(vars.Bson(), in.Bson()))
+}
+
+// EDateFromString return a expression that parse the what into a date
+func EDateFromString(what Expr, format string) Expr {
+	return rawExpr(APODateFromString(what.Bson(), format))
+}
+
+// EDateFromNullableString return a expression that parse the what into a date
+func EDateFromNullableString(what Expr, format string, onNull Expr) Expr {
+	return rawExpr(APODateFromNullableString(what.Bson(), format, onNull.Bson()))
+}
+
+// EConvert return a expression that convert input to to
+func EConvert(input Expr, to string) Expr {
+	return rawExpr(APOConvert(input.Bson(), to))
+}
+
+// EConvertErrorable return a expression that convert input to to
+func EConvertErrorable(input Expr, to string, onError Expr) Expr {
+	return rawExpr(APOConvertErrorable(input.Bson(), to, onError.Bson()))
+}
+
+// EConvertNullable return a expression that convert input to to
+func EConvertNullable(input Expr, to string, onNull Expr) Expr {
+	return rawExpr(APOConvertNullable(input.Bson(), to, onNull.Bson()))
+}
+
+// EConvertErrorableNullable return a expression that convert input to to
+func EConvertErrorableNullable(input Expr, to string, onError Expr, onNull Expr) Expr {
+	return rawExpr(APOConvertErrorableNullable(input.Bson(), to, onError.Bson(), onNull.Bson()))
+}
+
+// EToDouble return a expression that convert input to double
+func EToDouble(input Expr) Expr {
+	return rawExpr(APOToDouble(input.Bson()))
+}
+
+// ESum return a expression that sum the whats
+func ESum(what Expr) Expr {
+	return rawExpr(APOSum(what.Bson()))
+}
+
+// EMaxAggr return a expression that maximize the whats
+func EMaxAggr(what Expr) Expr {
+	return rawExpr(APOMaxAggr(what.Bson()))
+}
+
+// EAvg return a expression that average the whats
+func EAvg(what Expr) Expr {
+	return rawExpr(APOAvg(what.Bson()))
+}
+
+// EPush return a expression that push the whats
+func EPush(what Expr) Expr {
+	return rawExpr(APOPush(what.Bson()))
+}
+
+// ESplit return a expression that split the string what using sep as separator
+func ESplit(what Expr, sep Expr) Expr {
+	return rawExpr(APOSplit(what.Bson(), sep.Bson()))
+}
+
+// EIndexOfCp return a expression that return the index of subString in the string what
+func EIndexOfCp(what Expr, subString Expr) Expr {
+	return rawExpr(APOIndexOfCp(what.Bson(), subString.Bson()))
+}
+
+// ETrim return a expression that trim the string what
+func ETrim(what Expr) Expr {
+	return rawExpr(APOTrim(what.Bson()))
+}
+
+// EStrLenCP return a expression that return the length of the string what
+func EStrLenCP(what Expr) Expr {
+	return rawExpr(APOStrLenCP(what.Bson()))
+}
+
+// ESubstrCP return a expression that return the substring of the string what
+func ESubstrCP(what Expr, start Expr, len Expr) Expr {
+	return rawExpr(APOSubstrCP(what.Bson(), start.Bson(), len.Bson()))
+}
+
+// EMeta return a expression that return the metadata keyword of the document, like textScore, searchScore or searchHighlights
+func EMeta(keyword string) Expr {
+	return rawExpr(APOMeta(keyword))
+}
+
+// EDateTrunc return a expression that truncate the date to the start of the unit (like day or month) in the timezone,
+// that is UTC if empty
+func EDateTrunc(date Expr, unit string, timezone string) Expr {
+	return rawExpr(APODateTrunc(date.Bson(), unit, timezone))
+}
+
+// EDateTruncEmulated return a expression like EDateTrunc, with the weeks starting on monday, that works also with
+// the servers older than MongoDB 5.0
+func EDateTruncEmulated(date Expr, unit DateUnit, timezone string) Expr {
+	return rawExpr(APODateTruncEmulated(date.Bson(), unit, timezone))
+}
+
+// EDateToString return a expression that format the date with the format in the timezone, that is UTC if empty
+func EDateToString(date Expr, format string, timezone string) Expr {
+	return rawExpr(APODateToString(date.Bson(), format, timezone))
+}
+
+// ERank return a window function that return the position of the document sorted by the sortBy field,
+// with the ties ranked equally leaving gaps
+func ERank() Expr {
+	return rawExpr(APORank())
+}
+
+// EDenseRank return a window function that return the position of the document sorted by the sortBy field,
+// with the ties ranked equally without gaps
+func EDenseRank() Expr {
+	return rawExpr(APODenseRank())
+}
+
+// EDocumentNumber return a window function that return the position of the document in the partition
+func EDocumentNumber() Expr {
+	return rawExpr(APODocumentNumber())
+}
+
+// EShift return a window function that return the output of the document by positions after the current one,
+// or the defaultValue if it doesn't exist. defaultValue is omitted if nil
+func EShift(output Expr, by int, defaultValue Expr) Expr {
+	if defaultValue == nil {
+		return rawExpr(APOShift(output.Bson(), by, nil))
+	}
+	return rawExpr(APOShift(output.Bson(), by, defaultValue.Bson()))
+}
+
+// EDerivative return a window function that return the rate of change of input over the sortBy field in the window.
+// The unit, like hour, is required if the sortBy field is a date, otherwise it's omitted if empty
+func EDerivative(input Expr, unit string) Expr {
+	return rawExpr(APODerivative(input.Bson(), unit))
+}
+
+// EIntegral return a window function that return the area under input over the sortBy field in the window.
+// The unit, like hour, is required if the sortBy field is a date, otherwise it's omitted if empty
+func EIntegral(input Expr, unit string) Expr {
+	return rawExpr(APOIntegral(input.Bson(), unit))
+}
+
+// EExpMovingAvg return a window function that return the exponential moving average of input
+// weighted over the last n documents
+func EExpMovingAvg(input Expr, n int) Expr {
+	return rawExpr(APOExpMovingAvg(input.Bson(), n))
+}
+
+// EExpMovingAvgAlpha return a window function that return the exponential moving average of input
+// with the weight alpha of the current document
+func EExpMovingAvgAlpha(input Expr, alpha float64) Expr {
+	return rawExpr(APOExpMovingAvgAlpha(input.Bson(), alpha))
+}
+
+// EObjectToArray return a expression that convert the document what to an array of {k, v} documents
+func EObjectToArray(what Expr) Expr {
+	return rawExpr(APOObjectToArray(what.Bson()))
+}
+
+// EArrayToObject return a expression that convert the array of {k, v} documents or [k, v] pairs what to a document
+func EArrayToObject(what Expr) Expr {
+	return rawExpr(APOArrayToObject(what.Bson()))
+}
+
+// EIn return a expression that is true if the array contains the value
+func EIn(value Expr, array Expr) Expr {
+	return rawExpr(APOIn(value.Bson(), array.Bson()))
+}
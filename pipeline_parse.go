@@ -0,0 +1,650 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ParsePipeline return the pipeline written in the mongosh syntax, like the output of FormatShell,
+// or in canonical or relaxed Extended JSON. A single stage is returned as a pipeline with one stage
+func ParsePipeline(text string) (bson.A, error) {
+	p := &shellParser{src: text}
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected trailing text")
+	}
+
+	switch val := v.(type) {
+	case bson.A:
+		return val, nil
+	case bson.D:
+		return bson.A{val}, nil
+	}
+	return nil, fmt.Errorf("a pipeline must be an array of stages, found %s", typeName(v))
+}
+
+// shellParser is a recursive descent parser of javascript-like values
+type shellParser struct {
+	src string
+	pos int
+}
+
+// errorf return a error with the current position in the text
+func (p *shellParser) errorf(format string, args ...interface{}) error {
+	line, col := 1, 1
+	for _, r := range p.src[:p.pos] {
+		if r == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("line %d, column %d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+// skipSpaces skip the whitespaces and the comments
+func (p *shellParser) skipSpaces() {
+	for p.pos < len(p.src) {
+		switch {
+		case unicode.IsSpace(rune(p.src[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			if end := strings.IndexByte(p.src[p.pos:], '\n'); end >= 0 {
+				p.pos += end
+			} else {
+				p.pos = len(p.src)
+			}
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			if end := strings.Index(p.src[p.pos+2:], "*/"); end >= 0 {
+				p.pos += end + 4
+			} else {
+				p.pos = len(p.src)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// peek return the next significant byte, or 0 at the end of the text
+func (p *shellParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// expect consume the byte c or return a error
+func (p *shellParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected '%c'", c)
+	}
+	p.pos++
+	return nil
+}
+
+// parseValue parse any value
+func (p *shellParser) parseValue() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == 0:
+		return nil, p.errorf("unexpected end of text")
+	case c == '{':
+		return p.parseDocument()
+	case c == '[':
+		return p.parseArray()
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '/':
+		return p.parseRegex()
+	case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+		return p.parseIdentifierValue()
+	default:
+		return nil, p.errorf("unexpected character '%c'", c)
+	}
+}
+
+// parseDocument parse a document, converting the Extended JSON wrappers like {$oid: ...} to the corresponding values
+func (p *shellParser) parseDocument() (interface{}, error) {
+	start := p.pos
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+
+	doc := bson.D{}
+	for p.peek() != '}' {
+		var key string
+		if c := p.peek(); c == '"' || c == '\'' {
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			key = s.(string)
+		} else {
+			key = p.parseIdentifier()
+			if key == "" {
+				return nil, p.errorf("expected a field name")
+			}
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.E{Key: key, Value: v})
+
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect('}'); err != nil {
+		return nil, err
+	}
+
+	v, isWrapper, err := decodeExtJSONWrapper(doc)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("%v", err)
+	}
+	if isWrapper {
+		return v, nil
+	}
+	return doc, nil
+}
+
+// parseArray parse a array
+func (p *shellParser) parseArray() (interface{}, error) {
+	if err := p.expect('['); err != nil {
+		return nil, err
+	}
+
+	arr := bson.A{}
+	for p.peek() != ']' {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(']'); err != nil {
+		return nil, err
+	}
+
+	return arr, nil
+}
+
+// parseString parse a single or double quoted string
+func (p *shellParser) parseString() (interface{}, error) {
+	quote := p.peek()
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return sb.String(), nil
+		case c == '\\':
+			if p.pos+1 >= len(p.src) {
+				return nil, p.errorf("unterminated string")
+			}
+			p.pos++
+			switch esc := p.src[p.pos]; esc {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				if p.pos+5 > len(p.src) {
+					return nil, p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.src[p.pos+1:p.pos+5], 16, 32)
+				if err != nil {
+					return nil, p.errorf("invalid unicode escape")
+				}
+				sb.WriteRune(rune(code))
+				p.pos += 4
+			default:
+				sb.WriteByte(esc)
+			}
+			p.pos++
+		default:
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			sb.WriteRune(r)
+			p.pos += size
+		}
+	}
+
+	return nil, p.errorf("unterminated string")
+}
+
+// parseRegex parse a /pattern/flags regex literal
+func (p *shellParser) parseRegex() (interface{}, error) {
+	p.pos++
+	var sb strings.Builder
+	inClass := false
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.src):
+			if p.src[p.pos+1] != '/' {
+				sb.WriteByte(c)
+			}
+			sb.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+			continue
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '/' && !inClass:
+			p.pos++
+			start := p.pos
+			for p.pos < len(p.src) && unicode.IsLetter(rune(p.src[p.pos])) {
+				p.pos++
+			}
+			options := p.src[start:p.pos]
+			if err := checkRegexOptions(options); err != nil {
+				p.pos = start
+				return nil, p.errorf("%v", err)
+			}
+			pattern := sb.String()
+			if pattern == "(?:)" {
+				// (?:) is how the empty pattern is written, because // would be a comment
+				pattern = ""
+			}
+			return primitive.Regex{Pattern: pattern, Options: options}, nil
+		case c == '\n':
+			return nil, p.errorf("unterminated regex")
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+
+	return nil, p.errorf("unterminated regex")
+}
+
+// checkRegexOptions return a error if the regex options contain a flag not supported by MongoDB, that are i, m, s and x
+func checkRegexOptions(options string) error {
+	for _, c := range options {
+		if !strings.ContainsRune("imsx", c) {
+			return fmt.Errorf("invalid regex flag '%c', the supported flags are i, m, s and x", c)
+		}
+	}
+	return nil
+}
+
+// parseNumber parse a integer or a floating point number
+func (p *shellParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	if c := p.src[p.pos]; c == '-' || c == '+' {
+		p.pos++
+		if strings.HasPrefix(p.src[p.pos:], "Infinity") {
+			p.pos += len("Infinity")
+			return math.Inf(map[byte]int{'-': -1, '+': 1}[c]), nil
+		}
+	}
+	for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-xXabcdefABCDEF", p.src[p.pos]) >= 0 {
+		if c := p.src[p.pos]; (c == '+' || c == '-') && !strings.ContainsAny(p.src[p.pos-1:p.pos], "eE") {
+			break
+		}
+		p.pos++
+	}
+	text := p.src[start:p.pos]
+
+	if !strings.ContainsAny(text, ".eE") || strings.ContainsAny(text, "xX") {
+		n, err := strconv.ParseInt(text, 0, 64)
+		if err == nil {
+			return numberFromInt64(n), nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid number '%s'", text)
+	}
+	return f, nil
+}
+
+// parseIdentifier return the next identifier, or a empty string
+func (p *shellParser) parseIdentifier() string {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := rune(p.src[p.pos])
+		if c != '_' && c != '$' && c != '.' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// parseIdentifierValue parse a keyword, like true or null, or a constructor call, like ISODate('...')
+func (p *shellParser) parseIdentifierValue() (interface{}, error) {
+	start := p.pos
+	name := p.parseIdentifier()
+	switch name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "undefined":
+		return primitive.Undefined{}, nil
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "MinKey":
+		if p.peek() != '(' {
+			return primitive.MinKey{}, nil
+		}
+	case "MaxKey":
+		if p.peek() != '(' {
+			return primitive.MaxKey{}, nil
+		}
+	case "new":
+		return p.parseIdentifierValue()
+	}
+
+	if err := p.expect('('); err != nil {
+		p.pos = start
+		return nil, p.errorf("unknown identifier '%s'", name)
+	}
+	args := []interface{}{}
+	for p.peek() != ')' {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+
+	v, err := callShellConstructor(name, args)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("%v", err)
+	}
+	return v, nil
+}
+
+// callShellConstructor return the value built by the mongosh constructor name with the args
+func callShellConstructor(name string, args []interface{}) (interface{}, error) {
+	arg := func(i int) interface{} {
+		if i < len(args) {
+			return args[i]
+		}
+		return missing
+	}
+	argString := func(i int) (string, error) {
+		switch v := arg(i).(type) {
+		case string:
+			return v, nil
+		case int32, int64, float64:
+			return fmt.Sprint(v), nil
+		}
+		return "", fmt.Errorf("%s expects a string argument", name)
+	}
+
+	switch name {
+	case "ISODate", "Date":
+		if len(args) == 0 {
+			return primitive.NewDateTimeFromTime(time.Now()), nil
+		}
+		if ms, ok := toInt64(arg(0)); ok {
+			return primitive.DateTime(ms), nil
+		}
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseDateString(s, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		return primitive.NewDateTimeFromTime(t), nil
+	case "ObjectId":
+		if len(args) == 0 {
+			return primitive.NewObjectID(), nil
+		}
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		return primitive.ObjectIDFromHex(s)
+	case "NumberLong", "Long", "NumberInt", "Int32":
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer '%s'", s)
+		}
+		if name == "NumberInt" || name == "Int32" {
+			if n > math.MaxInt32 || n < math.MinInt32 {
+				return nil, fmt.Errorf("%s out of range", s)
+			}
+			return int32(n), nil
+		}
+		return n, nil
+	case "NumberDecimal", "Decimal128":
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		return primitive.ParseDecimal128(s)
+	case "Double":
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseFloat(s, 64)
+	case "Timestamp":
+		if doc, ok := arg(0).(bson.D); ok {
+			t, _ := toInt64(docGet(doc, "t"))
+			i, _ := toInt64(docGet(doc, "i"))
+			return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+		}
+		t, _ := toInt64(arg(0))
+		i, _ := toInt64(arg(1))
+		return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+	case "BinData":
+		subtype, ok := toInt64(arg(0))
+		data, err := argString(1)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("BinData expects a subtype and a base64 string")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		return primitive.Binary{Subtype: byte(subtype), Data: decoded}, nil
+	case "UUID":
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+		if err != nil || len(decoded) != 16 {
+			return nil, fmt.Errorf("invalid UUID '%s'", s)
+		}
+		return primitive.Binary{Subtype: 4, Data: decoded}, nil
+	case "MinKey":
+		return primitive.MinKey{}, nil
+	case "MaxKey":
+		return primitive.MaxKey{}, nil
+	case "Code":
+		s, err := argString(0)
+		if err != nil {
+			return nil, err
+		}
+		return primitive.JavaScript(s), nil
+	}
+
+	return nil, fmt.Errorf("unknown constructor %s", name)
+}
+
+// decodeExtJSONWrapper return the value represented by the Extended JSON wrapper doc, like {$oid: "..."}.
+// isWrapper is false if the doc isn't a wrapper
+func decodeExtJSONWrapper(doc bson.D) (value interface{}, isWrapper bool, err error) {
+	if len(doc) == 2 && doc[0].Key == "$binary" && doc[1].Key == "$type" {
+		data, _ := doc[0].Value.(string)
+		subtype, _ := doc[1].Value.(string)
+		v, err := decodeExtJSONBinary(data, subtype)
+		return v, true, err
+	}
+	if len(doc) != 1 {
+		return nil, false, nil
+	}
+
+	arg := doc[0].Value
+	s, isString := arg.(string)
+	switch doc[0].Key {
+	case "$oid":
+		v, err := primitive.ObjectIDFromHex(s)
+		return v, true, err
+	case "$numberInt", "$numberLong":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || !isString {
+			return nil, true, fmt.Errorf("invalid %s value", doc[0].Key)
+		}
+		if doc[0].Key == "$numberInt" {
+			return int32(n), true, nil
+		}
+		return n, true, nil
+	case "$numberDouble":
+		switch s {
+		case "Infinity":
+			return math.Inf(1), true, nil
+		case "-Infinity":
+			return math.Inf(-1), true, nil
+		case "NaN":
+			return math.NaN(), true, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return f, true, err
+	case "$numberDecimal":
+		v, err := primitive.ParseDecimal128(s)
+		return v, true, err
+	case "$date":
+		switch d := arg.(type) {
+		case string:
+			t, err := parseDateString(d, "", nil)
+			return primitive.NewDateTimeFromTime(t), true, err
+		case int64, int32:
+			ms, _ := toInt64(d)
+			return primitive.DateTime(ms), true, nil
+		}
+		return nil, true, fmt.Errorf("invalid $date value")
+	case "$binary":
+		spec, ok := arg.(bson.D)
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $binary value")
+		}
+		data, _ := docGet(spec, "base64").(string)
+		subtype, _ := docGet(spec, "subType").(string)
+		v, err := decodeExtJSONBinary(data, subtype)
+		return v, true, err
+	case "$timestamp":
+		spec, ok := arg.(bson.D)
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $timestamp value")
+		}
+		t, _ := toInt64(docGet(spec, "t"))
+		i, _ := toInt64(docGet(spec, "i"))
+		return primitive.Timestamp{T: uint32(t), I: uint32(i)}, true, nil
+	case "$regularExpression":
+		spec, ok := arg.(bson.D)
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $regularExpression value")
+		}
+		pattern, _ := docGet(spec, "pattern").(string)
+		options, _ := docGet(spec, "options").(string)
+		if err := checkRegexOptions(options); err != nil {
+			return nil, true, err
+		}
+		return primitive.Regex{Pattern: pattern, Options: options}, true, nil
+	case "$minKey":
+		return primitive.MinKey{}, true, nil
+	case "$maxKey":
+		return primitive.MaxKey{}, true, nil
+	case "$undefined":
+		return primitive.Undefined{}, true, nil
+	case "$symbol":
+		return primitive.Symbol(s), true, nil
+	case "$code":
+		return primitive.JavaScript(s), true, nil
+	}
+
+	return nil, false, nil
+}
+
+// decodeExtJSONBinary return the binary with the base64 data and the hex subtype
+func decodeExtJSONBinary(data string, subtype string) (interface{}, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	st, err := strconv.ParseUint(subtype, 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid binary subtype '%s'", subtype)
+	}
+	return primitive.Binary{Subtype: byte(st), Data: decoded}, nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"single stage", `{ $limit: 5 }`, `[{"$limit": 5}]`},
+		{"comments and trailing commas", "[\n  // first\n  { $match: { a: 1, }, },\n  /* second */ { $skip: 2 }\n]",
+			`[{"$match": {"a": 1}}, {"$skip": 2}]`},
+		{"strings", `[{ $set: { a: "x\"y", b: 'it\'s', c: 'è' } }]`, `[{"$set": {"a": "x\"y", "b": "it's", "c": "è"}}]`},
+		{"shell constructors", `[{ $match: { d: new Date('2019-11-05'), n: NumberLong(7), i: NumberInt('3') } }]`,
+			`[{"$match": {"d": {"$date": "2019-11-05T00:00:00Z"}, "n": {"$numberLong": "7"}, "i": 3}}]`},
+		{"regex", `[{ $match: { a: /^web\/[a-z]+$/imsx } }]`,
+			`[{"$match": {"a": {"$regularExpression": {"pattern": "^web/[a-z]+$", "options": "imsx"}}}}]`},
+		{"canonical Extended JSON", `[{"$match": {"n": {"$numberLong": "7"}, "r": {"$regularExpression": {"pattern": "a", "options": "i"}}}}]`,
+			`[{"$match": {"n": {"$numberLong": "7"}, "r": {"$regularExpression": {"pattern": "a", "options": "i"}}}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePipeline(tt.text)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestParsePipelineErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{"not a pipeline", `5`, "a pipeline must be an array of stages, found int"},
+		{"trailing text", `[] x`, "line 1, column 4: unexpected trailing text"},
+		{"unterminated string", "[{ $match: {\n a: 'x } }]", "line 2, column 12: unterminated string"},
+		{"unknown identifier", `[{ $match: { a: foo } }]`, "line 1, column 17: unknown identifier 'foo'"},
+		{"missing colon", `[{ $match { } }]`, "line 1, column 11: expected ':'"},
+		{"unsupported regex flag", `[{ $match: { a: /x/gi } }]`,
+			"line 1, column 20: invalid regex flag 'g', the supported flags are i, m, s and x"},
+		{"unsupported Extended JSON regex flag", `[{ "$match": { "a": { "$regularExpression": { "pattern": "x", "options": "u" } } } }]`,
+			"line 1, column 21: invalid regex flag 'u', the supported flags are i, m, s and x"},
+		{"invalid object id", `[{ $match: { _id: ObjectId('xyz') } }]`, "line 1, column 19: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePipeline(tt.text)
+			if err == nil {
+				t.Fatal("expected a error")
+			}
+			if got := err.Error(); len(got) < len(tt.wantErr) || got[:len(tt.wantErr)] != tt.wantErr {
+				t.Errorf("got error %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
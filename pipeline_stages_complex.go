@@ -16,7 +16,8 @@
 package mu
 
 import (
-	"regexp"
+	"fmt"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -40,89 +41,199 @@ func APOptionalSortingStage(sortBy string, sortDesc bool) interface{} {
 	})
 }
 
+// ParseSortSpec return the ordered sort document of the spec, a comma separated list of fields like "lastName,-createdAt",
+// where a field prefixed by - is sorted in descending order. Every field must be a key of allowedFields,
+// that translate the field names to the paths of the documents, otherwise a error is returned
+func ParseSortSpec(spec string, allowedFields map[string]string) (bson.D, error) {
+	out := bson.D{}
+	for _, item := range strings.Split(spec, ",") {
+		name := strings.TrimSpace(item)
+		direction := 1
+		if strings.HasPrefix(name, "-") {
+			name, direction = name[1:], -1
+		} else if strings.HasPrefix(name, "+") {
+			name = name[1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid sort spec %q: empty field name", spec)
+		}
+
+		path, ok := allowedFields[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid sort spec %q: unknown field %q, the allowed fields are %s", spec, name, joinedMapKeys(allowedFields))
+		}
+		if !isMissing(docGet(out, path)) {
+			return nil, fmt.Errorf("invalid sort spec %q: the field %q is repeated", spec, name)
+		}
+
+		out = append(out, bson.E{Key: path, Value: direction})
+	}
+
+	return out, nil
+}
+
+// APOptionalSortingSpecStage return a stage that sort documents by the multiple fields of the spec, as parsed by ParseSortSpec,
+// or nil if the spec is empty
+func APOptionalSortingSpecStage(spec string, allowedFields map[string]string) (interface{}, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	sortDoc, err := ParseSortSpec(spec, allowedFields)
+	if err != nil {
+		return nil, err
+	}
+
+	return APSort(sortDoc), nil
+}
+
 // APOptionalPagingStage return a stage that turn a stream of documents into a page that contains the documents plus some metadata
 func APOptionalPagingStage(page int, size int) interface{} {
 	if page == -1 || size == -1 {
 		return nil
 	}
 
-	return MAPipeline(
-		APFacet(bson.M{
-			"metadata": MAPipeline(
-				APCount("totalElements"),
-			),
-			"content": MAPipeline(
-				APSkip(page*size),
-				APLimit(size),
-			),
-		}),
-		APSet(bson.M{
-			"metadata": APOIfNull(APOArrayElemAt("$metadata", 0), bson.M{
-				"totalElements": 0,
-			}),
-		}),
-		APSet(bson.M{
-			"metadata.totalPages": "$metadata",
-		}),
-		APAddFields(bson.M{
-			"metadata.totalPages": APOFloor(APODivide("$metadata.totalElements", size)),
-			"metadata.size":       APOMin(size, APOSubtract("$metadata.totalElements", size*page)),
-			"metadata.number":     page,
-		}),
-		APAddFields(bson.M{
-			"metadata.empty": APOEqual("$metadata.size", 0),
-			"metadata.first": page == 0,
-			"metadata.last":  APOGreaterOrEqual(page, APOSubtract("$metadata.totalPages", 1)),
-		}),
-	)
+	return APPagingStages(page, size, PagingOptions{})
 }
 
 // APSearchFilterStage return a aggregation stage that filter the documents when any field match any keyword
 func APSearchFilterStage(fields []interface{}, keywords []string) interface{} {
-	//Build the search pattern
-	quotedKeywords := []string{}
-	for _, k := range keywords {
-		quotedKeywords = append(quotedKeywords, regexp.QuoteMeta(k))
-	}
+	return APSearchFilterStageWithOptions(fields, keywords, SearchFilterOptions{})
+}
 
+// APSearchFilterStageWithOptions return a aggregation stage that filter the documents when any field match all keywords,
+// or any keyword, as specified by the options
+func APSearchFilterStageWithOptions(fields []interface{}, keywords []string, options SearchFilterOptions) interface{} {
 	//Build the $or conditions
 	conditions := []interface{}{}
-	for _, q := range quotedKeywords {
+	for _, k := range keywords {
+		regex := options.regex(k)
 		matchKeywordConditions := []interface{}{}
 		for _, f := range fields {
-			matchKeywordConditions = append(matchKeywordConditions,
-				APOCond(
-					APOEqual(bson.M{
-						"$type": f,
-					}, "array"),
-					bson.M{
-						"$or": APOReduce(f, false,
-							APOOr(
-								"$$value",
-								bson.M{
-									"$regexMatch": bson.M{
-										"input": "$$this",
-										"regex": primitive.Regex{Pattern: q, Options: "i"},
-									},
-								},
-							),
-						),
-					},
-					bson.M{
-						"$regexMatch": bson.M{
-							"input": f,
-							"regex": primitive.Regex{Pattern: q, Options: "i"},
-						},
-					},
-				),
-			)
+			matchKeywordConditions = append(matchKeywordConditions, searchFieldCondition(f, regex))
 		}
 
 		conditions = append(conditions, APOOr(matchKeywordConditions...))
 	}
 
 	// Return the matching stage
-	return APMatch(QOExpr(APOAnd(conditions...)))
+	var matchStage interface{}
+	if options.Logic == MatchAnyKeyword {
+		matchStage = APMatch(QOExpr(APOOr(conditions...)))
+	} else {
+		matchStage = APMatch(QOExpr(APOAnd(conditions...)))
+	}
+	if !options.ReportMatches && !options.ReportMatchText {
+		return matchStage
+	}
+
+	return bson.A{
+		matchStage,
+		APSet(bson.M{
+			SearchMatchesField: searchMatchesReport(fields, keywords, options),
+		}),
+	}
+}
+
+// searchMatchesReport return a expression that return the array of the fields and the keywords that match
+func searchMatchesReport(fields []interface{}, keywords []string, options SearchFilterOptions) interface{} {
+	matches := bson.A{}
+	for _, k := range keywords {
+		regex := options.regex(k)
+		captureRegex := options.keywordRegex(k, true)
+		for _, f := range fields {
+			field := f
+			if path, ok := f.(string); ok {
+				field = strings.TrimPrefix(path, "$")
+			}
+			match := bson.M{
+				"field":   bson.M{"$literal": field},
+				"keyword": bson.M{"$literal": k},
+			}
+
+			if !options.ReportMatchText {
+				matches = append(matches, APOCond(searchFieldCondition(f, regex), match, nil))
+				continue
+			}
+
+			text := APOArrayElemAt("$$found.captures", 0)
+			start := APOAdd("$$found.idx", APOIndexOfCp("$$found.match", text))
+			match["match"] = text
+			match["start"] = start
+			match["end"] = APOAdd(start, APOStrLenCP(text))
+			matches = append(matches, APOLet(
+				bson.M{"found": searchFieldFind(f, captureRegex, searchFieldDepth(f))},
+				APOCond(APOEqual("$$found", nil), nil, match),
+			))
+		}
+	}
+
+	return APOFilter(matches, "match", APONotEqual("$$match", nil))
+}
+
+// searchFieldFind return a expression that return the $regexFind result of the first value, or item of the arrays nested up to depth levels in the value,
+// that match the regex, or null if nothing match
+func searchFieldFind(value interface{}, regex primitive.Regex, depth int) interface{} {
+	find := APORegexFind(APOConvertErrorableNullable(value, "string", "", ""), regex.Pattern, regex.Options)
+	if depth == 0 {
+		return find
+	}
+
+	return APOCond(
+		APOEqual(bson.M{
+			"$type": value,
+		}, "array"),
+		APOReduce(value, nil,
+			APOIfNull(
+				"$$value",
+				searchFieldFind("$$this", regex, depth-1),
+			),
+		),
+		find,
+	)
+}
+
+// searchFieldCondition return a expression that is true when the field match the regex.
+// When the field is a array, or a path that cross arrays of documents like "$hosts.features.name",
+// it's true when any item match, also inside a array of arrays. The values that aren't strings are converted to strings
+// and the documents never match
+func searchFieldCondition(field interface{}, regex primitive.Regex) interface{} {
+	return searchValueCondition(field, regex, searchFieldDepth(field))
+}
+
+// searchFieldDepth return the maximum depth of the arrays nested in the value of the field
+func searchFieldDepth(field interface{}) int {
+	if path, ok := field.(string); ok && strings.HasPrefix(path, "$") {
+		return strings.Count(path, ".") + 2
+	}
+	return 2
+}
+
+// searchValueCondition return a expression that is true when the value, or any item of the arrays nested up to depth levels in the value,
+// match the regex
+func searchValueCondition(value interface{}, regex primitive.Regex, depth int) interface{} {
+	match := bson.M{
+		"$regexMatch": bson.M{
+			"input": APOConvertErrorableNullable(value, "string", "", ""),
+			"regex": regex,
+		},
+	}
+	if depth == 0 {
+		return match
+	}
+
+	return APOCond(
+		APOEqual(bson.M{
+			"$type": value,
+		}, "array"),
+		APOReduce(value, false,
+			APOOr(
+				"$$value",
+				searchValueCondition("$$this", regex, depth-1),
+			),
+		),
+		match,
+	)
 }
 
 // APGroupAndCountStages return some aggregation stagess that group whatFieldName by what and count the documents
@@ -139,3 +250,55 @@ func APGroupAndCountStages(whatFieldName string, countFieldName string, what int
 		}),
 	}
 }
+
+// APGroupAndCountTopStages return some aggregation stages that group whatFieldName by what, count the documents and keep
+// the n values with the highest count, folding the remaining values into a single row where whatFieldName is othersValue.
+// Every row contains the percentage of the total count in percentageFieldName.
+// what could be a document like {os: "$os", version: "$version"} to group by multiple keys, that are nested in whatFieldName
+func APGroupAndCountTopStages(whatFieldName string, countFieldName string, percentageFieldName string, what interface{}, n int, othersValue interface{}) interface{} {
+	if n < 0 {
+		n = 0
+	}
+	var top interface{} = bson.A{}
+	if n > 0 {
+		top = APOSlice("$rows", 0, n)
+	}
+
+	return bson.A{
+		APGroup(bson.M{
+			"_id":   what,
+			"count": APOSum(1),
+		}),
+		APSort(bson.D{
+			{Key: "count", Value: -1},
+			{Key: "_id", Value: 1},
+		}),
+		APGroup(bson.M{
+			"_id":   nil,
+			"total": APOSum("$count"),
+			"rows": APOPush(bson.M{
+				"_id":   "$_id",
+				"count": "$count",
+			}),
+		}),
+		APProject(bson.M{
+			"total": true,
+			"rows": APOConcatArrays(
+				top,
+				APOCond(APOGreater(APOSize("$rows"), n),
+					bson.A{bson.M{
+						"_id":   bson.M{"$literal": othersValue},
+						"count": APOSumReducer(APOSlice("$rows", n, APOSize("$rows")), "$$this.count"),
+					}},
+					bson.A{},
+				),
+			),
+		}),
+		APUnwind("$rows"),
+		APReplaceWith(bson.M{
+			whatFieldName:       "$rows._id",
+			countFieldName:      "$rows.count",
+			percentageFieldName: APOMultiply(APODivide("$rows.count", "$total"), 100),
+		}),
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseSortSpec(t *testing.T) {
+	allowed := map[string]string{"lastName": "last_name", "createdAt": "info.createdAt", "cpu": "cpu"}
+	tests := []struct {
+		name    string
+		spec    string
+		want    bson.D
+		wantErr string
+	}{
+		{"single field", "lastName", bson.D{{Key: "last_name", Value: 1}}, ""},
+		{"multiple fields", "lastName, -createdAt,+cpu", bson.D{
+			{Key: "last_name", Value: 1}, {Key: "info.createdAt", Value: -1}, {Key: "cpu", Value: 1},
+		}, ""},
+		{"unknown field", "lastName,password", nil,
+			`invalid sort spec "lastName,password": unknown field "password", the allowed fields are cpu, createdAt, lastName`},
+		{"empty field", "lastName,,cpu", nil, `invalid sort spec "lastName,,cpu": empty field name`},
+		{"only the direction", "-", nil, `invalid sort spec "-": empty field name`},
+		{"repeated field", "cpu,-cpu", nil, `invalid sort spec "cpu,-cpu": the field "cpu" is repeated`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSortSpec(tt.spec, allowed)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if g, w := testJSON(t, got), testJSON(t, tt.want); g != w {
+				t.Errorf("got %s, want %s", g, w)
+			}
+			// the order of the fields is significant, so it is checked without sorting the keys
+			for i := range tt.want {
+				if got[i].Key != tt.want[i].Key {
+					t.Errorf("field %d: got %s, want %s", i, got[i].Key, tt.want[i].Key)
+				}
+			}
+		})
+	}
+}
+
+func TestOptionalSortingSpecStage(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "os": "linux", "cpu": 4},
+		{"_id": 2, "os": "windows", "cpu": 8},
+		{"_id": 3, "os": "linux", "cpu": 8},
+	}
+	tests := []struct {
+		name string
+		spec string
+		want string
+	}{
+		{"empty spec", " ", `[{"_id": 1}, {"_id": 2}, {"_id": 3}]`},
+		{"two fields", "os,-cpu", `[{"_id": 3}, {"_id": 1}, {"_id": 2}]`},
+		{"two fields reversed", "-cpu,os", `[{"_id": 3}, {"_id": 2}, {"_id": 1}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage, err := APOptionalSortingSpecStage(tt.spec, map[string]string{"os": "os", "cpu": "cpu"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(stage, APProject(bson.M{"_id": 1})), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestSearchFilterStageNestedValues(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "tags": bson.A{"linux", bson.A{"web", "nginx"}}, "hosts": bson.A{bson.M{"features": bson.A{bson.M{"name": "oracle"}}}}},
+		{"_id": 2, "tags": "db", "hosts": bson.A{bson.M{"features": bson.A{bson.M{"name": "mysql"}, bson.M{"name": "tomcat"}}}}},
+		{"_id": 3, "tags": bson.A{int32(8080), true}, "hosts": bson.M{"features": bson.M{"name": "nginx"}}},
+		{"_id": 4, "tags": bson.M{"name": "nginx"}},
+	}
+	tests := []struct {
+		name    string
+		keyword string
+		want    string
+	}{
+		{"array item", "linux", `[{"_id": 1}]`},
+		{"array of arrays", "nginx", `[{"_id": 1}, {"_id": 3}]`},
+		{"path through arrays of documents", "tomcat", `[{"_id": 2}]`},
+		{"number converted to string", "808", `[{"_id": 3}]`},
+		{"boolean converted to string", "true", `[{"_id": 3}]`},
+		{"documents never match", "name", `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(
+				APSearchFilterStage([]interface{}{"$tags", "$hosts.features.name"}, []string{tt.keyword}),
+				APProject(bson.M{"_id": 1}),
+			), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestSearchFilterStageWithOptions(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "name": "Web server"},
+		{"_id": 2, "name": "webserver"},
+		{"_id": 3, "name": "Città di web"},
+		{"_id": 4, "name": "web"},
+	}
+	tests := []struct {
+		name     string
+		keywords []string
+		options  SearchFilterOptions
+		want     string
+	}{
+		{"contains", []string{"web"}, SearchFilterOptions{}, `[{"_id": 1}, {"_id": 2}, {"_id": 3}, {"_id": 4}]`},
+		{"prefix", []string{"web"}, SearchFilterOptions{Mode: MatchPrefix}, `[{"_id": 1}, {"_id": 2}, {"_id": 4}]`},
+		{"whole word", []string{"web"}, SearchFilterOptions{Mode: MatchWholeWord}, `[{"_id": 1}, {"_id": 3}, {"_id": 4}]`},
+		{"exact", []string{"web"}, SearchFilterOptions{Mode: MatchExact}, `[{"_id": 4}]`},
+		{"case sensitive", []string{"Web"}, SearchFilterOptions{CaseSensitive: true}, `[{"_id": 1}]`},
+		{"all keywords", []string{"web", "server"}, SearchFilterOptions{}, `[{"_id": 1}, {"_id": 2}]`},
+		{"any keyword", []string{"città", "server"}, SearchFilterOptions{Logic: MatchAnyKeyword}, `[{"_id": 1}, {"_id": 2}, {"_id": 3}]`},
+		{"diacritic sensitive", []string{"citta"}, SearchFilterOptions{}, `[]`},
+		{"diacritic insensitive", []string{"CITTA"}, SearchFilterOptions{DiacriticInsensitive: true}, `[{"_id": 3}]`},
+		{"diacritic insensitive accented keyword", []string{"cìtta"}, SearchFilterOptions{DiacriticInsensitive: true}, `[{"_id": 3}]`},
+		{"diacritic insensitive whole word", []string{"di"}, SearchFilterOptions{DiacriticInsensitive: true, Mode: MatchWholeWord}, `[{"_id": 3}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(
+				APSearchFilterStageWithOptions([]interface{}{"$name"}, tt.keywords, tt.options),
+				APProject(bson.M{"_id": 1}),
+			), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestSearchFilterStageReportMatches(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "name": "My Web server", "tags": bson.A{"linux", bson.A{"città"}}},
+		{"_id": 2, "name": "db", "tags": bson.A{"web"}},
+	}
+	tests := []struct {
+		name     string
+		keywords []string
+		options  SearchFilterOptions
+		want     string
+	}{
+		{"fields and keywords", []string{"web"}, SearchFilterOptions{ReportMatches: true}, `[
+			{"_id": 1, "_matches": [{"field": "name", "keyword": "web"}]},
+			{"_id": 2, "_matches": [{"field": "tags", "keyword": "web"}]}]`},
+		{"any keyword", []string{"web", "linux"}, SearchFilterOptions{ReportMatches: true, Logic: MatchAnyKeyword}, `[
+			{"_id": 1, "_matches": [{"field": "name", "keyword": "web"}, {"field": "tags", "keyword": "linux"}]},
+			{"_id": 2, "_matches": [{"field": "tags", "keyword": "web"}]}]`},
+		{"match text", []string{"web"}, SearchFilterOptions{ReportMatchText: true}, `[
+			{"_id": 1, "_matches": [{"field": "name", "keyword": "web", "match": "Web", "start": 3, "end": 6}]},
+			{"_id": 2, "_matches": [{"field": "tags", "keyword": "web", "match": "web", "start": 0, "end": 3}]}]`},
+		{"match text in nested arrays in code points", []string{"citta"}, SearchFilterOptions{ReportMatchText: true, DiacriticInsensitive: true}, `[
+			{"_id": 1, "_matches": [{"field": "tags", "keyword": "citta", "match": "città", "start": 0, "end": 5}]}]`},
+		{"match text of whole words", []string{"server"}, SearchFilterOptions{ReportMatchText: true, Mode: MatchWholeWord}, `[
+			{"_id": 1, "_matches": [{"field": "name", "keyword": "server", "match": "server", "start": 7, "end": 13}]}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(
+				APSearchFilterStageWithOptions([]interface{}{"$name", "$tags"}, tt.keywords, tt.options),
+				APProject(bson.M{"_id": 1, SearchMatchesField: 1}),
+			), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestGroupAndCountTopStages(t *testing.T) {
+	docs := []bson.M{
+		{"os": "linux"}, {"os": "windows"}, {"os": "linux"}, {"os": "aix"}, {"os": "linux"}, {"os": "hpux"},
+		{"os": "windows"}, {"os": "solaris"},
+	}
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"top 2 and others", 2, `[{"os": "linux", "count": 3, "percentage": 37.5}, {"os": "windows", "count": 2, "percentage": 25.0},
+			{"os": "others", "count": 3, "percentage": 37.5}]`},
+		{"ties sorted by value", 3, `[{"os": "linux", "count": 3, "percentage": 37.5}, {"os": "windows", "count": 2, "percentage": 25.0},
+			{"os": "aix", "count": 1, "percentage": 12.5}, {"os": "others", "count": 2, "percentage": 25.0}]`},
+		{"no others row when every value fits", 5, `[{"os": "linux", "count": 3, "percentage": 37.5}, {"os": "windows", "count": 2, "percentage": 25.0},
+			{"os": "aix", "count": 1, "percentage": 12.5}, {"os": "hpux", "count": 1, "percentage": 12.5},
+			{"os": "solaris", "count": 1, "percentage": 12.5}]`},
+		{"only others", 0, `[{"os": "others", "count": 8, "percentage": 100.0}]`},
+		{"negative n", -1, `[{"os": "others", "count": 8, "percentage": 100.0}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(
+				APGroupAndCountTopStages("os", "count", "percentage", "$os", tt.n, "others"),
+			), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+
+	out, err := NewMemoryEngine().Aggregate(MAPipeline(
+		APGroupAndCountTopStages("os", "count", "percentage", "$os", 2, "others"),
+	), []bson.M{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSON(t, out, `[]`)
+}
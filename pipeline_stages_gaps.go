@@ -0,0 +1,174 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GapFillOptions contains the options of APGapFillStages
+type GapFillOptions struct {
+	// Field is the top level date field of the time series, like the _id of APDateHistogramStages
+	Field string
+	// Unit and Step are the distance between two buckets. A zero Step is a single unit
+	Unit DateUnit
+	Step int
+	// From and To are the range of the buckets, To is excluded. They are interpreted in UTC
+	From time.Time
+	To   time.Time
+	// Defaults contains the values of the fields of the missing buckets, like {count: 0}
+	Defaults bson.M
+	// CarryForward contains the fields of the missing buckets set to the value of the previous bucket
+	CarryForward []string
+	// Native use the $densify and $fill stages, that require MongoDB 5.3, instead of the emulation
+	Native bool
+}
+
+// dateUnitDurations contains the duration of the units with a fixed length
+var dateUnitDurations = map[DateUnit]time.Duration{
+	DateUnitMinute: time.Minute,
+	DateUnitHour:   time.Hour,
+	DateUnitDay:    24 * time.Hour,
+	DateUnitWeek:   7 * 24 * time.Hour,
+}
+
+// APGapFillStages return the stages that add to a time series sorted by date the missing buckets of the range,
+// with the default values and the values carried forward from the previous bucket.
+// The emulation used for the servers that don't support $densify returns only the buckets in the range,
+// and it returns all of them also when there are no documents.
+// Both the implementations compute the buckets in UTC adding fixed durations, or calendar months and years,
+// so in a timezone with daylight saving time they don't line up with the buckets of APDateHistogramStages.
+// It return nil if the unit is unknown
+func APGapFillStages(options GapFillOptions) interface{} {
+	if options.Step <= 0 {
+		options.Step = 1
+	}
+	if !gapFillAdd(options.From, options.Unit, options.Step).After(options.From) {
+		return nil
+	}
+
+	if options.Native {
+		return gapFillNativeStages(options)
+	}
+	return gapFillEmulatedStages(options)
+}
+
+// gapFillNativeStages return the gap filling stages based on $densify and $fill
+func gapFillNativeStages(options GapFillOptions) interface{} {
+	output := bson.M{}
+	for k, v := range options.Defaults {
+		output[k] = bson.M{"value": v}
+	}
+	for _, k := range options.CarryForward {
+		output[k] = bson.M{"method": "locf"}
+	}
+
+	return MAPipeline(
+		bson.M{"$densify": bson.M{
+			"field": options.Field,
+			"range": bson.M{
+				"step":   options.Step,
+				"unit":   string(options.Unit),
+				"bounds": bson.A{options.From.UTC(), options.To.UTC()},
+			},
+		}},
+		APOptionalStage(len(output) > 0, bson.M{"$fill": bson.M{
+			"sortBy": bson.M{options.Field: 1},
+			"output": output,
+		}}),
+	)
+}
+
+// gapFillEmulatedStages return the gap filling stages based on $range and APOReduce.
+// The documents are collected by a $facet, that unlike $group return a document also when there are no documents
+func gapFillEmulatedStages(options GapFillOptions) interface{} {
+	from := options.From.UTC()
+	to := options.To.UTC()
+	count := 0
+	for d := from; d.Before(to); d = gapFillAdd(from, options.Unit, count*options.Step) {
+		count++
+	}
+
+	missing := bson.A{bson.M{options.Field: "$$date"}}
+	if len(options.Defaults) > 0 {
+		missing = append(missing, bson.M{"$literal": options.Defaults})
+	}
+	if len(options.CarryForward) > 0 {
+		carried := bson.M{}
+		for _, k := range options.CarryForward {
+			carried[k] = "$$value.last." + k
+		}
+		missing = append(missing, carried)
+	}
+
+	return bson.A{
+		APFacet(bson.M{
+			"docs": bson.A{APMatch(bson.M{})},
+		}),
+		APProject(bson.M{
+			"series": APOReduce(bson.M{"$range": bson.A{0, count}}, bson.M{"out": bson.A{}, "last": nil},
+				APOLet(bson.M{"date": gapFillDateExpr(from, options.Unit, options.Step)},
+					APOLet(bson.M{"found": APOArrayElemAt(APOFilter("$docs", "doc", APOEqual("$$doc."+options.Field, "$$date")), 0)},
+						APOLet(bson.M{"doc": APOIfNull("$$found", APOMergeObjects(missing...))},
+							bson.M{
+								"out":  APOConcatArrays("$$value.out", bson.A{"$$doc"}),
+								"last": "$$doc",
+							},
+						),
+					),
+				),
+			),
+		}),
+		APUnwind("$series.out"),
+		APReplaceWith("$series.out"),
+	}
+}
+
+// gapFillAdd return the date n units after from
+func gapFillAdd(from time.Time, unit DateUnit, n int) time.Time {
+	switch unit {
+	case DateUnitMonth:
+		return from.AddDate(0, n, 0)
+	case DateUnitYear:
+		return from.AddDate(n, 0, 0)
+	}
+	return from.Add(time.Duration(n) * dateUnitDurations[unit])
+}
+
+// gapFillDateExpr return a expression that return the date of the bucket $$this of the series that start from
+func gapFillDateExpr(from time.Time, unit DateUnit, step int) interface{} {
+	if unit != DateUnitMonth && unit != DateUnitYear {
+		return APOAdd(from, APOMultiply("$$this", int64(step)*int64(dateUnitDurations[unit]/time.Millisecond)))
+	}
+
+	months := APOMultiply("$$this", step)
+	if unit == DateUnitYear {
+		months = APOMultiply("$$this", 12*step)
+	}
+	monthIndex := APOAdd(int(from.Month())-1, months)
+
+	return bson.M{"$dateFromParts": bson.M{
+		"year":        APOAdd(from.Year(), APOFloor(APODivide(monthIndex, 12))),
+		"month":       APOAdd(bson.M{"$mod": bson.A{monthIndex, 12}}, 1),
+		"day":         from.Day(),
+		"hour":        from.Hour(),
+		"minute":      from.Minute(),
+		"second":      from.Second(),
+		"millisecond": from.Nanosecond() / int(time.Millisecond),
+	}}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGapFillStages(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2019, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	series := []bson.M{
+		{"_id": day(2), "count": 3, "status": "up"},
+		{"_id": day(5), "count": 1, "status": "down"},
+	}
+	tests := []struct {
+		name    string
+		options GapFillOptions
+		want    string
+	}{
+		{"defaults", GapFillOptions{Field: "_id", Unit: DateUnitDay, From: day(1), To: day(4), Defaults: bson.M{"count": 0}}, `[
+			{"_id": {"$date": "2019-03-01T00:00:00Z"}, "count": 0},
+			{"_id": {"$date": "2019-03-02T00:00:00Z"}, "count": 3, "status": "up"},
+			{"_id": {"$date": "2019-03-03T00:00:00Z"}, "count": 0}]`},
+		{"carry forward", GapFillOptions{Field: "_id", Unit: DateUnitDay, From: day(2), To: day(6), Defaults: bson.M{"count": 0},
+			CarryForward: []string{"status"}}, `[
+			{"_id": {"$date": "2019-03-02T00:00:00Z"}, "count": 3, "status": "up"},
+			{"_id": {"$date": "2019-03-03T00:00:00Z"}, "count": 0, "status": "up"},
+			{"_id": {"$date": "2019-03-04T00:00:00Z"}, "count": 0, "status": "up"},
+			{"_id": {"$date": "2019-03-05T00:00:00Z"}, "count": 1, "status": "down"}]`},
+		{"step", GapFillOptions{Field: "_id", Unit: DateUnitDay, Step: 3, From: day(2), To: day(9)}, `[
+			{"_id": {"$date": "2019-03-02T00:00:00Z"}, "count": 3, "status": "up"},
+			{"_id": {"$date": "2019-03-05T00:00:00Z"}, "count": 1, "status": "down"},
+			{"_id": {"$date": "2019-03-08T00:00:00Z"}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, native := range []bool{true, false} {
+				options := tt.options
+				options.Native = native
+				// $densify keep also the documents out of the range, that are filtered to compare the results
+				out := mustAggregate(t, MAPipeline(
+					APGapFillStages(options),
+					APMatch(bson.M{"_id": bson.M{"$gte": options.From, "$lt": options.To}}),
+				), series)
+				assertJSON(t, out, tt.want)
+			}
+		})
+	}
+}
+
+func TestGapFillEmulatedStagesEmptySeries(t *testing.T) {
+	tests := []struct {
+		name    string
+		options GapFillOptions
+		want    string
+	}{
+		{"days", GapFillOptions{Field: "date", Unit: DateUnitDay,
+			From: time.Date(2019, 3, 30, 0, 0, 0, 0, time.UTC), To: time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC),
+			Defaults: bson.M{"count": 0}}, `[
+			{"date": {"$date": "2019-03-30T00:00:00Z"}, "count": 0},
+			{"date": {"$date": "2019-03-31T00:00:00Z"}, "count": 0}]`},
+		{"months", GapFillOptions{Field: "date", Unit: DateUnitMonth,
+			From: time.Date(2019, 11, 30, 0, 0, 0, 0, time.UTC), To: time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)}, `[
+			{"date": {"$date": "2019-11-30T00:00:00Z"}},
+			{"date": {"$date": "2019-12-30T00:00:00Z"}},
+			{"date": {"$date": "2020-01-30T00:00:00Z"}}]`},
+		{"empty range", GapFillOptions{Field: "date", Unit: DateUnitDay,
+			From: time.Date(2019, 3, 30, 0, 0, 0, 0, time.UTC), To: time.Date(2019, 3, 30, 0, 0, 0, 0, time.UTC)}, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, mustAggregate(t, MAPipeline(APGapFillStages(tt.options)), []bson.M{}), tt.want)
+		})
+	}
+
+	if stages := APGapFillStages(GapFillOptions{Field: "date", Unit: "decade"}); stages != nil {
+		t.Errorf("expected no stages for a unknown unit, got %v", stages)
+	}
+}
+
+// mustAggregate return the result of the pipeline run by the MemoryEngine on the docs, failing the test on error
+func mustAggregate(t *testing.T, pipeline bson.A, docs interface{}) []bson.D {
+	t.Helper()
+	out, err := NewMemoryEngine().Aggregate(pipeline, docs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return out
+}
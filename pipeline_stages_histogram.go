@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DateUnit is the size of the buckets of a date histogram
+type DateUnit string
+
+const (
+	// DateUnitMinute is a bucket of a minute
+	DateUnitMinute DateUnit = "minute"
+	// DateUnitHour is a bucket of a hour
+	DateUnitHour DateUnit = "hour"
+	// DateUnitDay is a bucket of a day
+	DateUnitDay DateUnit = "day"
+	// DateUnitWeek is a bucket of a ISO week, starting on monday
+	DateUnitWeek DateUnit = "week"
+	// DateUnitMonth is a bucket of a month
+	DateUnitMonth DateUnit = "month"
+	// DateUnitYear is a bucket of a year
+	DateUnitYear DateUnit = "year"
+)
+
+// dateUnitLabelFormats contains the format of the labels of the buckets of every unit
+var dateUnitLabelFormats = map[DateUnit]string{
+	DateUnitMinute: "%Y-%m-%d %H:%M",
+	DateUnitHour:   "%Y-%m-%d %H:00",
+	DateUnitDay:    "%Y-%m-%d",
+	DateUnitWeek:   "%G-W%V",
+	DateUnitMonth:  "%Y-%m",
+	DateUnitYear:   "%Y",
+}
+
+// dateUnitParts contains the parts of $dateToParts that are kept by the truncation to every unit
+var dateUnitParts = map[DateUnit][]string{
+	DateUnitMinute: {"year", "month", "day", "hour", "minute"},
+	DateUnitHour:   {"year", "month", "day", "hour"},
+	DateUnitDay:    {"year", "month", "day"},
+	DateUnitWeek:   {"isoWeekYear", "isoWeek"},
+	DateUnitMonth:  {"year", "month"},
+	DateUnitYear:   {"year"},
+}
+
+// APDateHistogramStages return the stages that group the documents by the bucket of the unit that contains the date
+// in the timezone, that is UTC if empty. For every bucket, sorted by date, it return the start of the bucket as _id,
+// a label like 2019-W05 or 2019-11 in labelFieldName, the number of documents in countFieldName and the accumulators.
+// It requires MongoDB 5.0 because it use $dateTrunc, APDateHistogramEmulatedStages works also with the older servers
+func APDateHistogramStages(date interface{}, unit DateUnit, timezone string, labelFieldName string, countFieldName string, accumulators bson.M) interface{} {
+	bucket := APODateTrunc(date, string(unit), timezone)
+	if unit == DateUnitWeek {
+		bucket.(bson.M)["$dateTrunc"].(bson.M)["startOfWeek"] = "monday"
+	}
+
+	return dateHistogramStages(bucket, unit, timezone, labelFieldName, countFieldName, accumulators)
+}
+
+// APDateHistogramEmulatedStages return the same stages of APDateHistogramStages, but it truncate the dates with
+// APODateTruncEmulated so it works also with the servers older than MongoDB 5.0
+func APDateHistogramEmulatedStages(date interface{}, unit DateUnit, timezone string, labelFieldName string, countFieldName string, accumulators bson.M) interface{} {
+	return dateHistogramStages(APODateTruncEmulated(date, unit, timezone), unit, timezone, labelFieldName, countFieldName, accumulators)
+}
+
+// dateHistogramStages return the stages of the date histogram that group the documents by the bucket expression
+func dateHistogramStages(bucket interface{}, unit DateUnit, timezone string, labelFieldName string, countFieldName string, accumulators bson.M) interface{} {
+	group := bson.M{
+		"_id":          bucket,
+		countFieldName: APOSum(1),
+	}
+	for k, v := range accumulators {
+		group[k] = v
+	}
+
+	return bson.A{
+		APGroup(group),
+		APSort(bson.M{
+			"_id": 1,
+		}),
+		APSet(bson.M{
+			labelFieldName: APODateToString("$_id", dateUnitLabelFormats[unit], timezone),
+		}),
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testDates return the documents with the dates, parsed as RFC 3339, in the field date
+func testDates(t *testing.T, dates ...string) []bson.M {
+	docs := []bson.M{}
+	for _, d := range dates {
+		date, err := time.Parse(time.RFC3339, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, bson.M{"date": date, "n": len(docs)})
+	}
+	return docs
+}
+
+func TestDateHistogramStages(t *testing.T) {
+	docs := testDates(t,
+		"2019-03-30T23:30:00Z", "2019-03-31T00:10:00Z", "2019-03-31T00:50:00Z",
+		"2019-04-01T10:00:00Z", "2019-12-30T08:00:00Z", "2020-01-01T08:00:00Z",
+	)
+	tests := []struct {
+		name     string
+		unit     DateUnit
+		timezone string
+		want     string
+	}{
+		{"hour", DateUnitHour, "", `[
+			{"_id": {"$date": "2019-03-30T23:00:00Z"}, "label": "2019-03-30 23:00", "count": 1},
+			{"_id": {"$date": "2019-03-31T00:00:00Z"}, "label": "2019-03-31 00:00", "count": 2},
+			{"_id": {"$date": "2019-04-01T10:00:00Z"}, "label": "2019-04-01 10:00", "count": 1},
+			{"_id": {"$date": "2019-12-30T08:00:00Z"}, "label": "2019-12-30 08:00", "count": 1},
+			{"_id": {"$date": "2020-01-01T08:00:00Z"}, "label": "2020-01-01 08:00", "count": 1}]`},
+		{"day in a timezone with DST", DateUnitDay, "Europe/Rome", `[
+			{"_id": {"$date": "2019-03-30T23:00:00Z"}, "label": "2019-03-31", "count": 3},
+			{"_id": {"$date": "2019-03-31T22:00:00Z"}, "label": "2019-04-01", "count": 1},
+			{"_id": {"$date": "2019-12-29T23:00:00Z"}, "label": "2019-12-30", "count": 1},
+			{"_id": {"$date": "2019-12-31T23:00:00Z"}, "label": "2020-01-01", "count": 1}]`},
+		{"ISO week", DateUnitWeek, "", `[
+			{"_id": {"$date": "2019-03-25T00:00:00Z"}, "label": "2019-W13", "count": 3},
+			{"_id": {"$date": "2019-04-01T00:00:00Z"}, "label": "2019-W14", "count": 1},
+			{"_id": {"$date": "2019-12-30T00:00:00Z"}, "label": "2020-W01", "count": 2}]`},
+		{"month", DateUnitMonth, "", `[
+			{"_id": {"$date": "2019-03-01T00:00:00Z"}, "label": "2019-03", "count": 3},
+			{"_id": {"$date": "2019-04-01T00:00:00Z"}, "label": "2019-04", "count": 1},
+			{"_id": {"$date": "2019-12-01T00:00:00Z"}, "label": "2019-12", "count": 1},
+			{"_id": {"$date": "2020-01-01T00:00:00Z"}, "label": "2020-01", "count": 1}]`},
+		{"year", DateUnitYear, "+01:00", `[
+			{"_id": {"$date": "2018-12-31T23:00:00Z"}, "label": "2019", "count": 5},
+			{"_id": {"$date": "2019-12-31T23:00:00Z"}, "label": "2020", "count": 1}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stages := range []interface{}{
+				APDateHistogramStages("$date", tt.unit, tt.timezone, "label", "count", nil),
+				APDateHistogramEmulatedStages("$date", tt.unit, tt.timezone, "label", "count", nil),
+			} {
+				out, err := NewMemoryEngine().Aggregate(MAPipeline(stages), docs)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				assertJSON(t, out, tt.want)
+			}
+		})
+	}
+}
+
+func TestDateHistogramStagesAccumulators(t *testing.T) {
+	docs := testDates(t, "2019-03-30T23:30:00Z", "2019-03-31T00:10:00Z", "2019-03-31T00:50:00Z")
+	out, err := NewMemoryEngine().Aggregate(MAPipeline(
+		APDateHistogramStages("$date", DateUnitDay, "", "label", "count", bson.M{"ids": APOPush("$n")}),
+	), docs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSON(t, out, `[
+		{"_id": {"$date": "2019-03-30T00:00:00Z"}, "label": "2019-03-30", "count": 1, "ids": [0]},
+		{"_id": {"$date": "2019-03-31T00:00:00Z"}, "label": "2019-03-31", "count": 2, "ids": [1, 2]}]`)
+}
+
+func TestBucketStages(t *testing.T) {
+	docs := testNumbers(10)
+	tests := []struct {
+		name  string
+		stage interface{}
+		want  string
+	}{
+		{"bucket", APBucket("$n", []interface{}{0, 3, 6}, "other", nil),
+			`[{"_id": 0, "count": 3}, {"_id": 3, "count": 3}, {"_id": "other", "count": 4}]`},
+		{"bucket with output", APBucket("$n", []interface{}{0, 5, 10}, nil, bson.M{"total": APOSum("$n")}),
+			`[{"_id": 0, "total": 10}, {"_id": 5, "total": 35}]`},
+		{"bucketAuto", APBucketAuto("$n", 2, nil, ""),
+			`[{"_id": {"min": 0, "max": 5}, "count": 5}, {"_id": {"min": 5, "max": 9}, "count": 5}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(tt.stage), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// KeysetCursor is the position of a document in a keyset (cursor-based) paging: its sort values and its _id
+type KeysetCursor struct {
+	Values bson.A
+	ID     interface{}
+}
+
+// EncodeKeysetCursor return the cursor as a opaque url-safe token
+func EncodeKeysetCursor(cursor KeysetCursor) (string, error) {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "v", Value: cursor.Values},
+		{Key: "id", Value: cursor.ID},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// DecodeKeysetCursor return the cursor encoded in the token by EncodeKeysetCursor
+func DecodeKeysetCursor(token string) (KeysetCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return KeysetCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return KeysetCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+	values, ok := docGet(doc, "v").(bson.A)
+	if !ok || isMissing(docGet(doc, "id")) {
+		return KeysetCursor{}, errors.New("invalid cursor: missing values")
+	}
+	for _, v := range append(append(bson.A{}, values...), docGet(doc, "id")) {
+		if hasOperatorKey(v) {
+			return KeysetCursor{}, errors.New("invalid cursor: the values can't contain operators")
+		}
+	}
+
+	return KeysetCursor{Values: values, ID: docGet(doc, "id")}, nil
+}
+
+// hasOperatorKey return true if v is a document with a key that start with $
+func hasOperatorKey(v interface{}) bool {
+	d, ok := v.(bson.D)
+	if !ok {
+		return false
+	}
+	for _, e := range d {
+		if strings.HasPrefix(e.Key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// keysetSort return the sort with the _id as last field, to have a total order
+func keysetSort(sort bson.D) (bson.D, error) {
+	normalized, err := normalizeValue(sort)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bson.D{}
+	for _, e := range normalized.(bson.D) {
+		n, ok := toInt64(e.Value)
+		if !ok || (n != 1 && n != -1) {
+			return nil, fmt.Errorf("the sort direction of %s must be 1 or -1", e.Key)
+		}
+		if e.Key == "_id" {
+			return append(out, bson.E{Key: "_id", Value: int(n)}), nil
+		}
+		out = append(out, bson.E{Key: e.Key, Value: int(n)})
+	}
+
+	return append(out, bson.E{Key: "_id", Value: 1}), nil
+}
+
+// reverseSort return the sort with the directions inverted
+func reverseSort(sort bson.D) bson.D {
+	out := make(bson.D, 0, len(sort))
+	for _, e := range sort {
+		out = append(out, bson.E{Key: e.Key, Value: -e.Value.(int)})
+	}
+	return out
+}
+
+// keysetAfterCondition return the condition that match the documents that come after the cursor in the sort
+func keysetAfterCondition(sort bson.D, cursor KeysetCursor) (interface{}, error) {
+	values := append(append(bson.A{}, cursor.Values...), cursor.ID)
+	if len(values) != len(sort) {
+		return nil, fmt.Errorf("the cursor contains %d values but the sort has %d fields", len(values), len(sort))
+	}
+
+	alternatives := bson.A{}
+	for i, e := range sort {
+		cond := bson.D{}
+		for j := 0; j < i; j++ {
+			cond = append(cond, bson.E{Key: sort[j].Key, Value: QOEqual(values[j])})
+		}
+		if e.Value.(int) > 0 {
+			cond = append(cond, bson.E{Key: e.Key, Value: QOGreaterThan(values[i])})
+		} else {
+			cond = append(cond, bson.E{Key: e.Key, Value: QOLessThan(values[i])})
+		}
+		alternatives = append(alternatives, cond)
+	}
+
+	return bson.M{"$or": alternatives}, nil
+}
+
+// APKeysetPagingStages return the stages that return the page of size documents sorted by sort that come after the cursor token,
+// or before it if previous is true. The first page is returned when the cursor is empty.
+// Unlike APOptionalPagingStage the cost of a page doesn't depend on its position and the collection isn't counted.
+// The sort fields shouldn't be null and the _id is used to break the ties
+func APKeysetPagingStages(sort bson.D, size int, cursor string, previous bool) (bson.A, error) {
+	fullSort, err := keysetSort(sort)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, errors.New("the page size must be positive")
+	}
+
+	pageSort := fullSort
+	if previous {
+		pageSort = reverseSort(fullSort)
+	}
+
+	var match interface{}
+	if cursor != "" {
+		decoded, err := DecodeKeysetCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		cond, err := keysetAfterCondition(pageSort, decoded)
+		if err != nil {
+			return nil, err
+		}
+		match = APMatch(cond)
+	}
+
+	return MAPipeline(
+		match,
+		APSort(pageSort),
+		APLimit(size),
+		APOptionalStage(previous, APSort(fullSort)),
+	), nil
+}
+
+// KeysetCursorOf return the cursor that point to the doc in the sort
+func KeysetCursorOf(sort bson.D, doc interface{}) (KeysetCursor, error) {
+	fullSort, err := keysetSort(sort)
+	if err != nil {
+		return KeysetCursor{}, err
+	}
+	normalized, err := normalizeValue(doc)
+	if err != nil {
+		return KeysetCursor{}, err
+	}
+
+	cursor := KeysetCursor{Values: bson.A{}, ID: getFieldPath(normalized, "_id")}
+	if isMissing(cursor.ID) {
+		return KeysetCursor{}, errors.New("the document doesn't have an _id")
+	}
+	for _, e := range fullSort[:len(fullSort)-1] {
+		v := getFieldPath(normalized, e.Key)
+		if isMissing(v) {
+			v = nil
+		}
+		cursor.Values = append(cursor.Values, v)
+	}
+
+	return cursor, nil
+}
+
+// KeysetPageCursors return the tokens of the cursors that point to the next and to the previous page,
+// given the docs of a page returned by the APKeysetPagingStages with the same sort.
+// The docs could be a []bson.M, a []bson.D or a slice of structs. The tokens are empty if docs is empty
+func KeysetPageCursors(sort bson.D, docs interface{}) (next string, previous string, err error) {
+	normalized, err := normalizeDocuments(docs)
+	if err != nil || len(normalized) == 0 {
+		return "", "", err
+	}
+
+	last, err := KeysetCursorOf(sort, normalized[len(normalized)-1])
+	if err != nil {
+		return "", "", err
+	}
+	first, err := KeysetCursorOf(sort, normalized[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	if next, err = EncodeKeysetCursor(last); err != nil {
+		return "", "", err
+	}
+	if previous, err = EncodeKeysetCursor(first); err != nil {
+		return "", "", err
+	}
+	return next, previous, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testKeysetDocs contains documents with repeated sort values, to check that the _id break the ties
+var testKeysetDocs = []bson.M{
+	{"_id": 1, "cpu": 4}, {"_id": 2, "cpu": 8}, {"_id": 3, "cpu": 4}, {"_id": 4, "cpu": 2},
+	{"_id": 5, "cpu": 8}, {"_id": 6, "cpu": 4}, {"_id": 7, "cpu": 16},
+}
+
+// testIDs return the documents with only the _id of the docs
+func testIDs(docs []bson.D) bson.A {
+	out := bson.A{}
+	for _, doc := range docs {
+		out = append(out, bson.M{"_id": docGet(doc, "_id")})
+	}
+	return out
+}
+
+func TestKeysetPagingStages(t *testing.T) {
+	tests := []struct {
+		name  string
+		sort  bson.D
+		pages []string
+	}{
+		{"ascending", bson.D{{Key: "cpu", Value: 1}}, []string{
+			`[{"_id": 4}, {"_id": 1}, {"_id": 3}]`,
+			`[{"_id": 6}, {"_id": 2}, {"_id": 5}]`,
+			`[{"_id": 7}]`,
+			`[]`,
+		}},
+		{"descending", bson.D{{Key: "cpu", Value: -1}}, []string{
+			`[{"_id": 7}, {"_id": 2}, {"_id": 5}]`,
+			`[{"_id": 1}, {"_id": 3}, {"_id": 6}]`,
+			`[{"_id": 4}]`,
+			`[]`,
+		}},
+		{"descending _id", bson.D{{Key: "cpu", Value: 1}, {Key: "_id", Value: -1}}, []string{
+			`[{"_id": 4}, {"_id": 6}, {"_id": 3}]`,
+			`[{"_id": 1}, {"_id": 5}, {"_id": 2}]`,
+			`[{"_id": 7}]`,
+			`[]`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor := ""
+			var previousPage []bson.D
+			for i, want := range tt.pages {
+				stages, err := APKeysetPagingStages(tt.sort, 3, cursor, false)
+				if err != nil {
+					t.Fatalf("page %d: unexpected error: %v", i, err)
+				}
+				out, err := NewMemoryEngine().Aggregate(stages, testKeysetDocs)
+				if err != nil {
+					t.Fatalf("page %d: unexpected error: %v", i, err)
+				}
+				assertJSON(t, testIDs(out), want)
+
+				next, previous, err := KeysetPageCursors(tt.sort, out)
+				if err != nil {
+					t.Fatalf("page %d: unexpected error: %v", i, err)
+				}
+				if len(out) == 0 {
+					if next != "" || previous != "" {
+						t.Errorf("page %d: expected empty cursors for an empty page", i)
+					}
+					break
+				}
+
+				// going back from the second page must return the first one
+				if i == 1 {
+					stages, err := APKeysetPagingStages(tt.sort, 3, previous, true)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					back, err := NewMemoryEngine().Aggregate(stages, testKeysetDocs)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if got, want := testJSON(t, testIDs(back)), testJSON(t, testIDs(previousPage)); got != want {
+						t.Errorf("previous page: got %s, want %s", got, want)
+					}
+				}
+				previousPage, cursor = out, next
+			}
+		})
+	}
+}
+
+func TestKeysetCursorRoundTrip(t *testing.T) {
+	cursor := KeysetCursor{Values: bson.A{"linux", int64(4)}, ID: "web1"}
+	token, err := EncodeKeysetCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeKeysetCursor(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, bson.A{decoded.Values, decoded.ID}, `[["linux", 4], "web1"]`)
+}
+
+func TestKeysetAfterCondition(t *testing.T) {
+	cond, err := keysetAfterCondition(bson.D{{Key: "os", Value: 1}, {Key: "_id", Value: -1}},
+		KeysetCursor{Values: bson.A{bson.D{{Key: "name", Value: "linux"}}}, ID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, cond, `{"$or": [
+		{"os": {"$gt": {"name": "linux"}}},
+		{"os": {"$eq": {"name": "linux"}}, "_id": {"$lt": 3}}
+	]}`)
+}
+
+func TestKeysetPagingStagesErrors(t *testing.T) {
+	other, err := EncodeKeysetCursor(KeysetCursor{Values: bson.A{1, 2}, ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator, err := EncodeKeysetCursor(KeysetCursor{Values: bson.A{bson.D{{Key: "$ne", Value: nil}}}, ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		sort   bson.D
+		size   int
+		cursor string
+	}{
+		{"invalid direction", bson.D{{Key: "cpu", Value: 2}}, 3, ""},
+		{"invalid size", bson.D{{Key: "cpu", Value: 1}}, 0, ""},
+		{"not base64", bson.D{{Key: "cpu", Value: 1}}, 3, "!!"},
+		{"not a cursor", bson.D{{Key: "cpu", Value: 1}}, 3, "AAAA"},
+		{"cursor of another sort", bson.D{{Key: "cpu", Value: 1}}, 3, other},
+		{"operator in the cursor", bson.D{{Key: "cpu", Value: 1}}, 3, operator},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := APKeysetPagingStages(tt.sort, tt.size, tt.cursor, false); err == nil {
+				t.Error("expected a error")
+			}
+		})
+	}
+}
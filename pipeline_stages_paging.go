@@ -0,0 +1,282 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PageShape is the layout of the document produced by APPagingStages
+type PageShape int
+
+const (
+	// PageShapeMetadata is the layout of APOptionalPagingStage: the content plus a metadata document.
+	// For compatibility metadata.size is the number of elements in the page and metadata.pageSize is the requested size
+	PageShapeMetadata PageShape = iota
+	// PageShapeSpring is the layout of the json serialization of the Page of Spring Data
+	PageShapeSpring
+	// PageShapeMinimal contains only the content and the totalElements
+	PageShapeMinimal
+	// PageShapeCustom contains the fields listed in PagingOptions.CustomFields
+	PageShapeCustom
+)
+
+// PagingOptions contains the options of APPagingStages
+type PagingOptions struct {
+	// Shape is the layout of the page
+	Shape PageShape
+	// Sort, if not empty, is applied to the content and echoed in the page
+	Sort bson.D
+	// CustomFields map the paths of the page produced with PageShapeCustom to the page fields.
+	// The page fields are content, totalElements, totalPages, size, number, numberOfElements,
+	// first, last, empty, hasNext, hasPrevious and sort
+	CustomFields map[string]string
+}
+
+// customPageFields contains the page fields that can be used in PagingOptions.CustomFields
+var customPageFields = map[string]bool{
+	"content": true, "totalElements": true, "totalPages": true, "size": true, "number": true, "numberOfElements": true,
+	"first": true, "last": true, "empty": true, "hasNext": true, "hasPrevious": true, "sort": true,
+}
+
+// validCustomFields return true if the custom fields aren't empty and map valid paths to page fields
+func validCustomFields(fields map[string]string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	for path, field := range fields {
+		if path == "" || strings.HasPrefix(path, "$") || !customPageFields[field] {
+			return false
+		}
+	}
+	return true
+}
+
+// APPagingStages return the stages that turn a stream of documents into a single document containing
+// the page number of size documents and its metadata, in the layout chosen by the options.
+// It return nil if page is negative, size is not positive or the shape is PageShapeCustom
+// and the CustomFields are empty or contain a unknown page field
+func APPagingStages(page int, size int, options PagingOptions) interface{} {
+	if page < 0 || size <= 0 {
+		return nil
+	}
+	if options.Shape == PageShapeCustom && !validCustomFields(options.CustomFields) {
+		return nil
+	}
+
+	var sortStage interface{}
+	var sortEcho interface{}
+	if len(options.Sort) > 0 {
+		sortStage = APSort(options.Sort)
+		sortEcho = bson.M{"$literal": options.Sort}
+	}
+
+	return MAPipeline(
+		APFacet(bson.M{
+			"metadata": MAPipeline(
+				APCount("totalElements"),
+			),
+			"content": MAPipeline(
+				sortStage,
+				APSkip(page*size),
+				APLimit(size),
+			),
+		}),
+		APReplaceWith(bson.M{
+			"content":       "$content",
+			"totalElements": APOIfNull(APOArrayElemAt("$metadata.totalElements", 0), 0),
+		}),
+		APSet(bson.M{
+			"totalPages":       APOConvert(APOCeil(APODivide("$totalElements", size)), "long"),
+			"numberOfElements": APOSize("$content"),
+			"size":             size,
+			"number":           page,
+		}),
+		APSet(bson.M{
+			"first":       APOEqual("$number", 0),
+			"last":        APOGreaterOrEqual(page+1, "$totalPages"),
+			"hasNext":     APOGreater("$totalPages", page+1),
+			"hasPrevious": APOGreater("$number", 0),
+			"empty":       APOEqual("$numberOfElements", 0),
+			"sort":        sortEcho,
+		}),
+		pageShapeStage(page, size, options),
+	)
+}
+
+// pageShapeStage return the stage that convert the page fields to the layout of the options
+func pageShapeStage(page int, size int, options PagingOptions) interface{} {
+	switch options.Shape {
+	case PageShapeSpring:
+		sorted := len(options.Sort) > 0
+		springSort := bson.M{
+			"sorted":   sorted,
+			"unsorted": !sorted,
+			"empty":    !sorted,
+		}
+		// $set would merge springSort into the echoed sort, so the echo is removed first
+		return MAPipeline(APUnset("sort"), APSet(bson.M{
+			"sort": springSort,
+			"pageable": bson.M{
+				"sort":       springSort,
+				"offset":     int64(page) * int64(size),
+				"pageNumber": page,
+				"pageSize":   size,
+				"paged":      true,
+				"unpaged":    false,
+			},
+		}))
+	case PageShapeMinimal:
+		return APProject(bson.M{
+			"content":       true,
+			"totalElements": true,
+		})
+	case PageShapeCustom:
+		fields := bson.M{}
+		for path, field := range options.CustomFields {
+			fields[path] = "$" + field
+		}
+		return APProject(fields)
+	default:
+		return APProject(bson.M{
+			"content": true,
+			"metadata": bson.M{
+				"totalElements":    "$totalElements",
+				"totalPages":       "$totalPages",
+				"size":             "$numberOfElements",
+				"pageSize":         "$size",
+				"number":           "$number",
+				"numberOfElements": "$numberOfElements",
+				"empty":            "$empty",
+				"first":            "$first",
+				"last":             "$last",
+				"hasNext":          "$hasNext",
+				"hasPrevious":      "$hasPrevious",
+				"sort":             "$sort",
+			},
+		})
+	}
+}
+
+// Page is a page of documents decoded from the document produced by APPagingStages or APOptionalPagingStage
+type Page struct {
+	// Content contains the documents of the page, that can be decoded with DecodeContent
+	Content []bson.Raw
+	// Size is the requested size of the page
+	Size             int64
+	Number           int64
+	NumberOfElements int64
+	TotalElements    int64
+	TotalPages       int64
+	First            bool
+	Last             bool
+	Empty            bool
+	HasNext          bool
+	HasPrevious      bool
+}
+
+// pageFields contains the page fields of the PageShapeSpring and PageShapeMinimal layouts
+type pageFields struct {
+	Content          []bson.Raw `bson:"content"`
+	Size             int64      `bson:"size"`
+	Number           int64      `bson:"number"`
+	NumberOfElements int64      `bson:"numberOfElements"`
+	TotalElements    int64      `bson:"totalElements"`
+	TotalPages       int64      `bson:"totalPages"`
+	First            bool       `bson:"first"`
+	Last             bool       `bson:"last"`
+	Empty            bool       `bson:"empty"`
+	HasNext          bool       `bson:"hasNext"`
+	HasPrevious      bool       `bson:"hasPrevious"`
+}
+
+// pageMetadataFields contains the page fields of the PageShapeMetadata layout
+type pageMetadataFields struct {
+	Content  []bson.Raw `bson:"content"`
+	Metadata struct {
+		PageSize         int64 `bson:"pageSize"`
+		Number           int64 `bson:"number"`
+		NumberOfElements int64 `bson:"numberOfElements"`
+		TotalElements    int64 `bson:"totalElements"`
+		TotalPages       int64 `bson:"totalPages"`
+		First            bool  `bson:"first"`
+		Last             bool  `bson:"last"`
+		Empty            bool  `bson:"empty"`
+		HasNext          bool  `bson:"hasNext"`
+		HasPrevious      bool  `bson:"hasPrevious"`
+	} `bson:"metadata"`
+}
+
+// DecodePage return the page decoded from doc, the document produced by APPagingStages with the shape.
+// The doc could be a bson.Raw, a bson.D or a bson.M. The PageShapeCustom layout can't be decoded
+func DecodePage(doc interface{}, shape PageShape) (*Page, error) {
+	raw, ok := doc.(bson.Raw)
+	if !ok {
+		marshaled, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		raw = marshaled
+	}
+
+	switch shape {
+	case PageShapeSpring, PageShapeMinimal:
+		var fields pageFields
+		if err := bson.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		p := Page(fields)
+		return &p, nil
+	case PageShapeMetadata:
+		var fields pageMetadataFields
+		if err := bson.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		m := fields.Metadata
+		return &Page{
+			Content:          fields.Content,
+			Size:             m.PageSize,
+			Number:           m.Number,
+			NumberOfElements: m.NumberOfElements,
+			TotalElements:    m.TotalElements,
+			TotalPages:       m.TotalPages,
+			First:            m.First,
+			Last:             m.Last,
+			Empty:            m.Empty,
+			HasNext:          m.HasNext,
+			HasPrevious:      m.HasPrevious,
+		}, nil
+	}
+
+	return nil, errors.New("the custom page shape can't be decoded")
+}
+
+// DecodeContent decode the documents of the page into out, that must be a pointer to a slice
+func (p *Page) DecodeContent(out interface{}) error {
+	content := make(bson.A, 0, len(p.Content))
+	for _, c := range p.Content {
+		content = append(content, c)
+	}
+
+	raw, err := bson.Marshal(bson.D{{Key: "content", Value: content}})
+	if err != nil {
+		return err
+	}
+	return bson.Raw(raw).Lookup("content").Unmarshal(out)
+}
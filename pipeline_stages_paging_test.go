@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPagingStagesMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		count      int
+		page, size int
+		want       Page
+		content    string
+	}{
+		{"first of 4 pages", 10, 0, 3, Page{Size: 3, Number: 0, NumberOfElements: 3, TotalElements: 10, TotalPages: 4,
+			First: true, HasNext: true}, `[{"n": 0}, {"n": 1}, {"n": 2}]`},
+		{"middle page", 10, 2, 3, Page{Size: 3, Number: 2, NumberOfElements: 3, TotalElements: 10, TotalPages: 4,
+			HasNext: true, HasPrevious: true}, `[{"n": 6}, {"n": 7}, {"n": 8}]`},
+		{"last partial page", 10, 3, 3, Page{Size: 3, Number: 3, NumberOfElements: 1, TotalElements: 10, TotalPages: 4,
+			Last: true, HasPrevious: true}, `[{"n": 9}]`},
+		{"exact last page", 9, 2, 3, Page{Size: 3, Number: 2, NumberOfElements: 3, TotalElements: 9, TotalPages: 3,
+			Last: true, HasPrevious: true}, `[{"n": 6}, {"n": 7}, {"n": 8}]`},
+		{"page past the end", 10, 5, 3, Page{Size: 3, Number: 5, NumberOfElements: 0, TotalElements: 10, TotalPages: 4,
+			Last: true, Empty: true, HasPrevious: true}, `[]`},
+		{"empty collection", 0, 0, 3, Page{Size: 3, Number: 0, NumberOfElements: 0, TotalElements: 0, TotalPages: 0,
+			First: true, Last: true, Empty: true}, `[]`},
+		{"single page", 2, 0, 3, Page{Size: 3, Number: 0, NumberOfElements: 2, TotalElements: 2, TotalPages: 1,
+			First: true, Last: true}, `[{"n": 0}, {"n": 1}]`},
+	}
+	for _, tt := range tests {
+		for _, shape := range []PageShape{PageShapeMetadata, PageShapeSpring} {
+			t.Run(tt.name, func(t *testing.T) {
+				out, err := NewMemoryEngine().Aggregate(
+					MAPipeline(APPagingStages(tt.page, tt.size, PagingOptions{Shape: shape})), testNumbers(tt.count))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(out) != 1 {
+					t.Fatalf("expected a single page document, got %d", len(out))
+				}
+
+				page, err := DecodePage(out[0], shape)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				var content []bson.M
+				if err := page.DecodeContent(&content); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				assertJSON(t, content, tt.content)
+
+				page.Content = nil
+				if !reflect.DeepEqual(*page, tt.want) {
+					t.Errorf("shape %d: got %+v, want %+v", shape, *page, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestPagingStagesShapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		options PagingOptions
+		want    string
+	}{
+		{"minimal", PagingOptions{Shape: PageShapeMinimal}, `[{"content": [{"n": 2}], "totalElements": 3}]`},
+		{"custom", PagingOptions{Shape: PageShapeCustom, CustomFields: map[string]string{
+			"items": "content", "page.total": "totalElements", "page.more": "hasNext",
+		}}, `[{"items": [{"n": 2}], "page": {"total": 3, "more": false}}]`},
+		{"spring with sort", PagingOptions{Shape: PageShapeSpring, Sort: bson.D{{Key: "n", Value: -1}}},
+			`[{"content": [{"n": 0}], "totalElements": 3, "totalPages": 3, "numberOfElements": 1, "size": 1, "number": 2,
+			"first": false, "last": true, "hasNext": false, "hasPrevious": true, "empty": false,
+			"sort": {"sorted": true, "unsorted": false, "empty": false},
+			"pageable": {"sort": {"sorted": true, "unsorted": false, "empty": false}, "offset": 2, "pageNumber": 2,
+			"pageSize": 1, "paged": true, "unpaged": false}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(APPagingStages(2, 1, tt.options)), testNumbers(3))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestPagingStagesDisabled(t *testing.T) {
+	tests := []struct {
+		name       string
+		page, size int
+		options    PagingOptions
+	}{
+		{"negative page", -1, 10, PagingOptions{}},
+		{"negative size", 0, -1, PagingOptions{}},
+		{"zero size", 0, 0, PagingOptions{}},
+		{"no custom fields", 0, 10, PagingOptions{Shape: PageShapeCustom}},
+		{"unknown custom field", 0, 10, PagingOptions{Shape: PageShapeCustom, CustomFields: map[string]string{
+			"items": "content", "total": "count",
+		}}},
+		{"invalid custom path", 0, 10, PagingOptions{Shape: PageShapeCustom, CustomFields: map[string]string{
+			"$items": "content",
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if stages := APPagingStages(tt.page, tt.size, tt.options); stages != nil {
+				t.Errorf("expected no stages, got %v", stages)
+			}
+		})
+	}
+	if stage := APOptionalPagingStage(-1, 10); stage != nil {
+		t.Errorf("expected no stages, got %v", stage)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// unpivotFieldName is the temporary field that contains the {k, v} pairs of APUnpivotStages
+const unpivotFieldName = "_unpivot"
+
+// APPivotStages return some aggregation stages that turn the rows into a document for each rowKey, sorted by it,
+// with the rowKey as _id and a field for each columnKey, that must be a string, set to the accumulator (like $sum or $first)
+// of the values. For example the rows {host, metric, value} become {_id: host, cpu: value, mem: value}
+func APPivotStages(rowKey interface{}, columnKey interface{}, value interface{}, accumulator string) interface{} {
+	return bson.A{
+		APGroup(bson.M{
+			"_id": bson.M{
+				"row":    rowKey,
+				"column": columnKey,
+			},
+			"value": bson.M{accumulator: value},
+		}),
+		APGroup(bson.M{
+			"_id": "$_id.row",
+			"columns": APOPush(bson.M{
+				"k": "$_id.column",
+				"v": "$value",
+			}),
+		}),
+		APSort(bson.M{
+			"_id": 1,
+		}),
+		APReplaceWith(APOMergeObjects(
+			bson.M{"_id": "$_id"},
+			APOArrayToObject("$columns"),
+		)),
+	}
+}
+
+// APUnpivotStages return some aggregation stages that turn every document into a document for each of the top level
+// fields, without them, with the name of the field in keyName and its value in valueName. The missing fields are skipped.
+// If fields is empty every field except the _id is unpivoted and the other fields are removed.
+// For example the documents {_id: host, cpu: value, mem: value} become {_id: host, metric: cpu, value: value}
+func APUnpivotStages(fields []string, keyName string, valueName string) interface{} {
+	var pairs interface{}
+	var cleanup interface{}
+	if len(fields) == 0 {
+		pairs = APOFilter(APOObjectToArray("$$ROOT"), "field", APONotEqual("$$field.k", "_id"))
+		cleanup = APProject(bson.M{
+			keyName:   true,
+			valueName: true,
+		})
+	} else {
+		// the values are a bson.D to produce the documents in the order of the fields
+		values := bson.D{}
+		unset := []interface{}{unpivotFieldName}
+		for _, f := range fields {
+			values = append(values, bson.E{Key: f, Value: "$" + f})
+			unset = append(unset, f)
+		}
+		pairs = APOObjectToArray(values)
+		cleanup = APUnset(unset...)
+	}
+
+	return bson.A{
+		APSet(bson.M{
+			unpivotFieldName: pairs,
+		}),
+		APUnwind("$" + unpivotFieldName),
+		APSet(bson.M{
+			keyName:   "$" + unpivotFieldName + ".k",
+			valueName: "$" + unpivotFieldName + ".v",
+		}),
+		cleanup,
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPivotStages(t *testing.T) {
+	rows := []bson.M{
+		{"host": "web", "metric": "cpu", "value": 10},
+		{"host": "db", "metric": "cpu", "value": 30},
+		{"host": "web", "metric": "mem", "value": 4},
+		{"host": "web", "metric": "cpu", "value": 5},
+	}
+	tests := []struct {
+		name        string
+		accumulator string
+		want        string
+	}{
+		{"sum", "$sum", `[{"_id": "db", "cpu": 30}, {"_id": "web", "cpu": 15, "mem": 4}]`},
+		{"max", "$max", `[{"_id": "db", "cpu": 30}, {"_id": "web", "cpu": 10, "mem": 4}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustAggregate(t, MAPipeline(APPivotStages("$host", "$metric", "$value", tt.accumulator)), rows)
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
+
+func TestUnpivotStages(t *testing.T) {
+	docs := []bson.M{
+		{"_id": "web", "cpu": 15, "mem": 4, "zone": "eu"},
+		{"_id": "db", "cpu": 30, "zone": "us"},
+	}
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{"some fields", []string{"cpu", "mem"}, `[
+			{"_id": "web", "zone": "eu", "metric": "cpu", "value": 15},
+			{"_id": "web", "zone": "eu", "metric": "mem", "value": 4},
+			{"_id": "db", "zone": "us", "metric": "cpu", "value": 30}]`},
+		{"every field", nil, `[
+			{"_id": "web", "metric": "cpu", "value": 15},
+			{"_id": "web", "metric": "mem", "value": 4},
+			{"_id": "web", "metric": "zone", "value": "eu"},
+			{"_id": "db", "metric": "cpu", "value": 30},
+			{"_id": "db", "metric": "zone", "value": "us"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustAggregate(t, MAPipeline(
+				APUnpivotStages(tt.fields, "metric", "value"),
+				APSort(bson.D{{Key: "_id", Value: -1}, {Key: "metric", Value: 1}}),
+			), docs)
+			assertJSON(t, out, tt.want)
+		})
+	}
+
+	// the documents of each input document follow the order of the fields
+	out := mustAggregate(t, MAPipeline(APUnpivotStages([]string{"mem", "zone", "cpu"}, "metric", "value")), docs)
+	assertJSON(t, out, `[
+		{"_id": "web", "metric": "mem", "value": 4},
+		{"_id": "web", "metric": "zone", "value": "eu"},
+		{"_id": "web", "metric": "cpu", "value": 15},
+		{"_id": "db", "metric": "zone", "value": "us"},
+		{"_id": "db", "metric": "cpu", "value": 30}]`)
+}
+
+func TestPivotUnpivotRoundTrip(t *testing.T) {
+	docs := []bson.M{
+		{"_id": "db", "cpu": 30, "mem": 8},
+		{"_id": "web", "cpu": 15, "mem": 4},
+	}
+	out := mustAggregate(t, MAPipeline(
+		APUnpivotStages(nil, "metric", "value"),
+		APPivotStages("$_id", "$metric", "$value", "$first"),
+	), docs)
+	assertJSON(t, out, `[{"_id": "db", "cpu": 30, "mem": 8}, {"_id": "web", "cpu": 15, "mem": 4}]`)
+}
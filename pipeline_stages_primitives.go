@@ -133,3 +133,55 @@ func APFacet(fields interface{}) interface{} {
 func APCount(field string) interface{} {
 	return bson.M{"$count": field}
 }
+
+// APBucket return a bucket stage that group the documents by groupBy into the buckets delimited by the sorted boundaries.
+// The documents outside the boundaries are grouped into the defaultBucket, omitted if nil,
+// and the output contains the accumulators of every bucket, that count the documents if nil
+func APBucket(groupBy interface{}, boundaries []interface{}, defaultBucket interface{}, output bson.M) interface{} {
+	bucket := bson.M{
+		"groupBy":    groupBy,
+		"boundaries": boundaries,
+	}
+	if defaultBucket != nil {
+		bucket["default"] = defaultBucket
+	}
+	if output != nil {
+		bucket["output"] = output
+	}
+
+	return bson.M{"$bucket": bucket}
+}
+
+// APBucketAuto return a bucketAuto stage that group the documents by groupBy into the number of buckets with the same size.
+// The output contains the accumulators of every bucket, that count the documents if nil, and the granularity is the
+// preferred number series of the boundaries, like R5 or POWERSOF2, omitted if empty
+func APBucketAuto(groupBy interface{}, buckets int, output bson.M, granularity string) interface{} {
+	bucket := bson.M{
+		"groupBy": groupBy,
+		"buckets": buckets,
+	}
+	if output != nil {
+		bucket["output"] = output
+	}
+	if granularity != "" {
+		bucket["granularity"] = granularity
+	}
+
+	return bson.M{"$bucketAuto": bucket}
+}
+
+// APSetWindowFields return a setWindowFields stage that set the output fields computed by the window functions
+// over the documents of the same partition sorted by sortBy. partitionBy and sortBy are omitted if nil
+func APSetWindowFields(partitionBy interface{}, sortBy interface{}, output bson.M) interface{} {
+	window := bson.M{
+		"output": output,
+	}
+	if partitionBy != nil {
+		window["partitionBy"] = partitionBy
+	}
+	if sortBy != nil {
+		window["sortBy"] = sortBy
+	}
+
+	return bson.M{"$setWindowFields": window}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SearchMode is the implementation used by APKeywordSearchStages
+type SearchMode int
+
+const (
+	// SearchModeRegex search the keywords with regular expressions in the fields, like APSearchFilterStage.
+	// It doesn't need any index but it scan the whole collection
+	SearchModeRegex SearchMode = iota
+	// SearchModeText search the keywords with $text in the text index of the collection
+	SearchModeText
+	// SearchModeAtlas search the keywords with the $search stage in a Atlas Search index
+	SearchModeAtlas
+)
+
+// KeywordSearchOptions contains the options of APKeywordSearchStages
+type KeywordSearchOptions struct {
+	// Mode is the implementation of the search
+	Mode SearchMode
+	// Index is the name of the Atlas Search index, or empty for the default index
+	Index string
+	// ScoreField, if not empty, is the field set to the relevance score, used to sort the documents.
+	// It's ignored by SearchModeRegex
+	ScoreField string
+	// Filter contains the match options of SearchModeRegex
+	Filter SearchFilterOptions
+}
+
+// APKeywordSearchStages return the stages that filter the documents where any field match every keyword,
+// with the implementation chosen by the options, or nil if there are no keywords.
+// The fields are expressions like "$hostname" and they are ignored by SearchModeText, that use the fields of the text index.
+// The stages of SearchModeText and SearchModeAtlas must be the first ones of the pipeline
+func APKeywordSearchStages(fields []interface{}, keywords []string, options KeywordSearchOptions) interface{} {
+	if len(keywords) == 0 {
+		return nil
+	}
+
+	switch options.Mode {
+	case SearchModeText:
+		return APTextSearchStages(textSearchPhrases(keywords), options.ScoreField)
+	case SearchModeAtlas:
+		paths := bson.A{}
+		for _, f := range fields {
+			if s, ok := f.(string); ok {
+				paths = append(paths, strings.TrimPrefix(s, "$"))
+			}
+		}
+
+		must := []interface{}{}
+		for _, k := range keywords {
+			must = append(must, SOText(k, paths))
+		}
+
+		return MAPipeline(
+			APSearch(options.Index, SOCompound(must, nil, nil, nil)),
+			scoreStages(options.ScoreField, "searchScore"),
+		)
+	default:
+		return APSearchFilterStageWithOptions(fields, keywords, options.Filter)
+	}
+}
+
+// textSearchPhrases return the search string of $text that match all the keywords, quoting each keyword as a phrase
+func textSearchPhrases(keywords []string) string {
+	phrases := []string{}
+	for _, k := range keywords {
+		phrases = append(phrases, `"`+strings.Replace(k, `"`, ` `, -1)+`"`)
+	}
+	return strings.Join(phrases, " ")
+}
+
+// APTextSearchStages return the stages that filter the documents that match the $text search string
+// and, if scoreField is not empty, set scoreField to the textScore and sort by it
+func APTextSearchStages(search string, scoreField string) interface{} {
+	return MAPipeline(
+		APMatch(QOText(search)),
+		scoreStages(scoreField, "textScore"),
+	)
+}
+
+// scoreStages return the stages that set scoreField to the metadata score and sort by it, or nil if scoreField is empty
+func scoreStages(scoreField string, score string) interface{} {
+	if scoreField == "" {
+		return nil
+	}
+
+	return bson.A{
+		APSet(bson.M{
+			scoreField: APOMeta(score),
+		}),
+		APSort(bson.M{
+			scoreField: -1,
+		}),
+	}
+}
+
+// APSearch return a $search stage that run the search operator, like SOText or SOCompound,
+// in the Atlas Search index, or in the default index if index is empty
+func APSearch(index string, operator bson.M) interface{} {
+	search := bson.M{}
+	for k, v := range operator {
+		search[k] = v
+	}
+	if index != "" {
+		search["index"] = index
+	}
+
+	return bson.M{"$search": search}
+}
+
+// APSearchWithHighlight return a $search stage like APSearch that also return the highlights of the path,
+// that can be projected with APOMeta("searchHighlights")
+func APSearchWithHighlight(index string, operator bson.M, highlightPath interface{}) interface{} {
+	stage := APSearch(index, operator).(bson.M)
+	stage["$search"].(bson.M)["highlight"] = bson.M{"path": highlightPath}
+	return stage
+}
+
+// SOText return the text search operator, that search the query (a string or a array of strings) in the path
+// (a field name, a array of field names or a wildcard)
+func SOText(query interface{}, path interface{}) bson.M {
+	return bson.M{
+		"text": bson.M{
+			"query": query,
+			"path":  path,
+		},
+	}
+}
+
+// SOAutocomplete return the autocomplete search operator, that search the prefix query in the path,
+// that must be indexed with the autocomplete type
+func SOAutocomplete(query interface{}, path string) bson.M {
+	return bson.M{
+		"autocomplete": bson.M{
+			"query": query,
+			"path":  path,
+		},
+	}
+}
+
+// SOCompound return the compound search operator, that combine the operators that must match, should match,
+// must not match and filter the documents without changing the score. The empty clauses are omitted
+func SOCompound(must []interface{}, should []interface{}, mustNot []interface{}, filter []interface{}) bson.M {
+	compound := bson.M{}
+	if len(must) > 0 {
+		compound["must"] = must
+	}
+	if len(should) > 0 {
+		compound["should"] = should
+	}
+	if len(mustNot) > 0 {
+		compound["mustNot"] = mustNot
+	}
+	if len(filter) > 0 {
+		compound["filter"] = filter
+	}
+
+	return bson.M{"compound": compound}
+}
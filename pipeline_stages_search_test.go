@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestKeywordSearchStages(t *testing.T) {
+	fields := []interface{}{"$hostname", "$info.os"}
+	tests := []struct {
+		name     string
+		keywords []string
+		options  KeywordSearchOptions
+		want     string
+	}{
+		{"text", []string{"red hat", `say "hi"`}, KeywordSearchOptions{Mode: SearchModeText},
+			`[{"$match": {"$text": {"$search": "\"red hat\" \"say  hi \""}}}]`},
+		{"text with score", []string{"linux"}, KeywordSearchOptions{Mode: SearchModeText, ScoreField: "score"},
+			`[{"$match": {"$text": {"$search": "\"linux\""}}},
+			{"$set": {"score": {"$meta": "textScore"}}}, {"$sort": {"score": -1}}]`},
+		{"atlas", []string{"linux", "web"}, KeywordSearchOptions{Mode: SearchModeAtlas, Index: "hosts"},
+			`[{"$search": {"index": "hosts", "compound": {"must": [
+			{"text": {"query": "linux", "path": ["hostname", "info.os"]}},
+			{"text": {"query": "web", "path": ["hostname", "info.os"]}}]}}}]`},
+		{"atlas with score on the default index", []string{"linux"}, KeywordSearchOptions{Mode: SearchModeAtlas, ScoreField: "s"},
+			`[{"$search": {"compound": {"must": [{"text": {"query": "linux", "path": ["hostname", "info.os"]}}]}}},
+			{"$set": {"s": {"$meta": "searchScore"}}}, {"$sort": {"s": -1}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, MAPipeline(APKeywordSearchStages(fields, tt.keywords, tt.options)), tt.want)
+		})
+	}
+
+	if stages := APKeywordSearchStages(fields, nil, KeywordSearchOptions{Mode: SearchModeText}); stages != nil {
+		t.Errorf("expected no stages without keywords, got %v", stages)
+	}
+}
+
+func TestKeywordSearchStagesRegexMode(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "hostname": "web1", "info": bson.M{"os": "Red Hat Linux"}},
+		{"_id": 2, "hostname": "db1", "info": bson.M{"os": "Red Hat Linux"}},
+		{"_id": 3, "hostname": "web2", "info": bson.M{"os": "Windows"}},
+	}
+	stages := APKeywordSearchStages([]interface{}{"$hostname", "$info.os"}, []string{"web", "linux"}, KeywordSearchOptions{})
+	out, err := NewMemoryEngine().Aggregate(MAPipeline(stages, APProject(bson.M{"_id": 1})), docs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSON(t, out, `[{"_id": 1}]`)
+}
+
+func TestSearchOperators(t *testing.T) {
+	tests := []struct {
+		name string
+		got  interface{}
+		want string
+	}{
+		{"search with highlight", APSearchWithHighlight("", SOAutocomplete("we", "hostname"), "hostname"),
+			`{"$search": {"autocomplete": {"query": "we", "path": "hostname"}, "highlight": {"path": "hostname"}}}`},
+		{"compound omits the empty clauses", SOCompound(nil, []interface{}{SOText("a", "*")}, nil, []interface{}{}),
+			`{"compound": {"should": [{"text": {"query": "a", "path": "*"}}]}}`},
+		{"text with options", QOTextWithOptions("linux", "", true, false),
+			`{"$text": {"$search": "linux", "$caseSensitive": true, "$diacriticSensitive": false}}`},
+		{"text with language", QOTextWithOptions("linux", "en", false, false),
+			`{"$text": {"$search": "linux", "$language": "en", "$caseSensitive": false, "$diacriticSensitive": false}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, tt.got, tt.want)
+		})
+	}
+}
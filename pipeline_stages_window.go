@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// WindowUnbounded is the bound of a window that extends to the first or the last document of the partition
+	WindowUnbounded = "unbounded"
+	// WindowCurrent is the bound of a window at the current document
+	WindowCurrent = "current"
+)
+
+// APWindowDocuments return a window of the documents between the lower and the upper positions relative to the current
+// document, like -2, WindowCurrent or WindowUnbounded
+func APWindowDocuments(lower interface{}, upper interface{}) bson.M {
+	return bson.M{"documents": bson.A{lower, upper}}
+}
+
+// APWindowRange return a window of the documents with the sortBy field between the lower and the upper offsets
+// from the value of the current document. The offsets are measured in the unit, like day, if not empty
+func APWindowRange(lower interface{}, upper interface{}, unit string) bson.M {
+	window := bson.M{"range": bson.A{lower, upper}}
+	if unit != "" {
+		window["unit"] = unit
+	}
+	return window
+}
+
+// APOOverWindow return the window function, like APOSum, EIntegral or a bson.D, applied over the window,
+// or nil if the function isn't a document
+func APOOverWindow(function interface{}, window bson.M) interface{} {
+	switch f := function.(type) {
+	case Expr:
+		return APOOverWindow(f.Bson(), window)
+	case bson.M:
+		out := bson.M{}
+		for k, v := range f {
+			out[k] = v
+		}
+		out["window"] = window
+		return out
+	case map[string]interface{}:
+		return APOOverWindow(bson.M(f), window)
+	case bson.D:
+		out := make(bson.D, 0, len(f)+1)
+		for _, e := range f {
+			if e.Key != "window" {
+				out = append(out, e)
+			}
+		}
+		return append(out, bson.E{Key: "window", Value: window})
+	}
+	return nil
+}
+
+// APMovingAverageStage return a stage that set outputFieldName to the average of input over the current document
+// and the n-1 previous ones, sorted by sortBy in the partition. partitionBy is omitted if nil.
+// n must be at least 1
+func APMovingAverageStage(partitionBy interface{}, sortBy interface{}, input interface{}, n int, outputFieldName string) (interface{}, error) {
+	if n < 1 {
+		return nil, errors.New("the moving average size must be positive")
+	}
+
+	return windowFieldStage(partitionBy, sortBy, outputFieldName, APOAvg(input), APWindowDocuments(1-n, WindowCurrent))
+}
+
+// APRunningTotalStage return a stage that set outputFieldName to the sum of input over the documents up to the
+// current one, sorted by sortBy in the partition. partitionBy is omitted if nil
+func APRunningTotalStage(partitionBy interface{}, sortBy interface{}, input interface{}, outputFieldName string) (interface{}, error) {
+	return windowFieldStage(partitionBy, sortBy, outputFieldName, APOSum(input), APWindowDocuments(WindowUnbounded, WindowCurrent))
+}
+
+// windowFieldStage return a stage that set outputFieldName to the function applied over the window.
+// It return a error instead of a null output if APOOverWindow can't apply the function
+func windowFieldStage(partitionBy interface{}, sortBy interface{}, outputFieldName string, function interface{}, window bson.M) (interface{}, error) {
+	output := APOOverWindow(function, window)
+	if output == nil {
+		return nil, errors.New("the window function must be a document")
+	}
+
+	return APSetWindowFields(partitionBy, sortBy, bson.M{outputFieldName: output}), nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testWindowDocs contains two partitions of a series sorted by t
+var testWindowDocs = []bson.M{
+	{"_id": 1, "host": "a", "t": 1, "v": 10},
+	{"_id": 2, "host": "a", "t": 2, "v": 20},
+	{"_id": 3, "host": "a", "t": 3, "v": 20},
+	{"_id": 4, "host": "a", "t": 4, "v": 50},
+	{"_id": 5, "host": "b", "t": 1, "v": 5},
+	{"_id": 6, "host": "b", "t": 2, "v": 7},
+}
+
+func TestMovingAverageAndRunningTotalStages(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"size 1", 1, `[{"avg": 10.0, "total": 10}, {"avg": 20.0, "total": 30}, {"avg": 20.0, "total": 50}, {"avg": 50.0, "total": 100},
+			{"avg": 5.0, "total": 5}, {"avg": 7.0, "total": 12}]`},
+		{"size 2", 2, `[{"avg": 10.0, "total": 10}, {"avg": 15.0, "total": 30}, {"avg": 20.0, "total": 50}, {"avg": 35.0, "total": 100},
+			{"avg": 5.0, "total": 5}, {"avg": 6.0, "total": 12}]`},
+		{"larger than the partitions", 10, `[{"avg": 10.0, "total": 10}, {"avg": 15.0, "total": 30}, {"avg": 16.666666666666668, "total": 50},
+			{"avg": 25.0, "total": 100}, {"avg": 5.0, "total": 5}, {"avg": 6.0, "total": 12}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			average, err := APMovingAverageStage("$host", bson.M{"t": 1}, "$v", tt.n, "avg")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			total, err := APRunningTotalStage("$host", bson.M{"t": 1}, "$v", "total")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out := mustAggregate(t, MAPipeline(
+				average,
+				total,
+				APSort(bson.M{"_id": 1}),
+				APProject(bson.M{"_id": 0, "avg": 1, "total": 1}),
+			), testWindowDocs)
+			assertJSON(t, out, tt.want)
+		})
+	}
+
+	for _, n := range []int{0, -1} {
+		if _, err := APMovingAverageStage(nil, bson.M{"t": 1}, "$v", n, "avg"); err == nil {
+			t.Errorf("expected a error for the size %d", n)
+		}
+	}
+	if _, err := windowFieldStage(nil, bson.M{"t": 1}, "total", "$v", APWindowDocuments(WindowUnbounded, WindowCurrent)); err == nil {
+		t.Error("expected a error for a window function that isn't a document")
+	}
+}
+
+func TestOverWindow(t *testing.T) {
+	window := APWindowDocuments(-1, WindowCurrent)
+	tests := []struct {
+		name     string
+		function interface{}
+		want     string
+	}{
+		{"bson.M", APOSum("$v"), `{"$sum": "$v", "window": {"documents": [-1, "current"]}}`},
+		{"bson.D", bson.D{{Key: "$max", Value: "$v"}, {Key: "window", Value: bson.M{}}}, `{"$max": "$v", "window": {"documents": [-1, "current"]}}`},
+		{"typed expression", EIntegral(FieldRef("v"), ""), `{"$integral": {"input": "$v"}, "window": {"documents": [-1, "current"]}}`},
+		{"not a document", "$v", `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, APOOverWindow(tt.function, window), tt.want)
+		})
+	}
+}
+
+func TestWindowFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		function interface{}
+		sortBy   string
+		want     string
+	}{
+		{"rank", ERank(), "v", `[1, 2, 2, 4, 1, 2]`},
+		{"dense rank", EDenseRank(), "v", `[1, 2, 2, 3, 1, 2]`},
+		{"document number", EDocumentNumber(), "v", `[1, 2, 3, 4, 1, 2]`},
+		{"shift", EShift(FieldRef("v"), 1, Lit(-1)), "v", `[20, 20, 50, -1, 7, -1]`},
+		{"shift without default", EShift(FieldRef("v"), -1, nil), "v", `[null, 10, 20, 20, null, 5]`},
+		{"exponential moving average", EExpMovingAvg(FieldRef("v"), 3), "t", `[10.0, 15.0, 17.5, 33.75, 5.0, 6.0]`},
+		{"exponential moving average alpha", EExpMovingAvgAlpha(FieldRef("v"), 0.5), "t", `[10.0, 15.0, 17.5, 33.75, 5.0, 6.0]`},
+		{"derivative", APOOverWindow(EDerivative(FieldRef("v"), ""), APWindowDocuments(-1, WindowCurrent)), "t",
+			`[null, 10.0, 0.0, 30.0, null, 2.0]`},
+		{"integral", APOOverWindow(EIntegral(FieldRef("v"), ""), APWindowDocuments(WindowUnbounded, WindowCurrent)), "t",
+			`[0.0, 15.0, 35.0, 70.0, 0.0, 6.0]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustAggregate(t, MAPipeline(
+				APSetWindowFields("$host", bson.M{tt.sortBy: 1}, bson.M{"out": tt.function}),
+				APSort(bson.M{"_id": 1}),
+				APGroup(bson.M{"_id": nil, "out": APOPush("$out")}),
+			), testWindowDocs)
+			assertJSON(t, docGet(out[0], "out"), tt.want)
+		})
+	}
+}
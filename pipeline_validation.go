@@ -0,0 +1,652 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ValidationError is the error returned by Validate. It contains the path of the offending element, like stage[3].$facet.content[1]
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+// Error return the path and the message of the error
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Validate return a *ValidationError if the pipeline, built for example with MAPipeline, isn't well formed.
+// It check that every stage is known and well placed and that every expression operator is known and has the right arguments
+func Validate(pipeline bson.A) error {
+	normalized, err := normalizePipeline(pipeline)
+	if err != nil {
+		return &ValidationError{Path: "pipeline", Message: err.Error()}
+	}
+
+	return validatePipeline("", normalized, pipelineContext{})
+}
+
+// pipelineContext describe where a pipeline is nested
+type pipelineContext struct {
+	inFacet  bool
+	inLookup bool
+}
+
+// stageValidator validate the argument of a stage
+type stageValidator func(path string, arg interface{}, ctx pipelineContext) error
+
+// stagePlacement describe the constraints on the position of a stage
+type stagePlacement int
+
+const (
+	anywhere stagePlacement = iota
+	firstOnly
+	lastOnly
+)
+
+// stageSpec describe a pipeline stage
+type stageSpec struct {
+	validate  stageValidator
+	placement stagePlacement
+	// nestable is false for the stages that can't be used inside $facet and $lookup
+	nestable bool
+}
+
+// knownStages contains the known pipeline stages
+var knownStages map[string]stageSpec
+
+func init() {
+	knownStages = map[string]stageSpec{
+		"$match":           {validateMatchStage, anywhere, true},
+		"$sort":            {validateSortStage, anywhere, true},
+		"$skip":            {validateNonNegativeIntegerStage, anywhere, true},
+		"$limit":           {validatePositiveIntegerStage, anywhere, true},
+		"$project":         {validateProjectStage, anywhere, true},
+		"$set":             {validateAddFieldsStage, anywhere, true},
+		"$addFields":       {validateAddFieldsStage, anywhere, true},
+		"$unset":           {validateUnsetStage, anywhere, true},
+		"$unwind":          {validateUnwindStage, anywhere, true},
+		"$group":           {validateGroupStage, anywhere, true},
+		"$facet":           {validateFacetStage, anywhere, false},
+		"$count":           {validateCountStage, anywhere, true},
+		"$replaceWith":     {validateExpressionStage, anywhere, true},
+		"$replaceRoot":     {validateReplaceRootStage, anywhere, true},
+		"$lookup":          {validateLookupStage, anywhere, true},
+		"$out":             {nil, lastOnly, false},
+		"$merge":           {nil, lastOnly, false},
+		"$bucket":          {nil, anywhere, true},
+		"$bucketAuto":      {nil, anywhere, true},
+		"$sortByCount":     {validateExpressionStage, anywhere, true},
+		"$sample":          {nil, anywhere, true},
+		"$redact":          {validateExpressionStage, anywhere, true},
+		"$graphLookup":     {nil, anywhere, true},
+		"$unionWith":       {nil, anywhere, true},
+		"$setWindowFields": {nil, anywhere, true},
+		"$densify":         {nil, anywhere, true},
+		"$fill":            {nil, anywhere, true},
+		"$geoNear":         {nil, firstOnly, false},
+		"$collStats":       {nil, firstOnly, false},
+		"$indexStats":      {nil, firstOnly, false},
+		"$search":          {nil, firstOnly, false},
+		"$searchMeta":      {nil, firstOnly, false},
+		"$documents":       {nil, firstOnly, true},
+		"$currentOp":       {nil, firstOnly, false},
+		"$listSessions":    {nil, firstOnly, false},
+		"$planCacheStats":  {nil, firstOnly, false},
+	}
+}
+
+// validationErrorf return a *ValidationError with the path and the formatted message
+func validationErrorf(path string, format string, args ...interface{}) error {
+	return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// joinPath return the path of the key inside the element at path
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// validatePipeline validate the stages of the pipeline at path
+func validatePipeline(path string, stages bson.A, ctx pipelineContext) error {
+	for i, s := range stages {
+		stagePath := fmt.Sprintf("stage[%d]", i)
+		if path != "" {
+			stagePath = fmt.Sprintf("%s[%d]", path, i)
+		}
+
+		stage, ok := s.(bson.D)
+		if !ok {
+			return validationErrorf(stagePath, "a pipeline stage must be a document, found %s", typeName(s))
+		}
+		if len(stage) != 1 {
+			return validationErrorf(stagePath, "a pipeline stage must contain exactly one field, found %d", len(stage))
+		}
+
+		name := stage[0].Key
+		spec, ok := knownStages[name]
+		if !ok {
+			if _, isOperator := expressionOperators[name]; isOperator {
+				return validationErrorf(stagePath, "%s is an expression operator, not a pipeline stage", name)
+			}
+			return validationErrorf(stagePath, "unrecognized pipeline stage name: %s", name)
+		}
+
+		switch {
+		case spec.placement == firstOnly && i != 0:
+			return validationErrorf(stagePath, "%s is only valid as the first stage in a pipeline", name)
+		case spec.placement == lastOnly && i != len(stages)-1:
+			return validationErrorf(stagePath, "%s can only be the final stage in the pipeline", name)
+		case !spec.nestable && ctx.inFacet:
+			return validationErrorf(stagePath, "%s is not allowed to be used within a $facet stage", name)
+		case !spec.nestable && ctx.inLookup && name != "$facet":
+			return validationErrorf(stagePath, "%s is not allowed to be used within a $lookup stage", name)
+		}
+
+		if spec.validate != nil {
+			if err := spec.validate(joinPath(stagePath, name), stage[0].Value, ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateMatchStage validate the filter of a $match stage
+func validateMatchStage(path string, arg interface{}, ctx pipelineContext) error {
+	return validateQuery(path, arg)
+}
+
+// validateSortStage validate the specification of a $sort stage
+func validateSortStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) == 0 {
+		return validationErrorf(path, "the $sort key specification must be a non-empty object")
+	}
+	for _, e := range spec {
+		if meta, ok := e.Value.(bson.D); ok && len(meta) == 1 && meta[0].Key == "$meta" {
+			continue
+		}
+		if n, ok := toInt64(e.Value); !ok || (n != 1 && n != -1) {
+			return validationErrorf(joinPath(path, e.Key), "$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+	}
+	return nil
+}
+
+// validateNonNegativeIntegerStage validate the argument of the $skip stage
+func validateNonNegativeIntegerStage(path string, arg interface{}, ctx pipelineContext) error {
+	if n, ok := toInt64(arg); !ok || n < 0 {
+		return validationErrorf(path, "the argument must be a non-negative integer, found %v", arg)
+	}
+	return nil
+}
+
+// validatePositiveIntegerStage validate the argument of a stage like $limit, that must be a positive integer
+func validatePositiveIntegerStage(path string, arg interface{}, ctx pipelineContext) error {
+	if n, ok := toInt64(arg); !ok || n <= 0 {
+		return validationErrorf(path, "the argument must be a positive integer, found %v", arg)
+	}
+	return nil
+}
+
+// validateProjectStage validate the specification of a $project stage
+func validateProjectStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) == 0 {
+		return validationErrorf(path, "$project specification must be a non-empty object")
+	}
+
+	inclusion, exclusion := false, false
+	for _, e := range flattenProjection(spec, "") {
+		if err := validateFieldName(path, e.Key); err != nil {
+			return err
+		}
+		flag, isFlag := isInclusionFlag(e.Value)
+		switch {
+		case isFlag && !flag && e.Key != "_id":
+			exclusion = true
+		case !isFlag:
+			if err := validateExpression(joinPath(path, e.Key), e.Value); err != nil {
+				return err
+			}
+			inclusion = true
+		case flag:
+			inclusion = true
+		}
+	}
+	if inclusion && exclusion {
+		return validationErrorf(path, "cannot do exclusion and inclusion in the same projection")
+	}
+
+	return nil
+}
+
+// validateAddFieldsStage validate the specification of the $set and $addFields stages
+func validateAddFieldsStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return validationErrorf(path, "the specification must be an object, found %s", typeName(arg))
+	}
+	for _, e := range spec {
+		if err := validateFieldName(path, e.Key); err != nil {
+			return err
+		}
+		if err := validateExpression(joinPath(path, e.Key), e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateFieldName validate the name, that could be a dotted path, of a field set by the stage at path
+func validateFieldName(path string, name string) error {
+	if name == "" {
+		return validationErrorf(path, "the field name cannot be empty")
+	}
+	for _, part := range strings.Split(name, ".") {
+		switch {
+		case part == "":
+			return validationErrorf(joinPath(path, name), "the field path cannot contain an empty component")
+		case strings.HasPrefix(part, "$"):
+			return validationErrorf(joinPath(path, name), "the field path cannot contain a component starting with $")
+		}
+	}
+	return nil
+}
+
+// validateUnsetStage validate the specification of a $unset stage
+func validateUnsetStage(path string, arg interface{}, ctx pipelineContext) error {
+	fields, ok := arg.(bson.A)
+	if !ok {
+		fields = bson.A{arg}
+	}
+	if len(fields) == 0 {
+		return validationErrorf(path, "$unset specification must be a string or an array with at least one field")
+	}
+	for i, f := range fields {
+		if s, ok := f.(string); !ok || s == "" || strings.HasPrefix(s, "$") {
+			return validationErrorf(fmt.Sprintf("%s[%d]", path, i), "$unset specification must be a non-empty field name without $")
+		}
+	}
+	return nil
+}
+
+// validateUnwindStage validate the specification of a $unwind stage
+func validateUnwindStage(path string, arg interface{}, ctx pipelineContext) error {
+	p := arg
+	if spec, ok := arg.(bson.D); ok {
+		p = docGet(spec, "path")
+		path = joinPath(path, "path")
+	}
+	if s, ok := p.(string); !ok || !strings.HasPrefix(s, "$") || len(s) < 2 {
+		return validationErrorf(path, "path option to $unwind stage should be prefixed with a '$'")
+	}
+	return nil
+}
+
+// validateGroupStage validate the specification of a $group stage
+func validateGroupStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return validationErrorf(path, "a group's fields must be specified in an object")
+	}
+	if isMissing(docGet(spec, "_id")) {
+		return validationErrorf(path, "a group specification must include an _id")
+	}
+
+	for _, e := range spec {
+		if e.Key == "_id" {
+			if err := validateExpression(joinPath(path, e.Key), e.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := validateAccumulator(joinPath(path, e.Key), e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// knownAccumulators contains the accumulators allowed in $group and in the window functions
+var knownAccumulators = map[string]bool{
+	"$sum": true, "$avg": true, "$min": true, "$max": true, "$first": true, "$last": true, "$push": true,
+	"$addToSet": true, "$mergeObjects": true, "$stdDevPop": true, "$stdDevSamp": true, "$count": true,
+	"$accumulator": true, "$top": true, "$bottom": true, "$topN": true, "$bottomN": true,
+	"$firstN": true, "$lastN": true, "$maxN": true, "$minN": true,
+}
+
+// validateAccumulator validate a accumulator object, like {$sum: 1}
+func validateAccumulator(path string, acc interface{}) error {
+	doc, ok := acc.(bson.D)
+	if !ok || len(doc) != 1 || !strings.HasPrefix(doc[0].Key, "$") {
+		return validationErrorf(path, "the field must be an accumulator object")
+	}
+	if !knownAccumulators[doc[0].Key] {
+		return validationErrorf(path, "unknown group operator '%s'", doc[0].Key)
+	}
+	if doc[0].Key == "$count" {
+		if arg, ok := doc[0].Value.(bson.D); !ok || len(arg) != 0 {
+			return validationErrorf(joinPath(path, "$count"), "$count takes no arguments, i.e. $count:{}")
+		}
+		return nil
+	}
+	return validateExpression(joinPath(path, doc[0].Key), doc[0].Value)
+}
+
+// validateFacetStage validate the sub-pipelines of a $facet stage
+func validateFacetStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) == 0 {
+		return validationErrorf(path, "the $facet specification must be a non-empty object")
+	}
+	for _, f := range spec {
+		pipeline, ok := f.Value.(bson.A)
+		if !ok {
+			return validationErrorf(joinPath(path, f.Key), "a facet must be an array of stages, found %s", typeName(f.Value))
+		}
+		if err := validatePipeline(joinPath(path, f.Key), pipeline, pipelineContext{inFacet: true, inLookup: ctx.inLookup}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCountStage validate the field name of a $count stage
+func validateCountStage(path string, arg interface{}, ctx pipelineContext) error {
+	field, ok := arg.(string)
+	if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+		return validationErrorf(path, "the count field must be a non-empty string without $ and dots")
+	}
+	return nil
+}
+
+// validateExpressionStage validate a stage whose argument is a expression
+func validateExpressionStage(path string, arg interface{}, ctx pipelineContext) error {
+	return validateExpression(path, arg)
+}
+
+// validateReplaceRootStage validate the specification of a $replaceRoot stage
+func validateReplaceRootStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok || len(spec) != 1 || spec[0].Key != "newRoot" {
+		return validationErrorf(path, "$replaceRoot requires exactly the 'newRoot' field")
+	}
+	return validateExpression(joinPath(path, "newRoot"), spec[0].Value)
+}
+
+// validateLookupStage validate the specification of a $lookup stage
+func validateLookupStage(path string, arg interface{}, ctx pipelineContext) error {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return validationErrorf(path, "the $lookup specification must be an object")
+	}
+
+	for _, e := range spec {
+		switch e.Key {
+		case "from", "as", "localField", "foreignField":
+			if s, ok := e.Value.(string); !ok || s == "" {
+				return validationErrorf(joinPath(path, e.Key), "%s must be a non-empty string", e.Key)
+			}
+		case "let":
+			vars, ok := e.Value.(bson.D)
+			if !ok {
+				return validationErrorf(joinPath(path, e.Key), "let must be an object")
+			}
+			for _, v := range vars {
+				if err := validateExpression(joinPath(joinPath(path, e.Key), v.Key), v.Value); err != nil {
+					return err
+				}
+			}
+		case "pipeline":
+			pipeline, ok := e.Value.(bson.A)
+			if !ok {
+				return validationErrorf(joinPath(path, e.Key), "pipeline must be an array of stages")
+			}
+			if err := validatePipeline(joinPath(path, e.Key), pipeline, pipelineContext{inFacet: ctx.inFacet, inLookup: true}); err != nil {
+				return err
+			}
+		default:
+			return validationErrorf(joinPath(path, e.Key), "unknown argument to $lookup: %s", e.Key)
+		}
+	}
+
+	if isMissing(docGet(spec, "as")) {
+		return validationErrorf(path, "must specify 'as' field for a $lookup")
+	}
+	if isMissing(docGet(spec, "localField")) != isMissing(docGet(spec, "foreignField")) {
+		return validationErrorf(path, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	}
+	if isMissing(docGet(spec, "localField")) && isMissing(docGet(spec, "pipeline")) {
+		return validationErrorf(path, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	}
+
+	return nil
+}
+
+// knownQueryOperators contains the known field query operators
+var knownQueryOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$in": true, "$nin": true,
+	"$exists": true, "$type": true, "$regex": true, "$options": true, "$all": true, "$elemMatch": true,
+	"$size": true, "$not": true, "$mod": true, "$bitsAllSet": true, "$bitsAllClear": true, "$bitsAnySet": true,
+	"$bitsAnyClear": true, "$geoWithin": true, "$geoIntersects": true, "$near": true, "$nearSphere": true,
+	"$maxDistance": true, "$minDistance": true,
+}
+
+// validateQuery validate a query filter
+func validateQuery(path string, filter interface{}) error {
+	doc, ok := filter.(bson.D)
+	if !ok {
+		return validationErrorf(path, "the query filter must be an object, found %s", typeName(filter))
+	}
+
+	for _, e := range doc {
+		p := joinPath(path, e.Key)
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			conds, ok := e.Value.(bson.A)
+			if !ok || len(conds) == 0 {
+				return validationErrorf(p, "%s must be a nonempty array", e.Key)
+			}
+			for i, c := range conds {
+				if err := validateQuery(fmt.Sprintf("%s[%d]", p, i), c); err != nil {
+					return err
+				}
+			}
+		case "$expr":
+			if err := validateExpression(p, e.Value); err != nil {
+				return err
+			}
+		case "$text", "$where", "$comment", "$jsonSchema", "$sampleRate":
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return validationErrorf(p, "unknown top level operator: %s", e.Key)
+			}
+			if !isOperatorDocument(e.Value) {
+				continue
+			}
+			for _, op := range e.Value.(bson.D) {
+				if !knownQueryOperators[op.Key] {
+					return validationErrorf(joinPath(p, op.Key), "unknown operator: %s", op.Key)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// operatorArity describe the number of arguments of a expression operator in the array form.
+// A max of -1 means unlimited arguments
+type operatorArity struct {
+	min int
+	max int
+}
+
+// expressionArities contains the arities of the expression operators that take a array of arguments
+var expressionArities = map[string]operatorArity{
+	"$subtract": {2, 2}, "$divide": {2, 2}, "$mod": {2, 2}, "$pow": {2, 2}, "$log": {2, 2},
+	"$eq": {2, 2}, "$ne": {2, 2}, "$gt": {2, 2}, "$gte": {2, 2}, "$lt": {2, 2}, "$lte": {2, 2}, "$cmp": {2, 2},
+	"$arrayElemAt": {2, 2}, "$split": {2, 2}, "$in": {2, 2}, "$setDifference": {2, 2}, "$setIsSubset": {2, 2},
+	"$strcasecmp": {2, 2}, "$cond": {3, 3}, "$substrCP": {3, 3}, "$substr": {3, 3}, "$substrBytes": {3, 3},
+	"$ifNull": {2, -1}, "$indexOfCP": {2, 4}, "$indexOfBytes": {2, 4}, "$indexOfArray": {2, 4}, "$range": {2, 3},
+	"$slice": {2, 3}, "$round": {1, 2}, "$trunc": {1, 2},
+	"$not": {1, 1}, "$size": {1, 1}, "$floor": {1, 1}, "$ceil": {1, 1}, "$abs": {1, 1}, "$sqrt": {1, 1},
+	"$exp": {1, 1}, "$ln": {1, 1}, "$log10": {1, 1}, "$type": {1, 1}, "$isArray": {1, 1},
+	"$strLenCP": {1, 1}, "$strLenBytes": {1, 1}, "$toLower": {1, 1}, "$toUpper": {1, 1},
+	"$objectToArray": {1, 1}, "$arrayToObject": {1, 1}, "$reverseArray": {1, 1},
+	"$toDouble": {1, 1}, "$toInt": {1, 1}, "$toLong": {1, 1}, "$toDecimal": {1, 1}, "$toString": {1, 1},
+	"$toBool": {1, 1}, "$toDate": {1, 1}, "$toObjectId": {1, 1}, "$isNumber": {1, 1},
+	"$anyElementTrue": {1, 1}, "$allElementsTrue": {1, 1},
+}
+
+// namedOperatorArgs contains the required and the optional arguments of the expression operators that take a document of arguments
+var namedOperatorArgs = map[string][2][]string{
+	"$cond":           {{"if", "then", "else"}, nil},
+	"$let":            {{"vars", "in"}, nil},
+	"$map":            {{"input", "in"}, {"as"}},
+	"$filter":         {{"input", "cond"}, {"as", "limit"}},
+	"$reduce":         {{"input", "initialValue", "in"}, nil},
+	"$regexMatch":     {{"input", "regex"}, {"options"}},
+	"$regexFind":      {{"input", "regex"}, {"options"}},
+	"$regexFindAll":   {{"input", "regex"}, {"options"}},
+	"$convert":        {{"input", "to"}, {"onError", "onNull"}},
+	"$dateFromString": {{"dateString"}, {"format", "timezone", "onError", "onNull"}},
+	"$dateToString":   {{"date"}, {"format", "timezone", "onNull"}},
+	"$trim":           {{"input"}, {"chars"}},
+	"$ltrim":          {{"input"}, {"chars"}},
+	"$rtrim":          {{"input"}, {"chars"}},
+	"$switch":         {{"branches"}, {"default"}},
+	"$dateTrunc":      {{"date", "unit"}, {"binSize", "timezone", "startOfWeek"}},
+	"$dateAdd":        {{"startDate", "unit", "amount"}, {"timezone"}},
+	"$dateSubtract":   {{"startDate", "unit", "amount"}, {"timezone"}},
+	"$dateDiff":       {{"startDate", "endDate", "unit"}, {"timezone", "startOfWeek"}},
+	"$replaceOne":     {{"input", "find", "replacement"}, nil},
+	"$replaceAll":     {{"input", "find", "replacement"}, nil},
+	"$zip":            {{"inputs"}, {"useLongestLength", "defaults"}},
+}
+
+// otherExpressionOperators contains the known expression operators that the memory engine doesn't evaluate
+var otherExpressionOperators = map[string]bool{
+	"$pow": true, "$log": true, "$sqrt": true, "$exp": true, "$ln": true, "$log10": true, "$round": true,
+	"$trunc": true, "$setDifference": true, "$setIsSubset": true, "$setIntersection": true, "$setEquals": true,
+	"$strcasecmp": true, "$substr": true, "$substrBytes": true, "$indexOfBytes": true, "$indexOfArray": true,
+	"$strLenBytes": true, "$reverseArray": true, "$isNumber": true, "$anyElementTrue": true,
+	"$allElementsTrue": true, "$dateAdd": true, "$dateSubtract": true, "$dateDiff": true, "$replaceOne": true,
+	"$replaceAll": true, "$zip": true, "$year": true, "$month": true, "$week": true, "$dayOfMonth": true,
+	"$dayOfWeek": true, "$dayOfYear": true, "$hour": true, "$minute": true, "$second": true, "$millisecond": true,
+	"$isoWeek": true, "$isoWeekYear": true, "$isoDayOfWeek": true, "$meta": true, "$rand": true, "$getField": true,
+	"$setField": true, "$function": true, "$binarySize": true, "$bsonSize": true, "$stdDevPop": true,
+	"$stdDevSamp": true, "$sortArray": true, "$firstN": true, "$lastN": true, "$maxN": true, "$minN": true,
+	"$sin": true, "$cos": true, "$tan": true, "$asin": true, "$acos": true, "$atan": true, "$atan2": true,
+	"$degreesToRadians": true, "$radiansToDegrees": true, "$toHashedIndexKey": true, "$tsSecond": true,
+	"$tsIncrement": true,
+}
+
+// validateExpression validate a aggregation expression
+func validateExpression(path string, expr interface{}) error {
+	switch e := expr.(type) {
+	case bson.A:
+		for i, item := range e {
+			if err := validateExpression(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case bson.D:
+		if len(e) == 0 || !strings.HasPrefix(e[0].Key, "$") {
+			for _, item := range e {
+				if strings.HasPrefix(item.Key, "$") {
+					return validationErrorf(joinPath(path, item.Key), "field names can't start with $ in a object expression")
+				}
+				if err := validateExpression(joinPath(path, item.Key), item.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if len(e) != 1 {
+			return validationErrorf(path, "an expression specification must contain exactly one field, the name of the expression. Found %d fields", len(e))
+		}
+		return validateOperator(joinPath(path, e[0].Key), e[0].Key, e[0].Value)
+	}
+
+	return nil
+}
+
+// validateOperator validate the args of the expression operator name
+func validateOperator(path string, name string, args interface{}) error {
+	_, evaluable := expressionOperators[name]
+	if !evaluable && !otherExpressionOperators[name] {
+		if _, isStage := knownStages[name]; isStage {
+			return validationErrorf(path, "%s is a pipeline stage and can't be used inside an expression", name)
+		}
+		return validationErrorf(path, "unrecognized expression operator: %s", name)
+	}
+	if name == "$literal" {
+		return nil
+	}
+
+	if named, ok := namedOperatorArgs[name]; ok {
+		if doc, isDoc := args.(bson.D); isDoc {
+			for _, e := range doc {
+				if !containsString(named[0], e.Key) && !containsString(named[1], e.Key) {
+					return validationErrorf(joinPath(path, e.Key), "%s found an unknown argument: %s", name, e.Key)
+				}
+			}
+			for _, r := range named[0] {
+				if isMissing(docGet(doc, r)) {
+					return validationErrorf(path, "missing '%s' parameter to %s", r, name)
+				}
+			}
+			for _, e := range doc {
+				if err := validateExpression(joinPath(path, e.Key), e.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if _, hasArrayForm := expressionArities[name]; !hasArrayForm {
+			return validationErrorf(path, "%s expects an object as its argument", name)
+		}
+	}
+
+	if arity, ok := expressionArities[name]; ok {
+		n := 1
+		if list, isList := args.(bson.A); isList {
+			n = len(list)
+		}
+		if n < arity.min || (arity.max >= 0 && n > arity.max) {
+			switch {
+			case arity.min == arity.max:
+				return validationErrorf(path, "expression %s takes exactly %d arguments. %d were passed in", name, arity.min, n)
+			case arity.max < 0:
+				return validationErrorf(path, "expression %s takes at least %d arguments. %d were passed in", name, arity.min, n)
+			}
+			return validationErrorf(path, "expression %s takes between %d and %d arguments. %d were passed in", name, arity.min, arity.max, n)
+		}
+	}
+
+	return validateExpression(path, args)
+}
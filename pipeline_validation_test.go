@@ -0,0 +1,96 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestValidateValidPipelines(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline bson.A
+	}{
+		{"nil", nil},
+		{"empty", MAPipeline()},
+		{"paging", MAPipeline(APMatch(bson.M{"os": "linux"}), APOptionalSortingStage("name", true), APOptionalPagingStage(1, 10))},
+		{"search and group", MAPipeline(
+			APSearchFilterStage([]interface{}{"$hostname"}, []string{"web"}),
+			APGroupAndCountStages("os", "count", "$os"),
+		)},
+		{"facet", MAPipeline(APFacet(bson.M{"count": MAPipeline(APCount("n"))}))},
+		{"lookup pipeline", MAPipeline(APLookupPipeline("alerts", bson.M{"h": "$hostname"}, "alerts", MAPipeline(
+			APMatch(bson.M{"$expr": APOEqual("$host", "$$h")}),
+		)))},
+		{"out last", bson.A{bson.M{"$match": bson.M{}}, bson.M{"$out": "results"}}},
+		{"dotted set", MAPipeline(APSet(bson.M{"info.os": "linux"}))},
+		{"zero skip", MAPipeline(APSkip(0), APLimit(1))},
+		{"date histogram", MAPipeline(APDateHistogramEmulatedStages("$date", DateUnitWeek, "", "label", "count", nil))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.pipeline); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateInvalidPipelines(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline bson.A
+		wantPath string
+	}{
+		{"stage not a document", bson.A{"$match"}, "stage[0]"},
+		{"two keys", bson.A{bson.D{{Key: "$match", Value: bson.M{}}, {Key: "$limit", Value: 1}}}, "stage[0]"},
+		{"unknown stage", MAPipeline(APMatch(bson.M{}), bson.M{"$foo": 1}), "stage[1]"},
+		{"operator as stage", bson.A{bson.M{"$add": bson.A{1, 2}}}, "stage[0]"},
+		{"subtract arity", MAPipeline(APSet(bson.M{"a": bson.M{"$subtract": bson.A{1, 2, 3}}})), "stage[0].$set.a.$subtract"},
+		{"divide arity", MAPipeline(APProject(bson.M{"a": bson.M{"$divide": bson.A{1}}})), "stage[0].$project.a.$divide"},
+		{"cond without else", MAPipeline(APSet(bson.M{"a": bson.M{"$cond": bson.M{"if": true, "then": 1}}})), "stage[0].$set.a.$cond"},
+		{"count inside a expression", MAPipeline(APSet(bson.M{"a": bson.M{"$count": "n"}})), "stage[0].$set.a.$count"},
+		{"out not last", bson.A{bson.M{"$out": "results"}, bson.M{"$match": bson.M{}}}, "stage[0]"},
+		{"nested in facet", MAPipeline(APFacet(bson.M{"content": MAPipeline(APMatch(bson.M{}), bson.M{"$limit": -1})})),
+			"stage[0].$facet.content[1].$limit"},
+		{"negative skip", MAPipeline(APSkip(-1)), "stage[0].$skip"},
+		{"zero limit", MAPipeline(APLimit(0)), "stage[0].$limit"},
+		{"bad sort", MAPipeline(APSort(bson.M{"a": 2})), "stage[0].$sort.a"},
+		{"empty set field", MAPipeline(APSet(bson.M{"": 1})), "stage[0].$set"},
+		{"set field with $", MAPipeline(APSet(bson.M{"a.$b": 1})), "stage[0].$set.a.$b"},
+		{"empty project field", MAPipeline(APProject(bson.M{"a..b": 1})), "stage[0].$project.a..b"},
+		{"mixed projection", MAPipeline(APProject(bson.M{"a": 1, "b": 0})), "stage[0].$project"},
+		{"group without id", MAPipeline(APGroup(bson.M{"n": APOSum(1)})), "stage[0].$group"},
+		{"unknown accumulator", MAPipeline(APGroup(bson.M{"_id": nil, "n": bson.M{"$foo": 1}})), "stage[0].$group.n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.pipeline)
+			if err == nil {
+				t.Fatal("expected a error")
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("expected a *ValidationError, got %T", err)
+			}
+			if verr.Path != tt.wantPath {
+				t.Errorf("got path %s, want %s (%v)", verr.Path, tt.wantPath, verr)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Filter is a builder of query filters that keep the conditions in the order they are added.
+// The conditions on the same field are merged in a single document of operators, like {age: {$gt: 18, $lt: 65}},
+// and the conditions that can't be merged, like two $elemMatch or two different equalities, are added to a $and
+type Filter struct {
+	conditions bson.D
+}
+
+// NewFilter return a empty filter, that match all the documents
+func NewFilter() *Filter {
+	return &Filter{conditions: bson.D{}}
+}
+
+// Where add the condition on the field, that is a value to compare for equality or a operator like QOGreaterThan.
+// The operators are stored as a ordered document, so the filter is stable
+func (f *Filter) Where(field string, condition interface{}) *Filter {
+	ops, isOperators := filterOperators(condition)
+	if isOperators {
+		condition = ops
+	} else {
+		ops = bson.D{{Key: "$eq", Value: condition}}
+	}
+
+	for i, e := range f.conditions {
+		if e.Key != field {
+			continue
+		}
+		current, isCurrentOperators := filterOperators(e.Value)
+		if !isCurrentOperators {
+			if !isOperators && filterValuesEqual(e.Value, condition) {
+				return f
+			}
+			current = bson.D{{Key: "$eq", Value: e.Value}}
+		}
+		if merged, ok := mergeFilterOperators(current, ops); ok {
+			f.conditions[i].Value = merged
+			return f
+		}
+		return f.and(bson.D{{Key: field, Value: condition}})
+	}
+
+	f.conditions = append(f.conditions, bson.E{Key: field, Value: condition})
+	return f
+}
+
+// Equal add a equal condition on the field
+func (f *Filter) Equal(field string, value interface{}) *Filter {
+	return f.Where(field, value)
+}
+
+// NotEqual add a not equal condition on the field
+func (f *Filter) NotEqual(field string, value interface{}) *Filter {
+	return f.Where(field, QONotEqual(value))
+}
+
+// GreaterThan add a greater than condition on the field
+func (f *Filter) GreaterThan(field string, value interface{}) *Filter {
+	return f.Where(field, QOGreaterThan(value))
+}
+
+// GreaterThanOrEqual add a greater than or equal condition on the field
+func (f *Filter) GreaterThanOrEqual(field string, value interface{}) *Filter {
+	return f.Where(field, QOGreaterThanOrEqual(value))
+}
+
+// LessThan add a less than condition on the field
+func (f *Filter) LessThan(field string, value interface{}) *Filter {
+	return f.Where(field, QOLessThan(value))
+}
+
+// LessThanOrEqual add a less than or equal condition on the field
+func (f *Filter) LessThanOrEqual(field string, value interface{}) *Filter {
+	return f.Where(field, QOLessThanOrEqual(value))
+}
+
+// In add a condition on the field that is true if it's equal to one of the values
+func (f *Filter) In(field string, values ...interface{}) *Filter {
+	return f.Where(field, QOIn(values...))
+}
+
+// NotIn add a condition on the field that is true if it isn't equal to any of the values
+func (f *Filter) NotIn(field string, values ...interface{}) *Filter {
+	return f.Where(field, QONotIn(values...))
+}
+
+// Exists add a condition on the existence of the field
+func (f *Filter) Exists(field string, exists bool) *Filter {
+	return f.Where(field, QOExists(exists))
+}
+
+// Regex add a condition on the field that is true if it match the pattern with the options
+func (f *Filter) Regex(field string, pattern string, options string) *Filter {
+	return f.Where(field, QORegex(pattern, options))
+}
+
+// ElemMatch add a condition on the array field that is true if at least one element satisfy the conditions
+func (f *Filter) ElemMatch(field string, conditions interface{}) *Filter {
+	return f.Where(field, QOElemMatch(conditions))
+}
+
+// And add the condition that all the filters are true, merging their conditions into the filter
+func (f *Filter) And(filters ...*Filter) *Filter {
+	for _, other := range filters {
+		for _, e := range other.conditions {
+			switch {
+			case e.Key == "$and":
+				for _, c := range e.Value.(bson.A) {
+					f.and(c)
+				}
+			case e.Key == "$expr":
+				f.Expr(e.Value)
+			case !strings.HasPrefix(e.Key, "$"):
+				f.Where(e.Key, e.Value)
+			case isMissing(docGet(f.conditions, e.Key)):
+				f.conditions = append(f.conditions, e)
+			default:
+				f.and(bson.D{e})
+			}
+		}
+	}
+	return f
+}
+
+// Or add the condition that at least one of the filters is true
+func (f *Filter) Or(filters ...*Filter) *Filter {
+	return f.logical("$or", filters)
+}
+
+// Nor add the condition that none of the filters is true
+func (f *Filter) Nor(filters ...*Filter) *Filter {
+	return f.logical("$nor", filters)
+}
+
+// Expr add the condition that the aggregation expression is true
+func (f *Filter) Expr(expr interface{}) *Filter {
+	for i, e := range f.conditions {
+		if e.Key == "$expr" {
+			f.conditions[i].Value = APOAnd(e.Value, expr)
+			return f
+		}
+	}
+	f.conditions = append(f.conditions, bson.E{Key: "$expr", Value: expr})
+	return f
+}
+
+// Bson return the query filter
+func (f *Filter) Bson() bson.D {
+	return f.conditions
+}
+
+// logical add the $or or $nor operator op of the filters, or a $and of it if the filter already contains it
+func (f *Filter) logical(op string, filters []*Filter) *Filter {
+	list := bson.A{}
+	for _, other := range filters {
+		list = append(list, other.Bson())
+	}
+	if len(list) == 0 {
+		return f
+	}
+
+	if !isMissing(docGet(f.conditions, op)) {
+		return f.and(bson.D{{Key: op, Value: list}})
+	}
+	f.conditions = append(f.conditions, bson.E{Key: op, Value: list})
+	return f
+}
+
+// and add the filter to the $and operator of the filter
+func (f *Filter) and(filter interface{}) *Filter {
+	for i, e := range f.conditions {
+		if e.Key == "$and" {
+			f.conditions[i].Value = append(e.Value.(bson.A), filter)
+			return f
+		}
+	}
+	f.conditions = append(f.conditions, bson.E{Key: "$and", Value: bson.A{filter}})
+	return f
+}
+
+// filterOperators return the condition as a ordered document of operators, if it is one.
+// The keys of a bson.M with many operators are sorted to keep the filter stable
+func filterOperators(condition interface{}) (bson.D, bool) {
+	var ops bson.D
+	switch c := condition.(type) {
+	case bson.D:
+		ops = c
+	case bson.M:
+		for k, v := range c {
+			ops = append(ops, bson.E{Key: k, Value: v})
+		}
+		sort.Slice(ops, func(i, j int) bool {
+			return ops[i].Key < ops[j].Key
+		})
+	default:
+		return nil, false
+	}
+
+	if len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return nil, false
+	}
+	return ops, true
+}
+
+// mergeFilterOperators return the operators of a plus the ones of b, if they don't use the same operators.
+// $regex and $options are considered a single operator
+func mergeFilterOperators(a bson.D, b bson.D) (bson.D, bool) {
+	operator := func(key string) string {
+		if key == "$options" {
+			return "$regex"
+		}
+		return key
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if operator(x.Key) == operator(y.Key) {
+				return nil, false
+			}
+		}
+	}
+
+	merged := make(bson.D, 0, len(a)+len(b))
+	merged = append(merged, a...)
+	return append(merged, b...), true
+}
+
+// filterValuesEqual return true if the values of two equality conditions are the same
+func filterValuesEqual(a interface{}, b interface{}) bool {
+	ra, errA := bson.Marshal(bson.M{"v": a})
+	rb, errB := bson.Marshal(bson.M{"v": b})
+	return errA == nil && errB == nil && string(ra) == string(rb)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   string
+	}{
+		{"empty", NewFilter(), `{}`},
+		{"operators of the first condition are sorted", NewFilter().Where("age", bson.M{"$lt": 65, "$gt": 18}),
+			`{"age":{"$gt":18,"$lt":65}}`},
+		{"merged ranges", NewFilter().GreaterThan("age", 18).LessThan("age", 65).Equal("os", "linux"),
+			`{"age":{"$gt":18,"$lt":65},"os":"linux"}`},
+		{"repeated equality", NewFilter().Equal("os", "linux").Equal("os", "linux"), `{"os":"linux"}`},
+		{"equality merged with operators", NewFilter().Equal("os", "linux").NotIn("os", "aix"),
+			`{"os":{"$eq":"linux","$nin":["aix"]}}`},
+		{"different equalities", NewFilter().Equal("os", "linux").Equal("os", "aix"),
+			`{"os":"linux","$and":[{"os":"aix"}]}`},
+		{"repeated operator", NewFilter().GreaterThan("age", 18).GreaterThan("age", 21),
+			`{"age":{"$gt":18},"$and":[{"age":{"$gt":21}}]}`},
+		{"repeated operator from a bson.M", NewFilter().GreaterThan("age", 18).Where("age", bson.M{"$lt": 65, "$gt": 21}),
+			`{"age":{"$gt":18},"$and":[{"age":{"$gt":21,"$lt":65}}]}`},
+		{"regex and options are a single operator", NewFilter().Regex("name", "^web", "i").Regex("name", "prod", ""),
+			`{"name":{"$options":"i","$regex":"^web"},"$and":[{"name":{"$regex":"prod"}}]}`},
+		{"or and nor", NewFilter().Or(NewFilter().Equal("a", 1), NewFilter().Equal("b", 2)).Nor(NewFilter().Exists("c", true)),
+			`{"$or":[{"a":1},{"b":2}],"$nor":[{"c":{"$exists":true}}]}`},
+		{"repeated or", NewFilter().Or(NewFilter().Equal("a", 1)).Or(NewFilter().Equal("b", 2)),
+			`{"$or":[{"a":1}],"$and":[{"$or":[{"b":2}]}]}`},
+		{"expressions", NewFilter().Expr(APOGreater("$a", "$b")).Expr(APOGreater(10, "$a")),
+			`{"$expr":{"$and":[{"$gt":["$a","$b"]},{"$gt":[10,"$a"]}]}}`},
+		{"and merge the filters", NewFilter().GreaterThan("age", 18).And(
+			NewFilter().LessThan("age", 65).Or(NewFilter().Equal("a", 1)),
+			NewFilter().Equal("os", "linux").Expr(APOGreater("$a", 1)),
+		), `{"age":{"$gt":18,"$lt":65},"$or":[{"a":1}],"os":"linux","$expr":{"$gt":["$a",1]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bson.MarshalExtJSON(tt.filter.Bson(), false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "age": 20, "os": "linux", "tags": bson.A{"web", "prod"}},
+		{"_id": 2, "age": 70, "os": "linux", "tags": bson.A{"db"}},
+		{"_id": 3, "age": 30, "os": "aix"},
+	}
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   string
+	}{
+		{"range", NewFilter().GreaterThan("age", 18).LessThan("age", 65), `[{"_id": 1}, {"_id": 3}]`},
+		{"different equalities", NewFilter().Equal("os", "linux").Equal("os", "aix"), `[]`},
+		{"in and all", NewFilter().In("os", "linux", "aix").Where("tags", QOAll("web", "prod")), `[{"_id": 1}]`},
+		{"not exists or", NewFilter().Or(NewFilter().Exists("tags", false), NewFilter().GreaterThan("age", 65)),
+			`[{"_id": 2}, {"_id": 3}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustAggregate(t, MAPipeline(APMatch(tt.filter.Bson()), APProject(bson.M{"_id": 1})), docs)
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
@@ -43,3 +43,189 @@ func QOSize(value interface{}) interface{} {
 func QOExpr(value interface{}) interface{} {
 	return bson.M{"$expr": value}
 }
+
+// QOGreaterThan return a greater than condition
+func QOGreaterThan(value interface{}) interface{} {
+	return bson.M{"$gt": value}
+}
+
+// QOText return the text search operator, that search the words of search in the text index.
+// The words are ORed, the "quoted phrases" are ANDed
+func QOText(search string) interface{} {
+	return bson.M{"$text": bson.M{"$search": search}}
+}
+
+// QOTextWithOptions return the text search operator with the language and the sensitivity options
+func QOTextWithOptions(search string, language string, caseSensitive bool, diacriticSensitive bool) interface{} {
+	text := bson.M{
+		"$search":             search,
+		"$caseSensitive":      caseSensitive,
+		"$diacriticSensitive": diacriticSensitive,
+	}
+	if language != "" {
+		text["$language"] = language
+	}
+	return bson.M{"$text": text}
+}
+
+// QOEqual return a equal condition
+func QOEqual(value interface{}) interface{} {
+	return bson.M{"$eq": value}
+}
+
+// QOGreaterThanOrEqual return a greater than or equal condition
+func QOGreaterThanOrEqual(value interface{}) interface{} {
+	return bson.M{"$gte": value}
+}
+
+// QOIn return a condition that is true if the value is equal to one of the values
+func QOIn(values ...interface{}) interface{} {
+	return bson.M{"$in": values}
+}
+
+// QONotIn return a condition that is true if the value isn't equal to any of the values
+func QONotIn(values ...interface{}) interface{} {
+	return bson.M{"$nin": values}
+}
+
+// QOExists return a condition that is true if the existence of the field is exists
+func QOExists(exists bool) interface{} {
+	return bson.M{"$exists": exists}
+}
+
+// QOType return a condition that is true if the value has one of the bson types, like "string" or 2
+func QOType(types ...interface{}) interface{} {
+	if len(types) == 1 {
+		return bson.M{"$type": types[0]}
+	}
+	return bson.M{"$type": types}
+}
+
+// QORegex return a condition that is true if the value match the pattern with the options, like "i", omitted if empty
+func QORegex(pattern string, options string) interface{} {
+	if options == "" {
+		return bson.M{"$regex": pattern}
+	}
+	return bson.M{"$regex": pattern, "$options": options}
+}
+
+// QOAll return a condition that is true if the array contains all the values
+func QOAll(values ...interface{}) interface{} {
+	return bson.M{"$all": values}
+}
+
+// QOElemMatch return a condition that is true if at least one element of the array satisfy all the conditions.
+// The conditions are a query filter for arrays of documents or operators like QOGreaterThan for arrays of values
+func QOElemMatch(conditions interface{}) interface{} {
+	return bson.M{"$elemMatch": conditions}
+}
+
+// QONot return a condition that is true if the value doesn't satisfy the operator condition
+func QONot(condition interface{}) interface{} {
+	return bson.M{"$not": condition}
+}
+
+// QOAnd return a query filter that is true if all the filters are true
+func QOAnd(filters ...interface{}) interface{} {
+	return bson.M{"$and": filters}
+}
+
+// QOOr return a query filter that is true if at least one of the filters is true
+func QOOr(filters ...interface{}) interface{} {
+	return bson.M{"$or": filters}
+}
+
+// QONor return a query filter that is true if none of the filters is true
+func QONor(filters ...interface{}) interface{} {
+	return bson.M{"$nor": filters}
+}
+
+// QOMod return a condition that is true if the value divided by divisor has the remainder
+func QOMod(divisor int64, remainder int64) interface{} {
+	return bson.M{"$mod": bson.A{divisor, remainder}}
+}
+
+// QOBitsAllSet return a condition that is true if all the bits of the bitmask, or at the positions of a array, are set
+func QOBitsAllSet(bitmask interface{}) interface{} {
+	return bson.M{"$bitsAllSet": bitmask}
+}
+
+// QOBitsAnySet return a condition that is true if any of the bits of the bitmask, or at the positions of a array, is set
+func QOBitsAnySet(bitmask interface{}) interface{} {
+	return bson.M{"$bitsAnySet": bitmask}
+}
+
+// QOBitsAllClear return a condition that is true if all the bits of the bitmask, or at the positions of a array, are clear
+func QOBitsAllClear(bitmask interface{}) interface{} {
+	return bson.M{"$bitsAllClear": bitmask}
+}
+
+// QOBitsAnyClear return a condition that is true if any of the bits of the bitmask, or at the positions of a array, is clear
+func QOBitsAnyClear(bitmask interface{}) interface{} {
+	return bson.M{"$bitsAnyClear": bitmask}
+}
+
+// QOJSONSchema return a query filter that is true if the document is valid for the json schema
+func QOJSONSchema(schema interface{}) interface{} {
+	return bson.M{"$jsonSchema": schema}
+}
+
+// QOGeoJSONPoint return a GeoJSON point, to be used as geometry of the geo operators
+func QOGeoJSONPoint(longitude float64, latitude float64) interface{} {
+	return bson.M{
+		"type":        "Point",
+		"coordinates": bson.A{longitude, latitude},
+	}
+}
+
+// QOGeoJSONPolygon return a GeoJSON polygon with the rings of [longitude, latitude] points, to be used as geometry
+// of the geo operators. The first ring is the exterior one and every ring must be closed
+func QOGeoJSONPolygon(rings ...[][2]float64) interface{} {
+	coordinates := bson.A{}
+	for _, ring := range rings {
+		points := bson.A{}
+		for _, p := range ring {
+			points = append(points, bson.A{p[0], p[1]})
+		}
+		coordinates = append(coordinates, points)
+	}
+	return bson.M{
+		"type":        "Polygon",
+		"coordinates": coordinates,
+	}
+}
+
+// QOGeoWithin return a condition that is true if the geometry of the value is entirely within the GeoJSON geometry
+func QOGeoWithin(geometry interface{}) interface{} {
+	return bson.M{"$geoWithin": bson.M{"$geometry": geometry}}
+}
+
+// QOGeoWithinCenterSphere return a condition that is true if the geometry of the value is within the circle
+// with the center and the radius in radians on a sphere
+func QOGeoWithinCenterSphere(longitude float64, latitude float64, radius float64) interface{} {
+	return bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{bson.A{longitude, latitude}, radius}}}
+}
+
+// QOGeoIntersects return a condition that is true if the geometry of the value intersects the GeoJSON geometry
+func QOGeoIntersects(geometry interface{}) interface{} {
+	return bson.M{"$geoIntersects": bson.M{"$geometry": geometry}}
+}
+
+// QONear return a condition that sort the documents by the distance from the GeoJSON point, in meters.
+// The distances limit the documents if they are positive
+func QONear(point interface{}, minDistance float64, maxDistance float64) interface{} {
+	near := bson.M{"$geometry": point}
+	if minDistance > 0 {
+		near["$minDistance"] = minDistance
+	}
+	if maxDistance > 0 {
+		near["$maxDistance"] = maxDistance
+	}
+	return bson.M{"$near": near}
+}
+
+// QONearSphere return a condition like QONear that compute the distances on a sphere
+func QONearSphere(point interface{}, minDistance float64, maxDistance float64) interface{} {
+	near := QONear(point, minDistance, maxDistance).(bson.M)["$near"]
+	return bson.M{"$nearSphere": near}
+}
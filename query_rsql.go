@@ -0,0 +1,505 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rsqlDecimalNumber match the numbers written as plain decimal literals, like -1.5 or 2e10
+var rsqlDecimalNumber = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// RSQLType is the type of the values of a field of a RSQL filter
+type RSQLType int
+
+const (
+	// RSQLAny is a field whose values are booleans, numbers or strings, depending on how they are written.
+	// Only the plain decimal literals are numbers, so NaN, Inf or 0x10 are strings
+	RSQLAny RSQLType = iota
+	// RSQLString is a string field. The values of == and != can contain * as wildcard
+	RSQLString
+	// RSQLInteger is a integer field
+	RSQLInteger
+	// RSQLNumber is a integer or floating point field, whose values are decimal literals like -1.5 or 2e10
+	RSQLNumber
+	// RSQLBool is a boolean field, whose values are true or false
+	RSQLBool
+	// RSQLDate is a date field, whose values are like 2019-11-05 or 2019-11-05T10:00:00Z
+	RSQLDate
+	// RSQLObjectID is a ObjectId field, whose values are hex strings
+	RSQLObjectID
+)
+
+// RSQLField is a field that can be used in a RSQL filter
+type RSQLField struct {
+	// Path is the path of the field in the documents, or empty if it's the name of the field
+	Path string
+	Type RSQLType
+}
+
+// RSQLSchema contains the fields that can be used in a RSQL filter, by name
+type RSQLSchema map[string]RSQLField
+
+// RSQLWhitelist return a schema with the fields of any type, whose paths are their names
+func RSQLWhitelist(fields ...string) RSQLSchema {
+	out := RSQLSchema{}
+	for _, f := range fields {
+		out[f] = RSQLField{Type: RSQLAny}
+	}
+	return out
+}
+
+// RSQLError is the error returned by ParseRSQL for a invalid filter, with the position of the offending element.
+// The message is meant to be returned to the user, like in a 400 response
+type RSQLError struct {
+	Filter string
+	// Column is the position in characters of the offending element, starting from 1
+	Column  int
+	Message string
+}
+
+// Error return the message of the error with the position
+func (e *RSQLError) Error() string {
+	return fmt.Sprintf("invalid filter %q: column %d: %s", e.Filter, e.Column, e.Message)
+}
+
+// rsqlOperators contains the canonical names of the comparison operators
+var rsqlOperators = map[string]string{
+	"==": "==", "!=": "!=",
+	"<": "=lt=", "=lt=": "=lt=", "<=": "=le=", "=le=": "=le=",
+	">": "=gt=", "=gt=": "=gt=", ">=": "=ge=", "=ge=": "=ge=",
+	"=in=": "=in=", "=out=": "=out=", "=exists=": "=exists=",
+}
+
+// rsqlReserved contains the characters that can't be used in the fields and in the values that aren't quoted
+const rsqlReserved = "\"'();,=!~<> \t\r\n"
+
+// ParseRSQL parse a RSQL/FIQL filter like `status==active;cpu=gt=4,tags=in=(db,web)` and return the query filter.
+// The constraints are ANDed by ; or and, ORed by , or or, and grouped by parentheses. The operators are
+// ==, !=, =lt= (or <), =le= (or <=), =gt= (or >), =ge= (or >=), =in=, =out= and =exists=.
+// The values can be quoted by ' or ", null is the null value and the fields and the values are checked against the schema
+func ParseRSQL(filter string, schema RSQLSchema) (*Filter, error) {
+	p := rsqlParser{src: filter, schema: schema}
+
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return NewFilter(), nil
+	}
+	out, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		if p.src[p.pos] == ')' {
+			return nil, p.errorf("unbalanced )")
+		}
+		return nil, p.errorf("expected ; or , between the constraints")
+	}
+
+	return out, nil
+}
+
+// APRSQLMatchStage return a match stage of the documents that satisfy the filter, as parsed by ParseRSQL,
+// or nil if the filter is empty
+func APRSQLMatchStage(filter string, schema RSQLSchema) (interface{}, error) {
+	f, err := ParseRSQL(filter, schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Bson()) == 0 {
+		return nil, nil
+	}
+
+	return APMatch(f.Bson()), nil
+}
+
+// rsqlParser is a recursive descent parser of RSQL filters
+type rsqlParser struct {
+	src    string
+	pos    int
+	schema RSQLSchema
+}
+
+// rsqlValue is a argument of a comparison
+type rsqlValue struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+// errorf return a error with the current position in the filter
+func (p *rsqlParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.pos, format, args...)
+}
+
+// errorAt return a error with the position pos in the filter
+func (p *rsqlParser) errorAt(pos int, format string, args ...interface{}) error {
+	return &RSQLError{
+		Filter:  p.src,
+		Column:  utf8.RuneCountInString(p.src[:pos]) + 1,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// skipSpaces skip the whitespaces
+func (p *rsqlParser) skipSpaces() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// separator consume the next separator, that is sep or the keyword preceded by a whitespace, and return true if found
+func (p *rsqlParser) separator(sep byte, keyword string) bool {
+	start := p.pos
+	p.skipSpaces()
+	if p.pos < len(p.src) && p.src[p.pos] == sep {
+		p.pos++
+		return true
+	}
+
+	rest := p.src[p.pos:]
+	if p.pos > 0 && (p.pos > start || p.src[p.pos-1] == ')') && strings.HasPrefix(rest, keyword) &&
+		len(rest) > len(keyword) && strings.IndexByte(" \t\r\n(", rest[len(keyword)]) >= 0 {
+		p.pos += len(keyword)
+		return true
+	}
+	p.pos = start
+	return false
+}
+
+// parseOr parse constraints joined by , or or
+func (p *rsqlParser) parseOr() (*Filter, error) {
+	alternatives := []*Filter{}
+	for {
+		f, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, f)
+		if !p.separator(',', "or") {
+			break
+		}
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return NewFilter().Or(alternatives...), nil
+}
+
+// parseAnd parse constraints joined by ; or and
+func (p *rsqlParser) parseAnd() (*Filter, error) {
+	out := NewFilter()
+	for {
+		f, err := p.parseConstraint()
+		if err != nil {
+			return nil, err
+		}
+		out.And(f)
+		if !p.separator(';', "and") {
+			return out, nil
+		}
+	}
+}
+
+// parseConstraint parse a comparison or a group
+func (p *rsqlParser) parseConstraint() (*Filter, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("expected a constraint")
+	}
+
+	if p.src[p.pos] == '(' {
+		p.pos++
+		group, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.pos >= len(p.src) || p.src[p.pos] != ')' {
+			return nil, p.errorf("expected ) or a separator")
+		}
+		p.pos++
+		return group, nil
+	}
+
+	fieldPos := p.pos
+	name := p.parseUnreserved()
+	if name == "" {
+		return nil, p.errorf("expected a field")
+	}
+	field, ok := p.schema[name]
+	if !ok {
+		return nil, p.errorAt(fieldPos, "unknown field %q, the allowed fields are %s", name, joinedMapKeys(p.schema))
+	}
+	if field.Path == "" {
+		field.Path = name
+	}
+
+	p.skipSpaces()
+	opPos := p.pos
+	op, err := p.parseOperator()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	argsPos := p.pos
+	args, isList, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "=in=", "=out=":
+		values := make([]interface{}, 0, len(args))
+		for _, a := range args {
+			v, err := p.convert(a, field.Type)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if op == "=in=" {
+			return NewFilter().In(field.Path, values...), nil
+		}
+		return NewFilter().NotIn(field.Path, values...), nil
+	}
+
+	if isList {
+		return nil, p.errorAt(argsPos, "the operator %s takes a single value", op)
+	}
+	arg := args[0]
+
+	switch op {
+	case "=exists=":
+		exists, err := p.convert(arg, RSQLBool)
+		if err != nil {
+			return nil, err
+		}
+		if exists == nil {
+			return nil, p.errorAt(arg.pos, "%q is not a boolean, it must be true or false", arg.text)
+		}
+		return NewFilter().Exists(field.Path, exists.(bool)), nil
+	case "==", "!=":
+		if !arg.quoted && strings.Contains(arg.text, "*") && (field.Type == RSQLString || field.Type == RSQLAny) {
+			pattern := rsqlWildcardPattern(arg.text)
+			if op == "==" {
+				return NewFilter().Regex(field.Path, pattern, ""), nil
+			}
+			return NewFilter().Where(field.Path, QONot(primitive.Regex{Pattern: pattern})), nil
+		}
+	}
+
+	v, err := p.convert(arg, field.Type)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "==":
+		return NewFilter().Equal(field.Path, v), nil
+	case "!=":
+		return NewFilter().NotEqual(field.Path, v), nil
+	case "=lt=":
+		return NewFilter().LessThan(field.Path, v), nil
+	case "=le=":
+		return NewFilter().LessThanOrEqual(field.Path, v), nil
+	case "=gt=":
+		return NewFilter().GreaterThan(field.Path, v), nil
+	case "=ge=":
+		return NewFilter().GreaterThanOrEqual(field.Path, v), nil
+	}
+
+	return nil, p.errorAt(opPos, "unsupported operator %s", op)
+}
+
+// parseUnreserved parse the characters that aren't reserved
+func (p *rsqlParser) parseUnreserved() string {
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte(rsqlReserved, p.src[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// parseOperator parse a comparison operator and return its canonical name
+func (p *rsqlParser) parseOperator() (string, error) {
+	start := p.pos
+	rest := p.src[p.pos:]
+
+	var op string
+	switch {
+	case strings.HasPrefix(rest, "=="), strings.HasPrefix(rest, "!="), strings.HasPrefix(rest, "<="), strings.HasPrefix(rest, ">="):
+		op = rest[:2]
+	case strings.HasPrefix(rest, "<"), strings.HasPrefix(rest, ">"):
+		op = rest[:1]
+	case strings.HasPrefix(rest, "="):
+		end := 1
+		for end < len(rest) && (rest[end] >= 'a' && rest[end] <= 'z' || rest[end] >= 'A' && rest[end] <= 'Z') {
+			end++
+		}
+		if end == 1 || end >= len(rest) || rest[end] != '=' {
+			return "", p.errorf("expected a comparison operator like ==, != or =gt=")
+		}
+		op = rest[:end+1]
+	default:
+		return "", p.errorf("expected a comparison operator like ==, != or =gt=")
+	}
+
+	canonical, ok := rsqlOperators[strings.ToLower(op)]
+	if !ok {
+		return "", p.errorAt(start, "unknown operator %s", op)
+	}
+	p.pos += len(op)
+	return canonical, nil
+}
+
+// parseArguments parse a value or a parenthesized list of values, and return true if it's a list
+func (p *rsqlParser) parseArguments() ([]rsqlValue, bool, error) {
+	if p.pos >= len(p.src) || p.src[p.pos] != '(' {
+		v, err := p.parseValue()
+		return []rsqlValue{v}, false, err
+	}
+
+	p.pos++
+	values := []rsqlValue{}
+	for {
+		p.skipSpaces()
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, false, err
+		}
+		values = append(values, v)
+
+		p.skipSpaces()
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos < len(p.src) && p.src[p.pos] == ')' {
+			p.pos++
+			return values, true, nil
+		}
+		return nil, false, p.errorf("expected , or ) in the list of values")
+	}
+}
+
+// parseValue parse a quoted or unreserved value
+func (p *rsqlParser) parseValue() (rsqlValue, error) {
+	start := p.pos
+	if p.pos >= len(p.src) || (p.src[p.pos] != '"' && p.src[p.pos] != '\'') {
+		text := p.parseUnreserved()
+		if text == "" {
+			return rsqlValue{}, p.errorf("expected a value")
+		}
+		return rsqlValue{text: text, pos: start}, nil
+	}
+
+	quote := p.src[p.pos]
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return rsqlValue{text: sb.String(), quoted: true, pos: start}, nil
+		case c == '\\' && p.pos+1 < len(p.src):
+			sb.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return rsqlValue{}, p.errorAt(start, "unterminated quoted value")
+}
+
+// convert return the value of the argument as the type t
+func (p *rsqlParser) convert(arg rsqlValue, t RSQLType) (interface{}, error) {
+	if arg.text == "null" && !arg.quoted {
+		return nil, nil
+	}
+
+	switch t {
+	case RSQLString:
+		return arg.text, nil
+	case RSQLInteger:
+		if n, err := strconv.ParseInt(arg.text, 10, 64); err == nil {
+			return n, nil
+		}
+		return nil, p.errorAt(arg.pos, "%q is not a integer", arg.text)
+	case RSQLNumber:
+		if n, err := strconv.ParseInt(arg.text, 10, 64); err == nil {
+			return n, nil
+		}
+		// ParseFloat accepts also NaN, Inf and hexadecimal numbers, that aren't allowed
+		if rsqlDecimalNumber.MatchString(arg.text) {
+			if f, err := strconv.ParseFloat(arg.text, 64); err == nil {
+				return f, nil
+			}
+		}
+		return nil, p.errorAt(arg.pos, "%q is not a number", arg.text)
+	case RSQLBool:
+		switch strings.ToLower(arg.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, p.errorAt(arg.pos, "%q is not a boolean, it must be true or false", arg.text)
+	case RSQLDate:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if d, err := time.Parse(layout, arg.text); err == nil {
+				return d, nil
+			}
+		}
+		return nil, p.errorAt(arg.pos, "%q is not a date like 2019-11-05 or 2019-11-05T10:00:00Z", arg.text)
+	case RSQLObjectID:
+		id, err := primitive.ObjectIDFromHex(arg.text)
+		if err != nil {
+			return nil, p.errorAt(arg.pos, "%q is not a ObjectId", arg.text)
+		}
+		return id, nil
+	}
+
+	if arg.quoted {
+		return arg.text, nil
+	}
+	for _, inferred := range []RSQLType{RSQLBool, RSQLNumber} {
+		if v, err := p.convert(arg, inferred); err == nil {
+			return v, nil
+		}
+	}
+	return arg.text, nil
+}
+
+// rsqlWildcardPattern return the regex pattern that match the whole value where * is any sequence of characters
+func rsqlWildcardPattern(value string) string {
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return "^" + strings.Join(parts, ".*") + "$"
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testRSQLSchema contains a field of every type
+var testRSQLSchema = RSQLSchema{
+	"any":     {Type: RSQLAny},
+	"name":    {Type: RSQLString, Path: "info.name"},
+	"cpu":     {Type: RSQLInteger},
+	"load":    {Type: RSQLNumber},
+	"enabled": {Type: RSQLBool},
+	"created": {Type: RSQLDate},
+	"id":      {Type: RSQLObjectID, Path: "_id"},
+}
+
+func TestParseRSQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		want   string
+	}{
+		{"empty", " ", `{}`},
+		{"and", "cpu=gt=4;enabled==true", `{"cpu": {"$gt": 4}, "enabled": true}`},
+		{"and keyword and aliases", "cpu>4 and cpu<=16", `{"cpu": {"$gt": 4, "$lte": 16}}`},
+		{"or and groups", "(cpu==1,cpu==2);load=ge=-1.5e2", `{"$or": [{"cpu": 1}, {"cpu": 2}], "load": {"$gte": -150.0}}`},
+		{"or keyword", "cpu==1 or cpu==2", `{"$or": [{"cpu": 1}, {"cpu": 2}]}`},
+		{"path and quotes", `name=="web 1";name!='it\'s'`, `{"info.name": {"$eq": "web 1", "$ne": "it's"}}`},
+		{"wildcard", "name==web*", `{"info.name": {"$regex": "^web.*$"}}`},
+		{"quoted wildcard", `name=="web*"`, `{"info.name": "web*"}`},
+		{"negated wildcard", "name!=*test", `{"info.name": {"$not": {"$regularExpression": {"pattern": "^.*test$", "options": ""}}}}`},
+		{"in and out", "cpu=in=(1,2);load=out=(0.5)", `{"cpu": {"$in": [1, 2]}, "load": {"$nin": [0.5]}}`},
+		{"exists", "load=exists=false", `{"load": {"$exists": false}}`},
+		{"null", "name==null", `{"info.name": null}`},
+		{"date", "created=lt=2019-11-05", `{"created": {"$lt": {"$date": "2019-11-05T00:00:00Z"}}}`},
+		{"object id", "id==5dc1a2b3c4d5e6f708091a2b", `{"_id": {"$oid": "5dc1a2b3c4d5e6f708091a2b"}}`},
+		{"inferred types", "any=in=(true,12,1.5,web,'7')", `{"any": {"$in": [true, 12, 1.5, "web", "7"]}}`},
+		{"not a decimal literal is a string", "any=in=(NaN,Inf,-infinity,0x10,1_000)",
+			`{"any": {"$in": ["NaN", "Inf", "-infinity", "0x10", "1_000"]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRSQL(tt.filter, testRSQLSchema)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, got.Bson(), tt.want)
+		})
+	}
+}
+
+func TestParseRSQLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		column  int
+		message string
+	}{
+		{"unknown field", "cpu==1;password==x", 8,
+			`unknown field "password", the allowed fields are any, cpu, created, enabled, id, load, name`},
+		{"missing operator", "cpu 1", 5, "expected a comparison operator like ==, != or =gt="},
+		{"not a integer", "cpu==1.5", 6, `"1.5" is not a integer`},
+		{"NaN", "load=gt=NaN", 9, `"NaN" is not a number`},
+		{"infinity", "load=lt=-Infinity", 9, `"-Infinity" is not a number`},
+		{"inf in a list", "load=in=(1,inf)", 12, `"inf" is not a number`},
+		{"hexadecimal", "load==0x1p-2", 7, `"0x1p-2" is not a number`},
+		{"out of range", "load==1e400", 7, `"1e400" is not a number`},
+		{"not a boolean", "enabled==yes", 10, `"yes" is not a boolean, it must be true or false`},
+		{"null exists", "name=exists=null", 13, `"null" is not a boolean, it must be true or false`},
+		{"not a date", "created==yesterday", 10, `"yesterday" is not a date like 2019-11-05 or 2019-11-05T10:00:00Z`},
+		{"not a ObjectId", "id==web", 5, `"web" is not a ObjectId`},
+		{"list for a single value", "cpu==(1,2)", 6, "the operator == takes a single value"},
+		{"unterminated quote", `name=="web`, 7, "unterminated quoted value"},
+		{"unbalanced", "cpu==1)", 7, "unbalanced )"},
+		{"unclosed group", "(cpu==1", 8, "expected ) or a separator"},
+		{"positions in characters", "name==città;x==1", 13, `unknown field "x", the allowed fields are any, cpu, created, enabled, id, load, name`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRSQL(tt.filter, testRSQLSchema)
+			var rsqlErr *RSQLError
+			if !errors.As(err, &rsqlErr) {
+				t.Fatalf("expected a RSQLError, got %v", err)
+			}
+			if rsqlErr.Column != tt.column || rsqlErr.Message != tt.message {
+				t.Errorf("got column %d: %s, want column %d: %s", rsqlErr.Column, rsqlErr.Message, tt.column, tt.message)
+			}
+		})
+	}
+}
+
+func TestRSQLMatchStage(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "info": bson.M{"name": "web1"}, "cpu": 4},
+		{"_id": 2, "info": bson.M{"name": "db1"}, "cpu": 8},
+		{"_id": 3, "info": bson.M{"name": "web2"}, "cpu": 16},
+	}
+	stage, err := APRSQLMatchStage("name==web*;cpu=gt=4,name==db1", testRSQLSchema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSON(t, mustAggregate(t, MAPipeline(stage, APProject(bson.M{"_id": 1})), docs), `[{"_id": 2}, {"_id": 3}]`)
+
+	if stage, err := APRSQLMatchStage("", testRSQLSchema); stage != nil || err != nil {
+		t.Errorf("expected no stage, got %v, %v", stage, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// KeywordLogic is the way the keywords of a search are combined
+type KeywordLogic int
+
+const (
+	// MatchAllKeywords match the documents that match every keyword
+	MatchAllKeywords KeywordLogic = iota
+	// MatchAnyKeyword match the documents that match at least one keyword
+	MatchAnyKeyword
+)
+
+// MatchMode is the way a keyword is matched against a value
+type MatchMode int
+
+const (
+	// MatchContains match the values that contain the keyword
+	MatchContains MatchMode = iota
+	// MatchPrefix match the values that start with the keyword
+	MatchPrefix
+	// MatchWholeWord match the values that contain the keyword as a whole word
+	MatchWholeWord
+	// MatchExact match the values that are equal to the keyword
+	MatchExact
+)
+
+// SearchFilterOptions contains the options of APSearchFilterStageWithOptions.
+// The zero value match the values that contain every keyword ignoring the case
+type SearchFilterOptions struct {
+	Logic         KeywordLogic
+	Mode          MatchMode
+	CaseSensitive bool
+	// DiacriticInsensitive match the letters ignoring their accents, so citta match città
+	DiacriticInsensitive bool
+	// ReportMatches set the SearchMatchesField of the documents to the fields and the keywords that matched,
+	// like [{field: "name", keyword: "web"}]
+	ReportMatches bool
+	// ReportMatchText add to the reported matches the first matched text and its start and end offsets in code points,
+	// like {field: "name", keyword: "web", match: "Web", start: 4, end: 7}
+	ReportMatchText bool
+}
+
+// SearchMatchesField is the field set to the matches reported by the search filter
+const SearchMatchesField = "_matches"
+
+// wordBoundary match a character that isn't part of a word
+const wordBoundary = `[^\p{L}\p{N}_]`
+
+// diacriticVariants contains the accented variants of the lowercase latin letters
+var diacriticVariants = map[rune]string{
+	'a': "àáâãäåāăą",
+	'c': "çćĉċč",
+	'd': "ďđ",
+	'e': "èéêëēĕėęě",
+	'g': "ĝğġģ",
+	'h': "ĥħ",
+	'i': "ìíîïĩīĭį",
+	'j': "ĵ",
+	'k': "ķ",
+	'l': "ĺļľŀł",
+	'n': "ñńņň",
+	'o': "òóôõöøōŏő",
+	'r': "ŕŗř",
+	's': "śŝşšș",
+	't': "ţťŧț",
+	'u': "ùúûüũūŭůűų",
+	'w': "ŵ",
+	'y': "ýÿŷ",
+	'z': "źżž",
+}
+
+// diacriticBases map every accented letter of diacriticVariants, in lowercase and uppercase, to its base letter
+var diacriticBases = map[rune]rune{}
+
+func init() {
+	for base, variants := range diacriticVariants {
+		for _, v := range variants {
+			diacriticBases[v] = base
+			if upper := unicode.ToUpper(v); upper != v {
+				diacriticBases[upper] = unicode.ToUpper(base)
+			}
+		}
+	}
+}
+
+// regex return the regular expression that match the keyword as specified by the options
+func (o SearchFilterOptions) regex(keyword string) primitive.Regex {
+	return o.keywordRegex(keyword, false)
+}
+
+// keywordRegex return the regular expression that match the keyword as specified by the options.
+// If capture is true the keyword is captured by the first group, without the surrounding word boundaries
+func (o SearchFilterOptions) keywordRegex(keyword string, capture bool) primitive.Regex {
+	return o.termRegex([]string{keyword}, capture)
+}
+
+// wildcardRegex return the regular expression that match the keyword as specified by the options,
+// where * match any sequence of characters
+func (o SearchFilterOptions) wildcardRegex(keyword string) primitive.Regex {
+	return o.termRegex(strings.Split(keyword, "*"), false)
+}
+
+// termRegex return the regular expression that match the parts, separated by any sequence of characters,
+// as specified by the options. If capture is true the match is captured by the first group
+func (o SearchFilterOptions) termRegex(parts []string, capture bool) primitive.Regex {
+	quoted := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if o.DiacriticInsensitive {
+			quoted = append(quoted, diacriticInsensitivePattern(part))
+		} else {
+			quoted = append(quoted, regexp.QuoteMeta(part))
+		}
+	}
+	pattern := strings.Join(quoted, ".*")
+	if capture {
+		pattern = "(" + pattern + ")"
+	}
+
+	switch o.Mode {
+	case MatchPrefix:
+		pattern = "^" + pattern
+	case MatchWholeWord:
+		pattern = "(?:^|" + wordBoundary + ")" + pattern + "(?:$|" + wordBoundary + ")"
+	case MatchExact:
+		pattern = "^" + pattern + "$"
+	}
+
+	options := "i"
+	if o.CaseSensitive {
+		options = ""
+	}
+	return primitive.Regex{Pattern: pattern, Options: options}
+}
+
+// diacriticInsensitivePattern return the quoted pattern of s where every letter match also its accented variants
+func diacriticInsensitivePattern(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if base, ok := diacriticBases[r]; ok {
+			r = base
+		}
+
+		lower := unicode.ToLower(r)
+		variants, ok := diacriticVariants[lower]
+		if !ok {
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			continue
+		}
+		if lower != r {
+			variants = strings.ToUpper(variants)
+		}
+		sb.WriteString("[" + string(r) + variants + "]")
+	}
+	return sb.String()
+}
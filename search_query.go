@@ -0,0 +1,318 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// SearchQuery is a parsed search string. A document match the query when it match all the clauses
+type SearchQuery struct {
+	Clauses []SearchClause
+}
+
+// SearchClause is a group of alternatives. A document match the clause when it match any of the terms
+type SearchClause struct {
+	Terms []SearchTerm
+}
+
+// SearchTerm is a word or a phrase searched in the default fields or in the field at Path
+type SearchTerm struct {
+	// Path is the path of the qualified field, or empty for the default fields
+	Path    string
+	Value   string
+	Phrase  bool
+	Negated bool
+}
+
+// searchQualifier match the field names that can qualify a term
+var searchQualifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// ParseSearchQuery parse a search string like `linux "red hat" -centos hostname:web* (os:aix OR os:hpux)`.
+// The words and the "quoted phrases" are ANDed, a term prefixed by - is excluded, OR join the adjacent terms
+// and the parentheses group the alternatives. A * in a word, but not in a phrase, match any sequence of characters. A term qualified by field: is searched only in the field,
+// that must be a key of allowedFields, that translate the field names to the paths of the documents
+func ParseSearchQuery(query string, allowedFields map[string]string) (*SearchQuery, error) {
+	p := searchParser{src: query, allowedFields: allowedFields}
+
+	out := &SearchQuery{Clauses: []SearchClause{}}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.src) {
+			return out, nil
+		}
+		if p.src[p.pos] == ')' {
+			return nil, p.errorf("unbalanced )")
+		}
+
+		clauses, err := p.parseAlternatives()
+		if err != nil {
+			return nil, err
+		}
+		out.Clauses = append(out.Clauses, clauses...)
+	}
+}
+
+// Condition return a expression that is true when the document match the query.
+// The terms that aren't qualified are searched in any of fields
+func (q *SearchQuery) Condition(fields []interface{}) interface{} {
+	return q.ConditionWithOptions(fields, SearchFilterOptions{})
+}
+
+// ConditionWithOptions return a expression like Condition that match the terms as specified by the options.
+// The logic of the options is ignored, because the query has its own
+func (q *SearchQuery) ConditionWithOptions(fields []interface{}, options SearchFilterOptions) interface{} {
+	conditions := []interface{}{}
+	for _, c := range q.Clauses {
+		alternatives := []interface{}{}
+		for _, t := range c.Terms {
+			alternatives = append(alternatives, t.condition(fields, options))
+		}
+		conditions = append(conditions, APOOr(alternatives...))
+	}
+
+	return APOAnd(conditions...)
+}
+
+// condition return a expression that is true when the document match the term
+func (t SearchTerm) condition(fields []interface{}, options SearchFilterOptions) interface{} {
+	if t.Path != "" {
+		fields = []interface{}{"$" + t.Path}
+	}
+
+	regex := options.regex(t.Value)
+	if !t.Phrase {
+		regex = options.wildcardRegex(t.Value)
+	}
+	matches := []interface{}{}
+	for _, f := range fields {
+		matches = append(matches, searchFieldCondition(f, regex))
+	}
+
+	if t.Negated {
+		return APONot(APOOr(matches...))
+	}
+	return APOOr(matches...)
+}
+
+// APSearchQueryStage return a aggregation stage that filter the documents that match the query, as parsed by ParseSearchQuery,
+// or nil if the query is empty
+func APSearchQueryStage(query string, fields []interface{}, allowedFields map[string]string) (interface{}, error) {
+	q, err := ParseSearchQuery(query, allowedFields)
+	if err != nil {
+		return nil, err
+	}
+	if len(q.Clauses) == 0 {
+		return nil, nil
+	}
+
+	return APMatch(QOExpr(q.Condition(fields))), nil
+}
+
+// searchParser is a recursive descent parser of search strings
+type searchParser struct {
+	src           string
+	pos           int
+	allowedFields map[string]string
+}
+
+// errorf return a error with the current position in the search string
+func (p *searchParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid search query %q: column %d: %s", p.src, utf8.RuneCountInString(p.src[:p.pos])+1, fmt.Sprintf(format, args...))
+}
+
+// skipSpaces skip the whitespaces
+func (p *searchParser) skipSpaces() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// atOr return true if the next word is the OR operator
+func (p *searchParser) atOr() bool {
+	rest := p.src[p.pos:]
+	return strings.HasPrefix(rest, "OR") && (len(rest) == 2 || strings.IndexByte(" \t\r\n(\"-", rest[2]) >= 0)
+}
+
+// parseAlternatives parse operands joined by OR
+func (p *searchParser) parseAlternatives() ([]SearchClause, error) {
+	out, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpaces()
+		if !p.atOr() {
+			return out, nil
+		}
+		p.pos += 2
+		p.skipSpaces()
+
+		next, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if len(out) != 1 || len(next) != 1 {
+			return nil, p.errorf("a negated group of alternatives can't be joined with OR")
+		}
+		out[0].Terms = append(out[0].Terms, next[0].Terms...)
+	}
+}
+
+// parseOperand parse a optionally negated term or group
+func (p *searchParser) parseOperand() ([]SearchClause, error) {
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("expected a term")
+	}
+
+	negated := false
+	if p.src[p.pos] == '-' {
+		negated = true
+		p.pos++
+		if p.pos >= len(p.src) || strings.IndexByte(" \t\r\n)", p.src[p.pos]) >= 0 {
+			return nil, p.errorf("expected a term after -")
+		}
+	}
+
+	if p.src[p.pos] != '(' {
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		term.Negated = negated
+		return []SearchClause{{Terms: []SearchTerm{term}}}, nil
+	}
+
+	p.pos++
+	p.skipSpaces()
+	group, err := p.parseAlternatives()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos >= len(p.src) || p.src[p.pos] != ')' {
+		return nil, p.errorf("expected ) or OR, the terms of a group must be joined by OR")
+	}
+	p.pos++
+
+	if !negated {
+		return group, nil
+	}
+	return p.negate(group)
+}
+
+// negate return the clauses that match when the clauses don't match
+func (p *searchParser) negate(clauses []SearchClause) ([]SearchClause, error) {
+	if len(clauses) == 1 {
+		out := []SearchClause{}
+		for _, t := range clauses[0].Terms {
+			t.Negated = !t.Negated
+			out = append(out, SearchClause{Terms: []SearchTerm{t}})
+		}
+		return out, nil
+	}
+
+	alternatives := SearchClause{}
+	for _, c := range clauses {
+		if len(c.Terms) != 1 {
+			return nil, p.errorf("the group is too complex to be negated")
+		}
+		t := c.Terms[0]
+		t.Negated = !t.Negated
+		alternatives.Terms = append(alternatives.Terms, t)
+	}
+	return []SearchClause{alternatives}, nil
+}
+
+// parseTerm parse a word, a phrase or a qualified term
+func (p *searchParser) parseTerm() (SearchTerm, error) {
+	if p.src[p.pos] == '"' {
+		value, err := p.parsePhrase()
+		return SearchTerm{Value: value, Phrase: true}, err
+	}
+
+	start := p.pos
+	word := p.parseWord()
+	if word == "" {
+		return SearchTerm{}, p.errorf("expected a term")
+	}
+
+	sep := strings.IndexByte(word, ':')
+	if sep <= 0 || !searchQualifier.MatchString(word[:sep]) {
+		return SearchTerm{Value: word}, nil
+	}
+
+	name := word[:sep]
+	path, ok := p.allowedFields[name]
+	if !ok {
+		p.pos = start
+		return SearchTerm{}, p.errorf("unknown field %q, the allowed fields are %s", name, joinedMapKeys(p.allowedFields))
+	}
+
+	p.pos = start + len(name) + 1
+	if p.pos < len(p.src) && p.src[p.pos] == '"' {
+		value, err := p.parsePhrase()
+		return SearchTerm{Path: path, Value: value, Phrase: true}, err
+	}
+
+	value := p.parseWord()
+	if value == "" {
+		return SearchTerm{}, p.errorf("expected a value for the field %q", name)
+	}
+	return SearchTerm{Path: path, Value: value}, nil
+}
+
+// parseWord parse the characters until a whitespace, a parenthesis or a quote
+func (p *searchParser) parseWord() string {
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n()\"", p.src[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// parsePhrase parse a double quoted phrase, where \" is a quote and \\ is a backslash
+func (p *searchParser) parsePhrase() (string, error) {
+	start := p.pos
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			if strings.TrimSpace(sb.String()) == "" {
+				p.pos = start
+				return "", p.errorf("empty phrase")
+			}
+			return sb.String(), nil
+		case c == '\\' && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '"' || p.src[p.pos+1] == '\\'):
+			sb.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	p.pos = start
+	return "", p.errorf("unterminated phrase")
+}
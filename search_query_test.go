@@ -0,0 +1,141 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testSearchFields contains the fields that can qualify the terms of the search queries in the tests
+var testSearchFields = map[string]string{"hostname": "hostname", "os": "info.os"}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []SearchClause
+	}{
+		{"empty", "  ", []SearchClause{}},
+		{"words", "linux web", []SearchClause{
+			{Terms: []SearchTerm{{Value: "linux"}}},
+			{Terms: []SearchTerm{{Value: "web"}}},
+		}},
+		{"phrase and negation", `"red hat" -centos`, []SearchClause{
+			{Terms: []SearchTerm{{Value: "red hat", Phrase: true}}},
+			{Terms: []SearchTerm{{Value: "centos", Negated: true}}},
+		}},
+		{"qualified terms", `hostname:web* os:"aix 7"`, []SearchClause{
+			{Terms: []SearchTerm{{Path: "hostname", Value: "web*"}}},
+			{Terms: []SearchTerm{{Path: "info.os", Value: "aix 7", Phrase: true}}},
+		}},
+		{"alternatives", "linux OR (os:aix OR os:hpux) db", []SearchClause{
+			{Terms: []SearchTerm{{Value: "linux"}, {Path: "info.os", Value: "aix"}, {Path: "info.os", Value: "hpux"}}},
+			{Terms: []SearchTerm{{Value: "db"}}},
+		}},
+		{"negated group", "-(aix OR hpux)", []SearchClause{
+			{Terms: []SearchTerm{{Value: "aix", Negated: true}}},
+			{Terms: []SearchTerm{{Value: "hpux", Negated: true}}},
+		}},
+		{"escaped phrase", `"say \"hi\""`, []SearchClause{
+			{Terms: []SearchTerm{{Value: `say "hi"`, Phrase: true}}},
+		}},
+		{"unqualified colon", "10:30", []SearchClause{
+			{Terms: []SearchTerm{{Value: "10:30"}}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSearchQuery(tt.query, testSearchFields)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Clauses, tt.want) {
+				t.Errorf("got %+v, want %+v", got.Clauses, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{"unknown field", "linux password:x",
+			`invalid search query "linux password:x": column 7: unknown field "password", the allowed fields are hostname, os`},
+		{"unbalanced close", "linux )", `invalid search query "linux )": column 7: unbalanced )`},
+		{"unclosed group", "(aix OR hpux", `invalid search query "(aix OR hpux": column 13: expected ) or OR, the terms of a group must be joined by OR`},
+		{"group without OR", "(aix hpux)", `invalid search query "(aix hpux)": column 6: expected ) or OR, the terms of a group must be joined by OR`},
+		{"unterminated phrase", `web "red hat`, `invalid search query "web \"red hat": column 5: unterminated phrase`},
+		{"empty phrase", `"  "`, `invalid search query "\"  \"": column 1: empty phrase`},
+		{"dangling minus", "web -", `invalid search query "web -": column 6: expected a term after -`},
+		{"missing value", "os: web", `invalid search query "os: web": column 4: expected a value for the field "os"`},
+		{"dangling OR", "web OR", `invalid search query "web OR": column 7: expected a term`},
+		{"positions in runes", "città )", `invalid search query "città )": column 7: unbalanced )`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSearchQuery(tt.query, testSearchFields)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSearchQueryStage(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "hostname": "webserver", "info": bson.M{"os": "Red Hat Linux"}},
+		{"_id": 2, "hostname": "db-web", "info": bson.M{"os": "CentOS Linux"}},
+		{"_id": 3, "hostname": "aix-db", "info": bson.M{"os": "AIX 7"}},
+		{"_id": 4, "hostname": "file*server", "info": bson.M{"os": "HP-UX"}},
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"word in any field", "linux", `[{"_id": 1}, {"_id": 2}]`},
+		{"qualified word", "hostname:web", `[{"_id": 1}, {"_id": 2}]`},
+		{"qualified wildcard", "hostname:web*r", `[{"_id": 1}]`},
+		{"wildcard", "a*db", `[{"_id": 3}]`},
+		{"wildcard at the end", "hostname:file*", `[{"_id": 4}]`},
+		{"star in a phrase is literal", `"file*server"`, `[{"_id": 4}]`},
+		{"star in a phrase doesn't match", `"web*"`, `[]`},
+		{"phrase", `"red hat"`, `[{"_id": 1}]`},
+		{"negation", "linux -centos", `[{"_id": 1}]`},
+		{"alternatives", "os:aix OR os:hp-ux", `[{"_id": 3}, {"_id": 4}]`},
+		{"negated group", "-(linux OR aix)", `[{"_id": 4}]`},
+		{"regex metacharacters", "hp.ux", `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage, err := APSearchQueryStage(tt.query, []interface{}{"$hostname", "$info.os"}, testSearchFields)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(stage, APProject(bson.M{"_id": 1})), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
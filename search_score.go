@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SearchField is a field of a scored search
+type SearchField struct {
+	// Field is a expression like "$name"
+	Field interface{}
+	// Weight is the score of a keyword that match the field
+	Weight float64
+}
+
+// SearchScoreOptions contains the options of APSearchScoreStages
+type SearchScoreOptions struct {
+	// Filter contains the options used to filter the documents and to match the keywords
+	Filter SearchFilterOptions
+	// ScoreField is the field set to the score, or "score" if it's empty
+	ScoreField string
+	// ExactBonus is added, multiplied by the weight of the field, when the field is equal to the keyword
+	ExactBonus float64
+	// PrefixBonus is added, multiplied by the weight of the field, when the field start with the keyword but it isn't equal
+	PrefixBonus float64
+	// SortByScore sort the documents by descending score
+	SortByScore bool
+}
+
+// APSearchScoreStages return the stages that filter the documents like APSearchFilterStageWithOptions and set the ScoreField
+// to the relevance of the document, that is the sum of the weights of the fields that match every keyword plus the bonuses
+func APSearchScoreStages(fields []SearchField, keywords []string, options SearchScoreOptions) interface{} {
+	scoreField := options.ScoreField
+	if scoreField == "" {
+		scoreField = "score"
+	}
+
+	filterFields := []interface{}{}
+	for _, f := range fields {
+		filterFields = append(filterFields, f.Field)
+	}
+
+	exactOptions := options.Filter
+	exactOptions.Mode = MatchExact
+	prefixOptions := options.Filter
+	prefixOptions.Mode = MatchPrefix
+
+	scores := []interface{}{}
+	for _, k := range keywords {
+		regex := options.Filter.regex(k)
+		exactRegex := exactOptions.regex(k)
+		prefixRegex := prefixOptions.regex(k)
+
+		for _, f := range fields {
+			bonus := APOCond(searchFieldCondition(f.Field, exactRegex), options.ExactBonus,
+				APOCond(searchFieldCondition(f.Field, prefixRegex), options.PrefixBonus, 0.0),
+			)
+			scores = append(scores, APOCond(searchFieldCondition(f.Field, regex),
+				APOMultiply(f.Weight, APOAdd(1.0, bonus)),
+				0.0,
+			))
+		}
+	}
+
+	var sortStage interface{}
+	if options.SortByScore {
+		sortStage = APSort(bson.M{
+			scoreField: -1,
+		})
+	}
+
+	return MAPipeline(
+		APSearchFilterStageWithOptions(filterFields, keywords, options.Filter),
+		APSet(bson.M{
+			scoreField: APOAdd(scores...),
+		}),
+		sortStage,
+	)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSearchScoreStages(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "name": "web", "description": "frontend"},
+		{"_id": 2, "name": "webserver", "description": "web frontend"},
+		{"_id": 3, "name": "db", "description": "used by the web frontend"},
+		{"_id": 4, "name": "db", "description": "backend"},
+	}
+	fields := []SearchField{{Field: "$name", Weight: 10}, {Field: "$description", Weight: 1}}
+	tests := []struct {
+		name     string
+		keywords []string
+		options  SearchScoreOptions
+		want     string
+	}{
+		{"default score field", []string{"web"}, SearchScoreOptions{},
+			`[{"_id": 1, "score": 10.0}, {"_id": 2, "score": 11.0}, {"_id": 3, "score": 1.0}]`},
+		{"bonuses", []string{"web"}, SearchScoreOptions{ScoreField: "s", ExactBonus: 1, PrefixBonus: 0.5},
+			`[{"_id": 1, "s": 20.0}, {"_id": 2, "s": 16.5}, {"_id": 3, "s": 1.0}]`},
+		{"sorted by score", []string{"web"}, SearchScoreOptions{SortByScore: true, ExactBonus: 1},
+			`[{"_id": 1, "score": 20.0}, {"_id": 2, "score": 11.0}, {"_id": 3, "score": 1.0}]`},
+		{"every keyword", []string{"web", "frontend"}, SearchScoreOptions{},
+			`[{"_id": 1, "score": 11.0}, {"_id": 2, "score": 12.0}, {"_id": 3, "score": 2.0}]`},
+		{"any keyword", []string{"web", "backend"}, SearchScoreOptions{Filter: SearchFilterOptions{Logic: MatchAnyKeyword}},
+			`[{"_id": 1, "score": 10.0}, {"_id": 2, "score": 11.0}, {"_id": 3, "score": 1.0}, {"_id": 4, "score": 1.0}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewMemoryEngine().Aggregate(MAPipeline(
+				APSearchScoreStages(fields, tt.keywords, tt.options),
+				APUnset("name", "description"),
+			), docs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, out, tt.want)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+// StructProjectionOptions contains the options of the projections and of the field paths derived from structs
+type StructProjectionOptions struct {
+	// Exclude contains the paths of the fields of the struct that are ignored, like info.os or info for all its fields
+	Exclude []string
+	// Rename contains the paths of the documents of the fields of the struct that are stored elsewhere,
+	// like {"hostname": "info.hostname"}
+	Rename map[string]string
+}
+
+// marshalerTypes contains the interfaces of the types that are marshalled as bson values instead of documents
+var marshalerTypes = []reflect.Type{
+	reflect.TypeOf((*bsoncodec.ValueMarshaler)(nil)).Elem(),
+	reflect.TypeOf((*bsoncodec.Marshaler)(nil)).Elem(),
+}
+
+// StructFieldPaths return the paths of the leaf fields of the struct type of v, that could also be a pointer or a slice of them,
+// as they are read by the bson decoder. The nested structs are walked, the inline ones are flattened into their parent
+// and the fields with the bson:"-" tag are skipped. The renamed fields have the paths of the documents
+func StructFieldPaths(v interface{}, options StructProjectionOptions) []string {
+	out := []string{}
+	for _, f := range structFields(v, options) {
+		out = append(out, f.source)
+	}
+	return out
+}
+
+// StructSearchFields return the fields of StructFieldPaths as field paths like $info.os,
+// to be used as the fields of APSearchFilterStage
+func StructSearchFields(v interface{}, options StructProjectionOptions) []interface{} {
+	out := []interface{}{}
+	for _, f := range structFields(v, options) {
+		out = append(out, "$"+f.source)
+	}
+	return out
+}
+
+// StructProjection return the projection of the fields of the struct type of v, walked like in StructFieldPaths.
+// The renamed fields are projected from their paths in the documents and the _id is excluded if the struct doesn't contain it.
+// It return a error if v isn't a struct or if all its fields are excluded, because the projection would contain only the _id
+func StructProjection(v interface{}, options StructProjectionOptions) (bson.D, error) {
+	fields := structFields(v, options)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("the type %T doesn't have fields to project", v)
+	}
+
+	out := bson.D{}
+	hasID := false
+	for _, f := range fields {
+		if f.path == "_id" {
+			hasID = true
+		}
+		if f.source != f.path {
+			out = append(out, bson.E{Key: f.path, Value: "$" + f.source})
+		} else {
+			out = append(out, bson.E{Key: f.path, Value: true})
+		}
+	}
+	if !hasID {
+		out = append(bson.D{{Key: "_id", Value: false}}, out...)
+	}
+
+	return out, nil
+}
+
+// APStructProjectStage return a project stage of the fields of the struct type of v, as returned by StructProjection
+func APStructProjectStage(v interface{}, options StructProjectionOptions) (interface{}, error) {
+	projection, err := StructProjection(v, options)
+	if err != nil {
+		return nil, err
+	}
+	return APProject(projection), nil
+}
+
+// structField is a leaf field of a struct
+type structField struct {
+	// path is the path of the field in the struct
+	path string
+	// source is the path of the field in the documents
+	source string
+}
+
+// structFields return the leaf fields of the struct type of v that aren't excluded
+func structFields(v interface{}, options StructProjectionOptions) []structField {
+	if v == nil {
+		return nil
+	}
+	t := derefStructType(reflect.TypeOf(v))
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	out := []structField{}
+	for _, path := range collectStructPaths(t, "", map[reflect.Type]bool{}) {
+		excluded := false
+		for _, ex := range options.Exclude {
+			if path == ex || strings.HasPrefix(path, ex+".") {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			continue
+		}
+
+		source := path
+		if renamed, ok := options.Rename[path]; ok {
+			source = renamed
+		}
+		out = append(out, structField{path: path, source: source})
+	}
+
+	return out
+}
+
+// collectStructPaths return the paths of the leaf fields of the struct type t prefixed by prefix.
+// visiting contains the struct types being walked, to stop at the recursive types
+func collectStructPaths(t reflect.Type, prefix string, visiting map[reflect.Type]bool) []string {
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	out := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tags, err := bsoncodec.DefaultStructTagParser(sf)
+		if err != nil || tags.Skip {
+			continue
+		}
+
+		ft := derefStructType(sf.Type)
+		nested := isDocumentStruct(ft) && !visiting[ft]
+		if tags.Inline {
+			if nested {
+				out = append(out, collectStructPaths(ft, prefix, visiting)...)
+			}
+			// the inline maps contain the unknown fields, that can't be projected
+			continue
+		}
+
+		path := prefix + tags.Name
+		if nested {
+			out = append(out, collectStructPaths(ft, path+".", visiting)...)
+		} else {
+			out = append(out, path)
+		}
+	}
+
+	return out
+}
+
+// derefStructType return the type of the elements of the pointers, slices and arrays t
+func derefStructType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		if t.Kind() != reflect.Ptr && t.Elem().Kind() == reflect.Uint8 {
+			return t
+		}
+		t = t.Elem()
+	}
+	return t
+}
+
+// isDocumentStruct return true if t is a struct with fields that is marshalled as a document,
+// unlike the time.Time and the primitive types
+func isDocumentStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t.NumField() == 0 {
+		return false
+	}
+	if t.PkgPath() == "time" || t.PkgPath() == "go.mongodb.org/mongo-driver/bson/primitive" {
+		return false
+	}
+	for _, m := range marshalerTypes {
+		if t.Implements(m) || reflect.PtrTo(t).Implements(m) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testHostInfo is a nested struct of testHost
+type testHostInfo struct {
+	OS     string    `bson:"os"`
+	Kernel string    `bson:"kernel,omitempty"`
+	Boot   time.Time `bson:"boot"`
+}
+
+// testHostBase is a struct inlined in testHost
+type testHostBase struct {
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// testHost is a struct with every kind of field walked by the struct projections
+type testHost struct {
+	ID       primitive.ObjectID      `bson:"_id"`
+	Hostname string                  `bson:"hostname"`
+	Info     *testHostInfo           `bson:"info"`
+	Disks    []struct{ Name string } `bson:"disks"`
+	Data     []byte                  `bson:"data"`
+	Parent   *testHost               `bson:"parent"`
+	Secret   string                  `bson:"-"`
+	Base     testHostBase            `bson:",inline"`
+	Extra    bson.M                  `bson:",inline"`
+	internal int
+}
+
+func TestStructFieldPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		options StructProjectionOptions
+		want    []string
+	}{
+		{"struct", testHost{}, StructProjectionOptions{},
+			[]string{"_id", "hostname", "info.os", "info.kernel", "info.boot", "disks.name", "data", "parent", "createdAt"}},
+		{"slice of pointers", []*testHostInfo{}, StructProjectionOptions{}, []string{"os", "kernel", "boot"}},
+		{"excluded and renamed", &testHost{}, StructProjectionOptions{
+			Exclude: []string{"info", "disks.name", "parent", "data"},
+			Rename:  map[string]string{"hostname": "names.host"},
+		}, []string{"_id", "names.host", "createdAt"}},
+		{"not a struct", 42, StructProjectionOptions{}, []string{}},
+		{"nil", nil, StructProjectionOptions{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StructFieldPaths(tt.v, tt.options); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := StructSearchFields(testHostInfo{}, StructProjectionOptions{Exclude: []string{"boot"}}); !reflect.DeepEqual(got, []interface{}{"$os", "$kernel"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestStructProjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		options StructProjectionOptions
+		want    string
+	}{
+		{"without _id", testHostInfo{}, StructProjectionOptions{}, `{"_id":false,"os":true,"kernel":true,"boot":true}`},
+		{"with _id and renamed fields", testHost{}, StructProjectionOptions{
+			Exclude: []string{"info", "disks", "parent", "data"},
+			Rename:  map[string]string{"hostname": "names.host"},
+		}, `{"_id":true,"hostname":"$names.host","createdAt":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			projection, err := StructProjection(tt.v, tt.options)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := bson.MarshalExtJSON(projection, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructProjectionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		options StructProjectionOptions
+	}{
+		{"not a struct", "hostname", StructProjectionOptions{}},
+		{"nil", nil, StructProjectionOptions{}},
+		{"every field excluded", testHostInfo{}, StructProjectionOptions{Exclude: []string{"os", "kernel", "boot"}}},
+		{"struct without fields", struct{ internal int }{}, StructProjectionOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if projection, err := StructProjection(tt.v, tt.options); err == nil {
+				t.Errorf("expected a error, got %v", projection)
+			}
+			if stage, err := APStructProjectStage(tt.v, tt.options); err == nil {
+				t.Errorf("expected a error, got %v", stage)
+			}
+		})
+	}
+}
+
+func TestStructProjectStage(t *testing.T) {
+	docs := []bson.M{{"_id": 1, "os": "linux", "kernel": "5.4", "password": "x"}}
+	stage, err := APStructProjectStage(testHostInfo{}, StructProjectionOptions{Exclude: []string{"boot"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := mustAggregate(t, MAPipeline(stage), docs)
+	assertJSON(t, out, `[{"os": "linux", "kernel": "5.4"}]`)
+
+	// the projected documents are decoded into the struct
+	raw, err := bson.Marshal(out[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded testHostInfo
+	if err := bson.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.OS != "linux" || decoded.Kernel != "5.4" {
+		t.Errorf("got %+v", decoded)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// arrayFilterIdentifier match the identifiers of the filtered positional operators, like $[elem]
+var arrayFilterIdentifier = regexp.MustCompile(`^\$\[([a-z][A-Za-z0-9]*)\]$`)
+
+// PositionalPath return the path of the field of the first element of array that match the query, like array.$.field.
+// field can be empty
+func PositionalPath(array string, field string) string {
+	return joinUpdatePath(array, "$", field)
+}
+
+// AllPositionalPath return the path of the field of all the elements of array, like array.$[].field. field can be empty
+func AllPositionalPath(array string, field string) string {
+	return joinUpdatePath(array, "$[]", field)
+}
+
+// FilteredPositionalPath return the path of the field of the elements of array that match the array filter of the
+// identifier, like array.$[identifier].field. field can be empty
+func FilteredPositionalPath(array string, identifier string, field string) string {
+	return joinUpdatePath(array, "$["+identifier+"]", field)
+}
+
+// joinUpdatePath return the path of the field of the element of array
+func joinUpdatePath(array string, element string, field string) string {
+	if field == "" {
+		return array + "." + element
+	}
+	return array + "." + element + "." + field
+}
+
+// Update is a builder of update documents that merge several update operators, like UOSet and UOPush,
+// and keep the array filters of the filtered positional paths. The paths modified by more than one operator,
+// or that are one the prefix of the other, conflict and make the update invalid
+type Update struct {
+	operators    bson.D
+	paths        map[string]string
+	arrayFilters []interface{}
+	identifiers  map[string]bool
+	err          error
+}
+
+// NewUpdate return a empty update
+func NewUpdate() *Update {
+	return &Update{
+		operators:    bson.D{},
+		paths:        map[string]string{},
+		arrayFilters: []interface{}{},
+		identifiers:  map[string]bool{},
+	}
+}
+
+// Add merge the update operators into the update
+func (u *Update) Add(operators ...interface{}) *Update {
+	for _, operator := range operators {
+		ops, err := sortedUpdateDocument(operator)
+		if err != nil {
+			u.fail(err)
+			continue
+		}
+		for _, op := range ops {
+			if !strings.HasPrefix(op.Key, "$") {
+				u.fail(fmt.Errorf("%s is not a update operator", op.Key))
+				continue
+			}
+			fields, err := sortedUpdateDocument(op.Value)
+			if err != nil {
+				u.fail(fmt.Errorf("%s: %v", op.Key, err))
+				continue
+			}
+			for _, f := range fields {
+				u.addField(op.Key, f)
+			}
+		}
+	}
+	return u
+}
+
+// ArrayFilter add the array filter of the identifier used by the filtered positional paths. The keys of the filter are
+// the fields of the elements, or empty for the elements themselves, like {"": QOGreaterThan(5)} or {"grade": 85}
+func (u *Update) ArrayFilter(identifier string, filter bson.M) *Update {
+	if u.identifiers[identifier] {
+		u.fail(fmt.Errorf("found multiple array filters with the same top-level field name %s", identifier))
+		return u
+	}
+	u.identifiers[identifier] = true
+
+	out := bson.D{}
+	fields, _ := sortedUpdateDocument(filter)
+	for _, e := range fields {
+		key := identifier
+		if e.Key != "" {
+			key += "." + e.Key
+		}
+		out = append(out, bson.E{Key: key, Value: e.Value})
+	}
+	u.arrayFilters = append(u.arrayFilters, out)
+	return u
+}
+
+// Bson return the update document, or a error if the paths conflict or the array filters don't match the paths
+func (u *Update) Bson() (bson.D, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	paths := make([]string, 0, len(u.paths))
+	for path := range u.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	used := map[string]bool{}
+	for _, path := range paths {
+		for _, segment := range strings.Split(path, ".") {
+			if m := arrayFilterIdentifier.FindStringSubmatch(segment); m != nil {
+				if !u.identifiers[m[1]] {
+					return nil, fmt.Errorf("no array filter found for identifier '%s' in path '%s'", m[1], path)
+				}
+				used[m[1]] = true
+			}
+		}
+	}
+	for identifier := range u.identifiers {
+		if !used[identifier] {
+			return nil, fmt.Errorf("the array filter for identifier '%s' was not used in the update", identifier)
+		}
+	}
+
+	return u.operators, nil
+}
+
+// ArrayFilters return the array filters of the update
+func (u *Update) ArrayFilters() []interface{} {
+	return u.arrayFilters
+}
+
+// Options return the update options with the array filters of the update, if any
+func (u *Update) Options() *options.UpdateOptions {
+	opts := options.Update()
+	if len(u.arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: u.arrayFilters})
+	}
+	return opts
+}
+
+// addField add the field of the operator op, checking that its paths don't conflict with the previous ones
+func (u *Update) addField(op string, field bson.E) {
+	paths := []string{field.Key}
+	if op == "$rename" {
+		target, ok := field.Value.(string)
+		if !ok {
+			u.fail(fmt.Errorf("the 'to' field for $rename must be a string: %s", field.Key))
+			return
+		}
+		paths = append(paths, target)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			u.fail(fmt.Errorf("an empty update path is not valid"))
+			return
+		}
+		for other, otherOp := range u.paths {
+			if updatePathsConflict(path, other) {
+				u.fail(fmt.Errorf("updating the path '%s' of %s would create a conflict at '%s' of %s", path, op, other, otherOp))
+				return
+			}
+		}
+	}
+	for _, path := range paths {
+		u.paths[path] = op
+	}
+
+	for i, e := range u.operators {
+		if e.Key == op {
+			u.operators[i].Value = append(e.Value.(bson.D), field)
+			return
+		}
+	}
+	u.operators = append(u.operators, bson.E{Key: op, Value: bson.D{field}})
+}
+
+// fail set the error of the update, if it doesn't have one
+func (u *Update) fail(err error) {
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+// updatePathsConflict return true if the paths are the same or one is the prefix of the other
+func updatePathsConflict(a string, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return a == b || strings.HasPrefix(b, a+".")
+}
+
+// sortedUpdateDocument return the document v as a ordered document. The keys of a bson.M are sorted
+// and the other values, like the structs, are marshalled
+func sortedUpdateDocument(v interface{}) (bson.D, error) {
+	switch d := v.(type) {
+	case bson.D:
+		return d, nil
+	case bson.M:
+		out := bson.D{}
+		for k, v := range d {
+			out = append(out, bson.E{Key: k, Value: v})
+		}
+		sort.Slice(out, func(i, j int) bool {
+			return out[i].Key < out[j].Key
+		})
+		return out, nil
+	}
+
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out := bson.D{}
+	if err := bson.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -19,7 +19,110 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-// QOSize return the size operator
+// UOSet return the set operator of the fields to the values
 func UOSet(value interface{}) interface{} {
 	return bson.M{"$set": value}
 }
+
+// UOUnset return the unset operator of the fields
+func UOUnset(fields ...string) interface{} {
+	values := bson.M{}
+	for _, f := range fields {
+		values[f] = ""
+	}
+	return bson.M{"$unset": values}
+}
+
+// UOInc return the increment operator of the fields by the values
+func UOInc(values interface{}) interface{} {
+	return bson.M{"$inc": values}
+}
+
+// UOMul return the multiply operator of the fields by the values
+func UOMul(values interface{}) interface{} {
+	return bson.M{"$mul": values}
+}
+
+// UORename return the rename operator of the fields to the new names
+func UORename(names interface{}) interface{} {
+	return bson.M{"$rename": names}
+}
+
+// UOMin return the operator that set the fields to the values if they are less than the current ones
+func UOMin(values interface{}) interface{} {
+	return bson.M{"$min": values}
+}
+
+// UOMax return the operator that set the fields to the values if they are greater than the current ones
+func UOMax(values interface{}) interface{} {
+	return bson.M{"$max": values}
+}
+
+// UOCurrentDate return the operator that set the fields to the current date
+func UOCurrentDate(fields ...string) interface{} {
+	values := bson.M{}
+	for _, f := range fields {
+		values[f] = true
+	}
+	return bson.M{"$currentDate": values}
+}
+
+// UOSetOnInsert return the set operator of the fields to the values applied only when a upsert insert the document
+func UOSetOnInsert(values interface{}) interface{} {
+	return bson.M{"$setOnInsert": values}
+}
+
+// UOAddToSet return the operator that add to the array field the values that it doesn't contain
+func UOAddToSet(field string, values ...interface{}) interface{} {
+	return bson.M{"$addToSet": bson.M{field: bson.M{"$each": values}}}
+}
+
+// PushOptions contains the options of UOPushWithOptions. The nil options are omitted
+type PushOptions struct {
+	// Position is the index where the values are inserted, negative if counted from the end
+	Position *int
+	// Slice is the number of elements kept after the push, from the end if negative
+	Slice *int
+	// Sort is the order of the elements after the push, 1 or -1 for values or a sort document for documents
+	Sort interface{}
+}
+
+// UOPush return the operator that append the values to the array field
+func UOPush(field string, values ...interface{}) interface{} {
+	return UOPushWithOptions(field, values, PushOptions{})
+}
+
+// UOPushWithOptions return the operator that insert the values in the array field, sorting and slicing it after
+func UOPushWithOptions(field string, values []interface{}, options PushOptions) interface{} {
+	// the modifiers are a bson.D to always produce the same document
+	push := bson.D{{Key: "$each", Value: values}}
+	if options.Position != nil {
+		push = append(push, bson.E{Key: "$position", Value: *options.Position})
+	}
+	if options.Slice != nil {
+		push = append(push, bson.E{Key: "$slice", Value: *options.Slice})
+	}
+	if options.Sort != nil {
+		push = append(push, bson.E{Key: "$sort", Value: options.Sort})
+	}
+	return bson.M{"$push": bson.M{field: push}}
+}
+
+// UOPull return the operator that remove from the array field the elements that are equal to the condition,
+// or that satisfy it if it's a query condition
+func UOPull(field string, condition interface{}) interface{} {
+	return bson.M{"$pull": bson.M{field: condition}}
+}
+
+// UOPullAll return the operator that remove from the array field the elements equal to any of the values
+func UOPullAll(field string, values ...interface{}) interface{} {
+	return bson.M{"$pullAll": bson.M{field: values}}
+}
+
+// UOPop return the operator that remove the first element of the array field if first is true, otherwise the last one
+func UOPop(field string, first bool) interface{} {
+	if first {
+		return bson.M{"$pop": bson.M{field: -1}}
+	}
+	return bson.M{"$pop": bson.M{field: 1}}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// updatePipelineStages contains the stages allowed in the pipelines used as update, that require MongoDB 4.2
+var updatePipelineStages = map[string]bool{
+	"$set":         true,
+	"$addFields":   true,
+	"$unset":       true,
+	"$project":     true,
+	"$replaceWith": true,
+	"$replaceRoot": true,
+}
+
+// UpdatePipeline is a builder of the aggregation pipelines used as update, that can contain only
+// the $set, $addFields, $unset, $project, $replaceWith and $replaceRoot stages
+type UpdatePipeline struct {
+	stages bson.A
+}
+
+// NewUpdatePipeline return a empty update pipeline
+func NewUpdatePipeline() *UpdatePipeline {
+	return &UpdatePipeline{stages: bson.A{}}
+}
+
+// Add append the stages, that could be single stages or slices of stages like in MAPipeline
+func (p *UpdatePipeline) Add(stages ...interface{}) *UpdatePipeline {
+	p.stages = append(p.stages, MAPipeline(stages...)...)
+	return p
+}
+
+// Recompute append a stage that set the derived field to the value of the expression, like a total computed from other fields
+func (p *UpdatePipeline) Recompute(field string, expr interface{}) *UpdatePipeline {
+	return p.Add(APSet(bson.M{
+		field: expr,
+	}))
+}
+
+// AppendIfAbsent append a stage that append the value to the array field if it doesn't contain it.
+// The field is created if it's missing or null
+func (p *UpdatePipeline) AppendIfAbsent(field string, value interface{}) *UpdatePipeline {
+	current := APOIfNull("$"+field, bson.A{})
+	literal := bson.M{"$literal": value}
+
+	return p.Add(APSet(bson.M{
+		field: APOCond(APOIn(literal, current), current, APOConcatArrays(current, bson.A{literal})),
+	}))
+}
+
+// RenameField append the stages that move the value of the field from, that could be nested like a.b, to the field to.
+// Nothing is changed if from is missing
+func (p *UpdatePipeline) RenameField(from string, to string) *UpdatePipeline {
+	return p.Add(
+		APSet(bson.M{
+			to: "$" + from,
+		}),
+		APUnset(from),
+	)
+}
+
+// Bson return the update pipeline, or a error if it contains a stage that isn't allowed or isn't valid
+func (p *UpdatePipeline) Bson() (bson.A, error) {
+	normalized, err := normalizePipeline(p.stages)
+	if err != nil {
+		return nil, &ValidationError{Path: "pipeline", Message: err.Error()}
+	}
+	for i, s := range normalized {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) != 1 {
+			continue
+		}
+		if !updatePipelineStages[stage[0].Key] {
+			return nil, validationErrorf(fmt.Sprintf("stage[%d]", i), "%s is not allowed to be used within an update", stage[0].Key)
+		}
+	}
+
+	if err := Validate(p.stages); err != nil {
+		return nil, err
+	}
+	return p.stages, nil
+}
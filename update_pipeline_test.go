@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUpdatePipeline(t *testing.T) {
+	docs := []bson.M{
+		{"_id": 1, "price": 10, "qty": 3, "tags": bson.A{"web"}, "info": bson.M{"old": "x"}},
+		{"_id": 2, "price": 5, "qty": 2, "tags": nil},
+		{"_id": 3, "price": 1, "qty": 1},
+	}
+	tests := []struct {
+		name     string
+		pipeline *UpdatePipeline
+		want     string
+	}{
+		{"recompute", NewUpdatePipeline().Recompute("total", APOMultiply("$price", "$qty")).Add(APProject(bson.M{"total": 1})),
+			`[{"_id": 1, "total": 30}, {"_id": 2, "total": 10}, {"_id": 3, "total": 1}]`},
+		{"append if absent", NewUpdatePipeline().AppendIfAbsent("tags", "web").Add(APProject(bson.M{"tags": 1})),
+			`[{"_id": 1, "tags": ["web"]}, {"_id": 2, "tags": ["web"]}, {"_id": 3, "tags": ["web"]}]`},
+		{"append a document", NewUpdatePipeline().AppendIfAbsent("tags", bson.M{"$name": "db"}).Add(APProject(bson.M{"tags": 1})),
+			`[{"_id": 1, "tags": ["web", {"$name": "db"}]}, {"_id": 2, "tags": [{"$name": "db"}]}, {"_id": 3, "tags": [{"$name": "db"}]}]`},
+		{"rename nested field", NewUpdatePipeline().RenameField("info.old", "renamed").Add(APProject(bson.M{"info": 1, "renamed": 1})),
+			`[{"_id": 1, "info": {}, "renamed": "x"}, {"_id": 2}, {"_id": 3}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := tt.pipeline.Bson()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, mustAggregate(t, pipeline, docs), tt.want)
+		})
+	}
+}
+
+func TestUpdatePipelineErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline *UpdatePipeline
+		wantErr  string
+	}{
+		{"stage not allowed", NewUpdatePipeline().Recompute("a", 1).Add(APMatch(bson.M{"a": 1})),
+			"stage[1]: $match is not allowed to be used within an update"},
+		{"invalid stage", NewUpdatePipeline().Add(APSet(bson.M{"$a": 1})), "stage[0].$set.$a: the field path cannot contain a component starting with $"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.pipeline.Bson()
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("expected a ValidationError, got %v", err)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
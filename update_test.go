@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Sorint.lab S.p.A.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mu
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUpdate(t *testing.T) {
+	two := 2
+	tests := []struct {
+		name   string
+		update *Update
+		want   string
+	}{
+		{"empty", NewUpdate(), `{}`},
+		{"merged operators", NewUpdate().Add(UOSet(bson.M{"b": 1, "a": 2}), UOInc(bson.M{"n": 1}), UOSet(bson.M{"c": 3})),
+			`{"$set":{"a":2,"b":1,"c":3},"$inc":{"n":1}}`},
+		{"many operators in a document", NewUpdate().Add(bson.M{"$unset": bson.M{"x": ""}, "$currentDate": bson.M{"at": true}}),
+			`{"$currentDate":{"at":true},"$unset":{"x":""}}`},
+		{"sibling paths", NewUpdate().Add(UOSet(bson.M{"a.b": 1}), UOSet(bson.M{"a.bc": 2}), UOUnset("ab")),
+			`{"$set":{"a.b":1,"a.bc":2},"$unset":{"ab":""}}`},
+		{"array operators", NewUpdate().Add(
+			UOPushWithOptions("log", []interface{}{"x"}, PushOptions{Slice: &two}),
+			UOAddToSet("tags", "web"),
+			UOPop("queue", true),
+		), `{"$push":{"log":{"$each":["x"],"$slice":2}},"$addToSet":{"tags":{"$each":["web"]}},"$pop":{"queue":-1}}`},
+		{"push modifiers", NewUpdate().Add(
+			UOPushWithOptions("log", []interface{}{"x", "y"}, PushOptions{Sort: -1, Slice: &two, Position: &two}),
+		), `{"$push":{"log":{"$each":["x","y"],"$position":2,"$slice":2,"$sort":-1}}}`},
+		{"rename", NewUpdate().Add(UORename(bson.M{"old": "new"}), UOSet(bson.M{"other": 1})),
+			`{"$rename":{"old":"new"},"$set":{"other":1}}`},
+		{"positional paths", NewUpdate().Add(
+			UOSet(bson.M{PositionalPath("items", "qty"): 1}),
+			UOInc(bson.M{AllPositionalPath("scores", ""): 1}),
+		), `{"$set":{"items.$.qty":1},"$inc":{"scores.$[]":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := tt.update.Bson()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := bson.MarshalExtJSON(doc, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  *Update
+		wantErr string
+	}{
+		{"same path", NewUpdate().Add(UOSet(bson.M{"a": 1}), UOInc(bson.M{"a": 1})),
+			"updating the path 'a' of $inc would create a conflict at 'a' of $set"},
+		{"same path in the same operator", NewUpdate().Add(UOSet(bson.M{"a": 1}), UOSet(bson.M{"a": 2})),
+			"updating the path 'a' of $set would create a conflict at 'a' of $set"},
+		{"prefix", NewUpdate().Add(UOSet(bson.M{"a.b": 1}), UOUnset("a")),
+			"updating the path 'a' of $unset would create a conflict at 'a.b' of $set"},
+		{"rename target", NewUpdate().Add(UOSet(bson.M{"new.x": 1}), UORename(bson.M{"old": "new"})),
+			"updating the path 'new' of $rename would create a conflict at 'new.x' of $set"},
+		{"rename source", NewUpdate().Add(UORename(bson.M{"old": "new"}), UOPush("old", 1)),
+			"updating the path 'old' of $push would create a conflict at 'old' of $rename"},
+		{"rename to a string", NewUpdate().Add(UORename(bson.M{"old": 1})),
+			"the 'to' field for $rename must be a string: old"},
+		{"empty path", NewUpdate().Add(UOSet(bson.M{"": 1})), "an empty update path is not valid"},
+		{"not a operator", NewUpdate().Add(bson.M{"a": 1}), "a is not a update operator"},
+		{"the first error is kept", NewUpdate().Add(bson.M{"a": 1}, UOSet(bson.M{"": 1})), "a is not a update operator"},
+		{"missing array filter", NewUpdate().Add(UOSet(bson.M{FilteredPositionalPath("grades", "elem", ""): 0})),
+			"no array filter found for identifier 'elem' in path 'grades.$[elem]'"},
+		{"unused array filter", NewUpdate().Add(UOSet(bson.M{"a": 1})).ArrayFilter("elem", bson.M{"": 1}),
+			"the array filter for identifier 'elem' was not used in the update"},
+		{"repeated array filter", NewUpdate().ArrayFilter("elem", bson.M{"": 1}).ArrayFilter("elem", bson.M{"": 2}),
+			"found multiple array filters with the same top-level field name elem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.update.Bson(); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdateArrayFilters(t *testing.T) {
+	update := NewUpdate().
+		Add(UOSet(bson.M{FilteredPositionalPath("grades", "elem", "mean"): 100})).
+		Add(UOInc(bson.M{FilteredPositionalPath("scores", "low", ""): 1})).
+		ArrayFilter("elem", bson.M{"grade": QOGreaterThanOrEqual(85), "mean": QOLessThan(100)}).
+		ArrayFilter("low", bson.M{"": QOLessThan(5)})
+	if _, err := update.Bson(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := bson.MarshalExtJSON(bson.M{"f": update.ArrayFilters()}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"f":[{"elem.grade":{"$gte":85},"elem.mean":{"$lt":100}},{"low":{"$lt":5}}]}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if filters := update.Options().ArrayFilters; filters == nil || len(filters.Filters) != 2 {
+		t.Errorf("expected the array filters in the options, got %v", filters)
+	}
+	if filters := NewUpdate().Options().ArrayFilters; filters != nil {
+		t.Errorf("expected no array filters in the options, got %v", filters)
+	}
+}
@@ -17,6 +17,8 @@ package mu
 
 import (
 	"reflect"
+	"sort"
+	"strings"
 )
 
 // sliceToSliceOfInterface convert a interface to a slice of interface
@@ -34,3 +36,20 @@ func sliceToSliceOfInterface(slice interface{}) []interface{} {
 
 	return ret
 }
+
+// joinedMapKeys return the sorted keys of the map m, that must have string keys, joined by commas.
+// It's used to list the allowed fields in the error messages
+func joinedMapKeys(m interface{}) string {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map {
+		panic("joinedMapKeys() given a non-map type")
+	}
+
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ", ")
+}